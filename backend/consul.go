@@ -0,0 +1,74 @@
+package backend
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// ConsulBackend uses a Consul lock, and stores state in Consul KV
+type ConsulBackend struct {
+	client *consulapi.Client
+	prefix string // Consul KV prefix to write state to
+}
+
+// NewConsul ...
+func NewConsul() (*ConsulBackend, error) {
+	prefix := "nomad-firehose"
+	if v, ok := os.LookupEnv("NOMAD_FIREHOSE_CONSUL_PREFIX"); ok {
+		prefix = strings.TrimSuffix(v, "/")
+	}
+
+	client, err := consulapi.NewClient(consulapi.DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConsulBackend{
+		client: client,
+		prefix: prefix,
+	}, nil
+}
+
+// NewLock ...
+func (b *ConsulBackend) NewLock(name string) (Locker, error) {
+	lock, err := b.client.LockOpts(&consulapi.LockOptions{
+		Key:              fmt.Sprintf("%s/%s.lock", b.prefix, name),
+		SessionName:      fmt.Sprintf("nomad-firehose-%s", name),
+		MonitorRetries:   10,
+		MonitorRetryTime: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed create lock options: %+v", err)
+	}
+
+	return lock, nil
+}
+
+// Get ...
+func (b *ConsulBackend) Get(name string) ([]byte, error) {
+	kv, _, err := b.client.KV().Get(fmt.Sprintf("%s/%s.value", b.prefix, name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if kv == nil {
+		return nil, nil
+	}
+
+	return kv.Value, nil
+}
+
+// Put ...
+func (b *ConsulBackend) Put(name string, value []byte) error {
+	kv := &consulapi.KVPair{
+		Key:   fmt.Sprintf("%s/%s.value", b.prefix, name),
+		Value: value,
+	}
+
+	_, err := b.client.KV().Put(kv, nil)
+	return err
+}
@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileBackend stores state in files on local disk, and uses a file lock so only one process
+// on the host runs a firehose type. It is meant for single-instance deployments
+type FileBackend struct {
+	path string // directory to write state to
+}
+
+// NewFile ...
+func NewFile() (*FileBackend, error) {
+	path := os.Getenv("NOMAD_FIREHOSE_FILE_PATH")
+	if path == "" {
+		return nil, fmt.Errorf("[backend/file] Missing NOMAD_FIREHOSE_FILE_PATH (example: /var/lib/nomad-firehose)")
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("[backend/file] Could not create %s: %s", path, err)
+	}
+
+	return &FileBackend{
+		path: path,
+	}, nil
+}
+
+// NewLock ...
+func (b *FileBackend) NewLock(name string) (Locker, error) {
+	return &fileLock{
+		path: filepath.Join(b.path, name+".lock"),
+	}, nil
+}
+
+// Get ...
+func (b *FileBackend) Get(name string) ([]byte, error) {
+	value, err := ioutil.ReadFile(filepath.Join(b.path, name+".value"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return value, err
+}
+
+// Put writes the value to a temporary file first, so a crash never leaves a partial value behind
+func (b *FileBackend) Put(name string, value []byte) error {
+	path := filepath.Join(b.path, name+".value")
+
+	// Names of firehoses watching a specific region contain a "/"
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
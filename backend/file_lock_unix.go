@@ -0,0 +1,67 @@
+// +build darwin linux
+
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fileLock is an exclusive flock(2) on a file, released by the kernel if the process dies
+type fileLock struct {
+	path string
+	file *os.File
+}
+
+// Lock ...
+func (l *fileLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			l.file = file
+
+			// A local file lock can't be lost while we hold it
+			return make(chan struct{}), nil
+		}
+
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, err
+		}
+
+		log.Debugf("[backend/file] %s is locked by another process", l.path)
+
+		select {
+		case <-stopCh:
+			file.Close()
+			return nil, nil
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// Unlock ...
+func (l *fileLock) Unlock() error {
+	if l.file == nil {
+		return nil
+	}
+
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	l.file = nil
+
+	return err
+}
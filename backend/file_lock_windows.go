@@ -0,0 +1,23 @@
+// +build windows
+
+package backend
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// fileLock is not supported on Windows, the file backend must only be run by a single process
+type fileLock struct {
+	path string
+}
+
+// Lock ...
+func (l *fileLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	log.Warnf("[backend/file] File locks are not supported on Windows, not locking %s", l.path)
+	return make(chan struct{}), nil
+}
+
+// Unlock ...
+func (l *fileLock) Unlock() error {
+	return nil
+}
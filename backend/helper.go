@@ -0,0 +1,24 @@
+package backend
+
+import (
+	"fmt"
+	"os"
+)
+
+// GetBackend creates the backend configured by NOMAD_FIREHOSE_BACKEND, Consul by default
+func GetBackend() (Backend, error) {
+	backendType := os.Getenv("NOMAD_FIREHOSE_BACKEND")
+
+	switch backendType {
+	case "", "consul":
+		return NewConsul()
+	case "file":
+		return NewFile()
+	case "nomad":
+		return NewNomad()
+	case "redis":
+		return NewRedis()
+	default:
+		return nil, fmt.Errorf("Invalid NOMAD_FIREHOSE_BACKEND: %s, Valid values: consul, file, nomad, redis", backendType)
+	}
+}
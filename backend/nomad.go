@@ -0,0 +1,210 @@
+package backend
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const nomadLockTTL = 15 * time.Second
+
+// NomadBackend stores state in Nomad Variables (Nomad 1.4+), and uses Nomad Variable
+// locks (Nomad 1.7+) where the cluster supports them
+type NomadBackend struct {
+	client *nomad.Client
+	prefix string // Nomad Variable path prefix to write state to
+}
+
+// nomadVariable is a Nomad Variable, the Nomad API client we build against predates them
+type nomadVariable struct {
+	Namespace   string             `json:",omitempty"`
+	Path        string             `json:",omitempty"`
+	Items       map[string]string  `json:",omitempty"`
+	Lock        *nomadVariableLock `json:",omitempty"`
+	ModifyIndex uint64             `json:",omitempty"`
+}
+
+// nomadVariableLock is the lock held on a Nomad Variable
+type nomadVariableLock struct {
+	ID        string `json:",omitempty"`
+	TTL       string `json:",omitempty"`
+	LockDelay string `json:",omitempty"`
+}
+
+// NewNomad ...
+func NewNomad() (*NomadBackend, error) {
+	prefix := "nomad-firehose"
+	if v, ok := os.LookupEnv("NOMAD_FIREHOSE_NOMAD_PREFIX"); ok {
+		prefix = strings.Trim(v, "/")
+	}
+
+	client, err := nomad.NewClient(nomad.DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	return &NomadBackend{
+		client: client,
+		prefix: prefix,
+	}, nil
+}
+
+// NewLock ...
+func (b *NomadBackend) NewLock(name string) (Locker, error) {
+	return &nomadLock{
+		client: b.client,
+		path:   fmt.Sprintf("%s/%s/lock", b.prefix, name),
+	}, nil
+}
+
+// Get ...
+func (b *NomadBackend) Get(name string) ([]byte, error) {
+	var v nomadVariable
+	_, err := b.client.Raw().Query(b.endpoint(name), &v, nil)
+	if err != nil {
+		if strings.Contains(err.Error(), "404") {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	value, ok := v.Items["value"]
+	if !ok {
+		return nil, nil
+	}
+
+	return []byte(value), nil
+}
+
+// Put ...
+func (b *NomadBackend) Put(name string, value []byte) error {
+	v := &nomadVariable{
+		Path:  b.path(name),
+		Items: map[string]string{"value": string(value)},
+	}
+
+	_, err := b.client.Raw().Write(b.endpoint(name), v, nil, nil)
+	return err
+}
+
+// path returns the Nomad Variable path holding the value of a firehose type
+func (b *NomadBackend) path(name string) string {
+	return fmt.Sprintf("%s/%s/value", b.prefix, name)
+}
+
+func (b *NomadBackend) endpoint(name string) string {
+	return "/v1/var/" + b.path(name)
+}
+
+// nomadLock is a lock on a Nomad Variable, renewed in the background until released
+type nomadLock struct {
+	client *nomad.Client
+	path   string
+
+	id     string
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Lock ...
+func (l *nomadLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	hostname, _ := os.Hostname()
+
+	for {
+		in := &nomadVariable{
+			Path:  l.path,
+			Items: map[string]string{"holder": hostname},
+			Lock: &nomadVariableLock{
+				TTL:       nomadLockTTL.String(),
+				LockDelay: nomadLockTTL.String(),
+			},
+		}
+
+		var out nomadVariable
+		_, err := l.client.Raw().Write(l.endpoint("lock-acquire"), in, &out, nil)
+		switch {
+		case err == nil && (out.Lock == nil || out.Lock.ID == ""):
+			log.Warnf("[backend/nomad] Nomad Variable locks are not supported by the cluster (Nomad < 1.7), not locking %s", l.path)
+			return make(chan struct{}), nil
+
+		case err == nil:
+			l.id = out.Lock.ID
+			l.stopCh = make(chan struct{})
+
+			lostCh := make(chan struct{})
+			l.wg.Add(1)
+			go l.renew(lostCh)
+
+			return lostCh, nil
+
+		case strings.Contains(err.Error(), "404"):
+			return nil, fmt.Errorf("[backend/nomad] Nomad Variables are not supported by the cluster (Nomad < 1.4): %s", err)
+
+		case strings.Contains(err.Error(), "409"):
+			log.Debugf("[backend/nomad] %s is locked by another process", l.path)
+
+		default:
+			log.Errorf("[backend/nomad] Unable to acquire lock on %s: %s", l.path, err)
+		}
+
+		select {
+		case <-stopCh:
+			return nil, nil
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// renew the lock at half its TTL, closing lostCh if it can't be renewed
+func (l *nomadLock) renew(lostCh chan struct{}) {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(nomadLockTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stopCh:
+			return
+
+		case <-ticker.C:
+			if _, err := l.client.Raw().Write(l.endpoint("lock-renew"), l.variable(), nil, nil); err != nil {
+				log.Errorf("[backend/nomad] Unable to renew lock on %s: %s", l.path, err)
+				close(lostCh)
+				return
+			}
+		}
+	}
+}
+
+// Unlock ...
+func (l *nomadLock) Unlock() error {
+	if l.stopCh == nil {
+		return nil
+	}
+
+	close(l.stopCh)
+	l.wg.Wait()
+	l.stopCh = nil
+
+	_, err := l.client.Raw().Write(l.endpoint("lock-release"), l.variable(), nil, nil)
+	return err
+}
+
+// variable returns the variable used to renew or release the lock we hold
+func (l *nomadLock) variable() *nomadVariable {
+	return &nomadVariable{
+		Path: l.path,
+		Lock: &nomadVariableLock{ID: l.id},
+	}
+}
+
+func (l *nomadLock) endpoint(operation string) string {
+	return fmt.Sprintf("/v1/var/%s?%s", l.path, operation)
+}
@@ -0,0 +1,28 @@
+package backend
+
+// Locker is a lock making sure only one process runs a firehose type
+type Locker interface {
+	// Lock blocks until the lock is acquired or stopCh is closed (returning a nil channel).
+	// The returned channel is closed if the lock is lost
+	Lock(stopCh <-chan struct{}) (<-chan struct{}, error)
+
+	// Unlock releases the lock
+	Unlock() error
+}
+
+// StateStore persists the last change time or index of a firehose type
+type StateStore interface {
+	// Get the value stored for a firehose type, nil if there is none
+	Get(name string) ([]byte, error)
+
+	// Put the value for a firehose type
+	Put(name string, value []byte) error
+}
+
+// Backend provides both the lock and the state storage of the firehoses
+type Backend interface {
+	StateStore
+
+	// NewLock creates the lock for a firehose type
+	NewLock(name string) (Locker, error)
+}
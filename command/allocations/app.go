@@ -6,22 +6,33 @@ import (
 	"time"
 
 	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
 	"github.com/seatgeek/nomad-firehose/sink"
 	log "github.com/sirupsen/logrus"
 )
 
 // Firehose ...
 type Firehose struct {
+	allocations      map[string]*trackedAllocation // last known state of allocations, nil unless state changes are enabled
+	allocationsSeen  bool                          // true once the state of all allocations has been seeded
+	lastPrune        time.Time
+	checkpoint       *helper.Checkpoint
 	lastChangeTime   int64
 	lastChangeTimeCh chan interface{}
 	nomadClient      *nomad.Client
+	region           string // region to watch, empty for the region of the Nomad client
+	resolvedRegion   string // region events are annotated with
 	sink             sink.Sink
+	snapshot         bool // publish the state of live allocations on the first list
 	stopCh           chan struct{}
 }
 
 // AllocationUpdate ...
 type AllocationUpdate struct {
 	Name               string
+	Namespace          string
+	Region             string
 	NodeID             string
 	AllocationID       string
 	DesiredStatus      string
@@ -39,6 +50,14 @@ type AllocationUpdate struct {
 	TaskEvent          *nomad.TaskEvent
 }
 
+// allocationListStub is nomad.AllocationListStub with the namespace, which the Nomad API
+// client we build against predates
+type allocationListStub struct {
+	nomad.AllocationListStub
+	Namespace         string
+	DesiredTransition *nomad.DesiredTransition // only in event stream payloads
+}
+
 // NewFirehose ...
 func NewFirehose() (*Firehose, error) {
 	nomadClient, err := nomad.NewClient(nomad.DefaultConfig())
@@ -46,21 +65,39 @@ func NewFirehose() (*Firehose, error) {
 		return nil, err
 	}
 
-	sink, err := sink.GetSink("allocations")
+	return NewFirehoseWithClient(nomadClient, nil)
+}
+
+// NewFirehoseWithClient creates a Firehose using an existing Nomad client and sink,
+// if s is nil the sink configured by SINK_TYPE is created
+func NewFirehoseWithClient(nomadClient *nomad.Client, s sink.Sink) (*Firehose, error) {
+	if s == nil {
+		var err error
+		if s, err = sink.GetSink("allocations"); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := sink.ForFirehose(s, "allocations")
 	if err != nil {
 		return nil, err
 	}
 
 	return &Firehose{
 		nomadClient:      nomadClient,
-		sink:             sink,
+		sink:             s,
 		stopCh:           make(chan struct{}, 1),
 		lastChangeTimeCh: make(chan interface{}, 1),
 	}, nil
 }
 
 func (f *Firehose) Name() string {
-	return "allocations"
+	return helper.RegionName("allocations", f.region)
+}
+
+// SetRegion sets the Nomad region the firehose watches, the Nomad client must query the same region
+func (f *Firehose) SetRegion(region string) {
+	f.region = region
 }
 
 func (f *Firehose) UpdateCh() <-chan interface{} {
@@ -86,8 +123,32 @@ func (f *Firehose) Start() {
 	// Stop chan for all tasks to depend on
 	f.stopCh = make(chan struct{})
 
+	// Without a restore point, only replay the history the startup policy asks for
+	f.snapshot = false
+	if f.lastChangeTime == 0 {
+		policy := helper.GetStartupPolicy()
+		if cutoff := policy.Cutoff(time.Now()); !cutoff.IsZero() {
+			f.lastChangeTime = cutoff.UnixNano()
+		}
+		f.snapshot = policy.Snapshot()
+		log.Infof("No Last Change Time restore point, starting with the %s startup policy", policy)
+	}
+
+	// Only persist event times the sink has acknowledged
+	f.checkpoint = helper.NewCheckpoint(uint64(f.lastChangeTime))
+
+	f.resolvedRegion = helper.ResolveRegion(f.nomadClient, f.region)
+
+	if allocationStateChangesEnabled() {
+		f.allocations = make(map[string]*trackedAllocation)
+	}
+
 	// watch for allocation changes
-	go f.watch()
+	if helper.EventStreamEnabled() {
+		go f.watchStream()
+	} else {
+		go f.watch()
+	}
 
 	// Save the last event time every 5s
 	go f.persistLastChangeTime(5 * time.Second)
@@ -107,7 +168,7 @@ func (f *Firehose) Stop() {
 	f.sink.Stop()
 }
 
-// Write the Last Change Time to Consul so if the process restarts,
+// Write the Last Change Time acknowledged by the sink to Consul so if the process restarts,
 // it will try to resume from where it left off, not emitting tons of double events for
 // old events
 func (f *Firehose) persistLastChangeTime(interval time.Duration) {
@@ -116,22 +177,81 @@ func (f *Firehose) persistLastChangeTime(interval time.Duration) {
 	for {
 		select {
 		case <-f.stopCh:
-			f.lastChangeTimeCh <- f.lastChangeTime
+			f.lastChangeTimeCh <- f.checkpoint.Value()
 			break
 		case <-ticker.C:
-			f.lastChangeTimeCh <- f.lastChangeTime
+			f.lastChangeTimeCh <- f.checkpoint.Value()
 		}
 	}
 }
 
-// publish an update from the firehose
-func (f *Firehose) publish(update *AllocationUpdate) {
+// publish an update from the firehose described by meta, the checkpoint won't move past its time until the
+// sink acknowledged it
+func (f *Firehose) publish(meta sink.Metadata, update interface{}, time int64) {
+	ack := f.checkpoint.Track(uint64(time))
+
 	b, err := json.Marshal(update)
 	if err != nil {
 		log.Error(err)
+		ack(nil)
+		return
 	}
 
-	f.sink.Put(b)
+	f.sink.Put(sink.NewEventMessage(meta, b, ack))
+	metrics.EventsPublished.Inc(f.Name())
+}
+
+// Continously consume the Nomad event stream and publish allocation changes as updates,
+// falling back to blocking queries if the cluster does not support the event stream
+func (f *Firehose) watchStream() {
+	// The last change time is a task event time rather than a Nomad index, so catch up
+	// with a single list call and subscribe from the index it was read at
+	var index uint64
+	for {
+		start := time.Now()
+		allocations, meta, err := f.list(&nomad.QueryOptions{
+			AllowStale: true,
+			Namespace:  helper.GetNamespaces().Query(),
+		})
+		helper.ObserveNomadQuery(f.Name(), start, err)
+		if err != nil {
+			log.Errorf("Unable to fetch allocations: %s", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		f.publishSnapshot(allocations)
+		f.publishStateChanges(allocations, true)
+		f.publishTaskEvents(allocations)
+		index = meta.LastIndex
+		break
+	}
+
+	stream := helper.NewEventStream(f.nomadClient, f.Name(), "Allocation")
+	err := stream.Subscribe(index, f.stopCh, func(index uint64, events []*helper.StreamEvent) {
+		allocations := make([]*allocationListStub, 0, len(events))
+		for _, event := range events {
+			allocation := &allocationListStub{}
+			if err := event.Decode("Allocation", allocation); err != nil {
+				log.Errorf("Unable to decode allocation event: %s", err)
+				continue
+			}
+
+			if allocation.Namespace == "" {
+				allocation.Namespace = event.Namespace
+			}
+
+			allocations = append(allocations, allocation)
+		}
+
+		f.publishStateChanges(allocations, false)
+		f.publishTaskEvents(allocations)
+	})
+
+	if err == helper.ErrEventStreamUnsupported {
+		log.Warn("Nomad event stream is not supported, falling back to blocking queries")
+		f.watch()
+	}
 }
 
 // Continously watch for changes to the allocation list and publish it as updates
@@ -140,12 +260,13 @@ func (f *Firehose) watch() {
 		WaitIndex:  1,
 		WaitTime:   5 * time.Minute,
 		AllowStale: true,
+		Namespace:  helper.GetNamespaces().Query(),
 	}
 
-	newMax := f.lastChangeTime
-
 	for {
-		allocations, meta, err := f.nomadClient.Allocations().List(q)
+		start := time.Now()
+		allocations, meta, err := f.list(q)
+		helper.ObserveNomadQuery(f.Name(), start, err)
 		if err != nil {
 			log.Errorf("Unable to fetch allocations: %s", err)
 			time.Sleep(10 * time.Second)
@@ -163,44 +284,79 @@ func (f *Firehose) watch() {
 
 		log.Debugf("Allocations index is changed (%d <> %d)", remoteWaitIndex, localWaitIndex)
 
-		// Iterate allocations and find events that have changed since last run
-		for _, allocation := range allocations {
-			for taskName, taskInfo := range allocation.TaskStates {
-				for _, taskEvent := range taskInfo.Events {
-					if taskEvent.Time <= f.lastChangeTime {
-						continue
-					}
-
-					if taskEvent.Time > newMax {
-						newMax = taskEvent.Time
-					}
-
-					payload := &AllocationUpdate{
-						Name:               allocation.Name,
-						NodeID:             allocation.NodeID,
-						AllocationID:       allocation.ID,
-						EvalID:             allocation.EvalID,
-						DesiredStatus:      allocation.DesiredStatus,
-						DesiredDescription: allocation.DesiredDescription,
-						ClientStatus:       allocation.ClientStatus,
-						ClientDescription:  allocation.ClientDescription,
-						JobID:              allocation.JobID,
-						GroupName:          allocation.TaskGroup,
-						TaskName:           taskName,
-						TaskEvent:          taskEvent,
-						TaskState:          taskInfo.State,
-						TaskFailed:         taskInfo.Failed,
-						TaskStartedAt:      &taskInfo.StartedAt,
-						TaskFinishedAt:     &taskInfo.FinishedAt,
-					}
-
-					f.publish(payload)
+		f.publishSnapshot(allocations)
+		f.publishStateChanges(allocations, true)
+		f.publishTaskEvents(allocations)
+
+		// Update WaitIndex for next iteration
+		q.WaitIndex = meta.LastIndex
+		metrics.NomadIndex.Set(float64(q.WaitIndex), f.Name())
+	}
+}
+
+// list the allocations, including their namespace
+func (f *Firehose) list(q *nomad.QueryOptions) ([]*allocationListStub, *nomad.QueryMeta, error) {
+	var allocations []*allocationListStub
+	meta, err := f.nomadClient.Raw().Query("/v1/allocations", &allocations, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return allocations, meta, nil
+}
+
+// Iterate allocations, publish task events that have changed since last run
+// and update the Last Change Time
+func (f *Firehose) publishTaskEvents(allocations []*allocationListStub) {
+	newMax := f.lastChangeTime
+
+	for _, allocation := range allocations {
+		if !helper.GetNamespaces().Allowed(allocation.Namespace) {
+			continue
+		}
+
+		for taskName, taskInfo := range allocation.TaskStates {
+			for _, taskEvent := range taskInfo.Events {
+				if taskEvent.Time <= f.lastChangeTime {
+					continue
+				}
+
+				if taskEvent.Time > newMax {
+					newMax = taskEvent.Time
 				}
+
+				payload := &AllocationUpdate{
+					Name:               allocation.Name,
+					Namespace:          allocation.Namespace,
+					Region:             f.resolvedRegion,
+					NodeID:             allocation.NodeID,
+					AllocationID:       allocation.ID,
+					EvalID:             allocation.EvalID,
+					DesiredStatus:      allocation.DesiredStatus,
+					DesiredDescription: allocation.DesiredDescription,
+					ClientStatus:       allocation.ClientStatus,
+					ClientDescription:  allocation.ClientDescription,
+					JobID:              allocation.JobID,
+					GroupName:          allocation.TaskGroup,
+					TaskName:           taskName,
+					TaskEvent:          taskEvent,
+					TaskState:          taskInfo.State,
+					TaskFailed:         taskInfo.Failed,
+					TaskStartedAt:      &taskInfo.StartedAt,
+					TaskFinishedAt:     &taskInfo.FinishedAt,
+				}
+
+				meta := sink.Metadata{
+					ID:     helper.EventID("allocation", f.resolvedRegion, allocation.ID, taskName, taskEvent.Time),
+					Type:   "task_event",
+					Region: f.resolvedRegion,
+					Index:  allocation.ModifyIndex,
+				}
+				f.publish(meta, payload, taskEvent.Time)
 			}
 		}
-
-		// Update WaitIndex and Last Change Time for next iteration
-		q.WaitIndex = meta.LastIndex
-		f.lastChangeTime = newMax
 	}
+
+	f.lastChangeTime = newMax
+	f.checkpoint.Advance(uint64(newMax))
 }
@@ -0,0 +1,107 @@
+package allocations
+
+import (
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/sink"
+)
+
+// AllocationSnapshotType is the Type of AllocationSnapshot events
+const AllocationSnapshotType = "AllocationSnapshot"
+
+// AllocationSnapshot is the current state of a live allocation, emitted once per allocation
+// when the firehose starts without a restore point and the startup policy is full-snapshot
+type AllocationSnapshot struct {
+	Type               string
+	Name               string
+	Namespace          string
+	Region             string
+	NodeID             string
+	AllocationID       string
+	EvalID             string
+	DesiredStatus      string
+	DesiredDescription string
+	ClientStatus       string
+	ClientDescription  string
+	JobID              string
+	JobVersion         uint64
+	GroupName          string
+	ModifyIndex        uint64
+	ModifyTime         int64
+	TaskStates         map[string]*TaskSnapshot
+}
+
+// TaskSnapshot is the current state of a task, with its last event rather than all of them
+type TaskSnapshot struct {
+	State      string
+	Failed     bool
+	Restarts   uint64
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+	LastEvent  *nomad.TaskEvent
+}
+
+// publishSnapshot publishes an AllocationSnapshot for the live allocations, only the first time
+// it is called after starting with the full-snapshot startup policy
+func (f *Firehose) publishSnapshot(allocations []*allocationListStub) {
+	if !f.snapshot {
+		return
+	}
+	f.snapshot = false
+
+	for _, allocation := range allocations {
+		if !helper.GetNamespaces().Allowed(allocation.Namespace) {
+			continue
+		}
+
+		if allocation.ClientStatus != "pending" && allocation.ClientStatus != "running" {
+			continue
+		}
+
+		snapshot := &AllocationSnapshot{
+			Type:               AllocationSnapshotType,
+			Name:               allocation.Name,
+			Namespace:          allocation.Namespace,
+			Region:             f.resolvedRegion,
+			NodeID:             allocation.NodeID,
+			AllocationID:       allocation.ID,
+			EvalID:             allocation.EvalID,
+			DesiredStatus:      allocation.DesiredStatus,
+			DesiredDescription: allocation.DesiredDescription,
+			ClientStatus:       allocation.ClientStatus,
+			ClientDescription:  allocation.ClientDescription,
+			JobID:              allocation.JobID,
+			JobVersion:         allocation.JobVersion,
+			GroupName:          allocation.TaskGroup,
+			ModifyIndex:        allocation.ModifyIndex,
+			ModifyTime:         allocation.ModifyTime,
+			TaskStates:         make(map[string]*TaskSnapshot, len(allocation.TaskStates)),
+		}
+
+		for taskName, taskInfo := range allocation.TaskStates {
+			task := &TaskSnapshot{
+				State:      taskInfo.State,
+				Failed:     taskInfo.Failed,
+				Restarts:   taskInfo.Restarts,
+				StartedAt:  &taskInfo.StartedAt,
+				FinishedAt: &taskInfo.FinishedAt,
+			}
+
+			if n := len(taskInfo.Events); n > 0 {
+				task.LastEvent = taskInfo.Events[n-1]
+			}
+
+			snapshot.TaskStates[taskName] = task
+		}
+
+		meta := sink.Metadata{
+			ID:     helper.EventID(AllocationSnapshotType, f.resolvedRegion, allocation.ID, allocation.ModifyIndex),
+			Type:   "snapshot",
+			Region: f.resolvedRegion,
+			Index:  allocation.ModifyIndex,
+		}
+		f.publish(meta, snapshot, f.lastChangeTime)
+	}
+}
@@ -0,0 +1,227 @@
+package allocations
+
+import (
+	"os"
+	"reflect"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/sink"
+)
+
+const (
+	// AllocationStateChangeType is the Type of AllocationStateChange events
+	AllocationStateChangeType = "AllocationStateChange"
+
+	// Terminal allocations are forgotten once they haven't changed for this long, as the
+	// event stream does not tell us when they are garbage collected
+	terminalAllocationRetention = 1 * time.Hour
+	pruneInterval               = 10 * time.Minute
+)
+
+// AllocationState is the part of an allocation AllocationStateChange reports changes of
+type AllocationState struct {
+	DesiredStatus      string
+	DesiredDescription string
+	ClientStatus       string
+	ClientDescription  string
+	DesiredTransition  *nomad.DesiredTransition     `json:",omitempty"`
+	RescheduleTracker  *nomad.RescheduleTracker     `json:",omitempty"`
+	FollowupEvalID     string                       `json:",omitempty"`
+	DeploymentStatus   *nomad.AllocDeploymentStatus `json:",omitempty"`
+}
+
+// AllocationStateChange is emitted when the state of an allocation changed, whether or not
+// it came with a new task event. Previous is nil for allocations seen for the first time
+type AllocationStateChange struct {
+	Type          string
+	Name          string
+	Namespace     string
+	Region        string
+	AllocationID  string
+	NodeID        string
+	JobID         string
+	GroupName     string
+	EvalID        string
+	ModifyIndex   uint64
+	ModifyTime    int64
+	ChangedFields []string
+	Previous      *AllocationState
+	Current       *AllocationState
+}
+
+// trackedAllocation is the last known state of an allocation
+type trackedAllocation struct {
+	modifyIndex uint64
+	modifyTime  int64
+	state       *AllocationState
+}
+
+// allocationStateChangesEnabled returns true if NOMAD_FIREHOSE_ALLOCATION_STATE_CHANGES=true,
+// emitting AllocationStateChange events on top of task events
+func allocationStateChangesEnabled() bool {
+	return os.Getenv("NOMAD_FIREHOSE_ALLOCATION_STATE_CHANGES") == "true"
+}
+
+func newAllocationState(allocation *allocationListStub) *AllocationState {
+	return &AllocationState{
+		DesiredStatus:      allocation.DesiredStatus,
+		DesiredDescription: allocation.DesiredDescription,
+		ClientStatus:       allocation.ClientStatus,
+		ClientDescription:  allocation.ClientDescription,
+		DesiredTransition:  allocation.DesiredTransition,
+		RescheduleTracker:  allocation.RescheduleTracker,
+		FollowupEvalID:     allocation.FollowupEvalID,
+		DeploymentStatus:   allocation.DeploymentStatus,
+	}
+}
+
+// diff returns the names of the fields that changed between previous and current, if previous
+// is nil the fields set in current are returned
+func (current *AllocationState) diff(previous *AllocationState) []string {
+	changed := make([]string, 0)
+	c := reflect.ValueOf(*current)
+
+	for i := 0; i < c.NumField(); i++ {
+		name := c.Type().Field(i).Name
+		field := c.Field(i)
+
+		if previous == nil {
+			if !field.IsZero() {
+				changed = append(changed, name)
+			}
+			continue
+		}
+
+		// List stubs don't have the desired transition, only compare it when both sides know it
+		if name == "DesiredTransition" && (current.DesiredTransition == nil || previous.DesiredTransition == nil) {
+			continue
+		}
+
+		if !reflect.DeepEqual(field.Interface(), reflect.ValueOf(*previous).Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+
+	return changed
+}
+
+// publishStateChanges publishes an AllocationStateChange for allocations whose state changed
+// since they were last seen. If complete is set, allocations is the full allocation list and
+// allocations missing from it are forgotten
+func (f *Firehose) publishStateChanges(allocations []*allocationListStub, complete bool) {
+	if f.allocations == nil {
+		return
+	}
+
+	seen := make(map[string]bool, len(allocations))
+
+	for _, allocation := range allocations {
+		seen[allocation.ID] = true
+
+		if !helper.GetNamespaces().Allowed(allocation.Namespace) {
+			continue
+		}
+
+		previous, known := f.allocations[allocation.ID]
+		if known && allocation.ModifyIndex <= previous.modifyIndex {
+			continue
+		}
+
+		current := newAllocationState(allocation)
+		f.allocations[allocation.ID] = &trackedAllocation{
+			modifyIndex: allocation.ModifyIndex,
+			modifyTime:  allocation.ModifyTime,
+			state:       current,
+		}
+
+		var previousState *AllocationState
+		if known {
+			previousState = previous.state
+
+			// Keep the desired transition if we learnt it from the event stream, and the
+			// allocation was read from a list stub since
+			if current.DesiredTransition == nil {
+				current.DesiredTransition = previousState.DesiredTransition
+			}
+		} else if !f.allocationsSeen && allocation.ModifyTime <= f.lastChangeTime {
+			// On startup, seed the state of allocations that didn't change since the last checkpoint
+			continue
+		}
+
+		changed := current.diff(previousState)
+		if len(changed) == 0 {
+			continue
+		}
+
+		meta := sink.Metadata{
+			ID:     helper.EventID(AllocationStateChangeType, f.resolvedRegion, allocation.ID, allocation.ModifyIndex),
+			Type:   "state_change",
+			Region: f.resolvedRegion,
+			Index:  allocation.ModifyIndex,
+		}
+		f.publish(meta, &AllocationStateChange{
+			Type:          AllocationStateChangeType,
+			Name:          allocation.Name,
+			Namespace:     allocation.Namespace,
+			Region:        f.resolvedRegion,
+			AllocationID:  allocation.ID,
+			NodeID:        allocation.NodeID,
+			JobID:         allocation.JobID,
+			GroupName:     allocation.TaskGroup,
+			EvalID:        allocation.EvalID,
+			ModifyIndex:   allocation.ModifyIndex,
+			ModifyTime:    allocation.ModifyTime,
+			ChangedFields: changed,
+			Previous:      previousState,
+			Current:       current,
+		}, allocation.ModifyTime)
+	}
+
+	f.allocationsSeen = true
+
+	if complete {
+		for id := range f.allocations {
+			if !seen[id] {
+				delete(f.allocations, id)
+			}
+		}
+
+		return
+	}
+
+	f.pruneAllocations(time.Now())
+}
+
+// pruneAllocations forgets terminal allocations that haven't changed for a while
+func (f *Firehose) pruneAllocations(now time.Time) {
+	if now.Sub(f.lastPrune) < pruneInterval {
+		return
+	}
+	f.lastPrune = now
+
+	for id, allocation := range f.allocations {
+		if !isTerminal(allocation.state) {
+			continue
+		}
+
+		if now.Sub(time.Unix(0, allocation.modifyTime)) > terminalAllocationRetention {
+			delete(f.allocations, id)
+		}
+	}
+}
+
+// isTerminal returns true if the allocation stopped and won't be started again
+func isTerminal(state *AllocationState) bool {
+	if state.DesiredStatus == "run" {
+		return false
+	}
+
+	switch state.ClientStatus {
+	case "complete", "failed", "lost":
+		return true
+	}
+
+	return false
+}
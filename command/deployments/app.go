@@ -8,19 +8,34 @@ import (
 	"time"
 
 	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
 	"github.com/seatgeek/nomad-firehose/sink"
 	log "github.com/sirupsen/logrus"
 )
 
 // Firehose ...
 type Firehose struct {
+	checkpoint       *helper.Checkpoint
 	lastChangeTime   uint64
 	lastChangeTimeCh chan interface{}
 	nomadClient      *nomad.Client
+	pool             *helper.WorkerPool // reads changed deployments from Nomad
+	region           string             // region to watch, empty for the region of the Nomad client
+	restoreIndex     uint64             // deployments that changed since were not seen before a restart
+	resolvedRegion   string             // region events are annotated with
 	sink             sink.Sink
+	state            *deploymentState // last known state of deployments, nil unless deployment events are enabled
 	stopCh           chan struct{}
 }
 
+// Deployment is the deployment emitted by the firehose, annotated with its region
+type Deployment struct {
+	*nomad.Deployment
+	Region   string
+	Snapshot bool `json:",omitempty"` // set for the current state emitted by the full-snapshot startup policy
+}
+
 // NewFirehose ...
 func NewFirehose() (*Firehose, error) {
 	nomadClient, err := nomad.NewClient(nomad.DefaultConfig())
@@ -28,21 +43,45 @@ func NewFirehose() (*Firehose, error) {
 		return nil, err
 	}
 
-	sink, err := sink.GetSink("deployments")
+	return NewFirehoseWithClient(nomadClient, nil)
+}
+
+// NewFirehoseWithClient creates a Firehose using an existing Nomad client and sink,
+// if s is nil the sink configured by SINK_TYPE is created
+func NewFirehoseWithClient(nomadClient *nomad.Client, s sink.Sink) (*Firehose, error) {
+	if s == nil {
+		var err error
+		if s, err = sink.GetSink("deployments"); err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	}
+
+	s, err := sink.ForFirehose(s, "deployments")
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return nil, err
+	}
+
+	pool, err := helper.NewWorkerPool()
+	if err != nil {
+		return nil, err
 	}
 
 	return &Firehose{
 		nomadClient:      nomadClient,
-		sink:             sink,
+		pool:             pool,
+		sink:             s,
 		lastChangeTimeCh: make(chan interface{}, 1),
 	}, nil
 }
 
 func (f *Firehose) Name() string {
-	return "deployments"
+	return helper.RegionName("deployments", f.region)
+}
+
+// SetRegion sets the Nomad region the firehose watches, the Nomad client must query the same region
+func (f *Firehose) SetRegion(region string) {
+	f.region = region
 }
 
 func (f *Firehose) UpdateCh() <-chan interface{} {
@@ -72,8 +111,36 @@ func (f *Firehose) Start() {
 	// Stop chan for all tasks to depend on
 	f.stopCh = make(chan struct{})
 
+	// Without a restore point, start where the startup policy asks for
+	snapshot := f.startup()
+	select {
+	case <-f.stopCh:
+		return
+	default:
+	}
+
+	// Only persist indexes the sink has acknowledged
+	f.checkpoint = helper.NewCheckpoint(f.lastChangeTime)
+
+	f.resolvedRegion = helper.ResolveRegion(f.nomadClient, f.region)
+
+	f.pool.Start(f.Name())
+
+	// Emit typed progress events rather than the full deployments
+	if deploymentEventsEnabled() {
+		f.restoreIndex = f.lastChangeTime
+		f.state = &deploymentState{deployments: make(map[string]*trackedDeployment)}
+		f.seedDeployments()
+	}
+
+	f.publishSnapshot(snapshot)
+
 	// watch for deployment changes
-	go f.watch()
+	if helper.EventStreamEnabled() {
+		go f.watchStream()
+	} else {
+		go f.watch()
+	}
 
 	// Save the last event time every 5s
 	go f.persistLastChangeTime(5 * time.Second)
@@ -90,10 +157,11 @@ func (f *Firehose) Start() {
 // Stop the firehose
 func (f *Firehose) Stop() {
 	close(f.stopCh)
+	f.pool.Stop()
 	f.sink.Stop()
 }
 
-// Write the Last Change Time to Consul so if the process restarts,
+// Write the Last Change Time acknowledged by the sink to Consul so if the process restarts,
 // it will try to resume from where it left off, not emitting tons of double events for
 // old events
 func (f *Firehose) persistLastChangeTime(interval time.Duration) {
@@ -102,22 +170,65 @@ func (f *Firehose) persistLastChangeTime(interval time.Duration) {
 	for {
 		select {
 		case <-f.stopCh:
-			f.lastChangeTimeCh <- f.lastChangeTime
+			f.lastChangeTimeCh <- f.checkpoint.Value()
 			break
 		case <-ticker.C:
-			f.lastChangeTimeCh <- f.lastChangeTime
+			f.lastChangeTimeCh <- f.checkpoint.Value()
 		}
 	}
 }
 
-// Publish an update from the firehose
-func (f *Firehose) Publish(update *nomad.Deployment) {
-	b, err := json.Marshal(update)
+// Publish an update from the firehose, ack is called once the sink acknowledged it
+func (f *Firehose) Publish(update *nomad.Deployment, ack sink.AckFunc) {
+	if f.state != nil {
+		f.publishEvents(update, ack)
+		return
+	}
+
+	b, err := json.Marshal(&Deployment{Deployment: update, Region: f.resolvedRegion})
 	if err != nil {
 		log.Error(err)
+		ack(nil)
+		return
 	}
 
-	f.sink.Put(b)
+	meta := sink.Metadata{
+		ID:     helper.EventID("deployment", f.resolvedRegion, update.ID, update.ModifyIndex),
+		Type:   "updated",
+		Region: f.resolvedRegion,
+		Index:  update.ModifyIndex,
+	}
+	f.sink.Put(sink.NewEventMessage(meta, b, ack))
+	metrics.EventsPublished.Inc(f.Name())
+}
+
+// Continously consume the Nomad event stream and publish deployment changes as updates,
+// falling back to blocking queries if the cluster does not support the event stream
+func (f *Firehose) watchStream() {
+	stream := helper.NewEventStream(f.nomadClient, f.Name(), "Deployment")
+	err := stream.Subscribe(f.lastChangeTime, f.stopCh, func(index uint64, events []*helper.StreamEvent) {
+		if index <= f.lastChangeTime {
+			return
+		}
+
+		for _, event := range events {
+			deployment := &nomad.Deployment{}
+			if err := event.Decode("Deployment", deployment); err != nil {
+				log.Errorf("Unable to decode deployment event: %s", err)
+				continue
+			}
+
+			f.Publish(deployment, f.checkpoint.Track(index))
+		}
+
+		f.lastChangeTime = index
+		f.checkpoint.Advance(index)
+	})
+
+	if err == helper.ErrEventStreamUnsupported {
+		log.Warn("Nomad event stream is not supported, falling back to blocking queries")
+		f.watch()
+	}
 }
 
 // Continously watch for changes to the deployment list and publish it as updates
@@ -126,12 +237,15 @@ func (f *Firehose) watch() {
 		WaitIndex:  uint64(f.lastChangeTime),
 		WaitTime:   5 * time.Minute,
 		AllowStale: true,
+		Namespace:  helper.GetNamespaces().Query(),
 	}
 
 	newMax := uint64(f.lastChangeTime)
 
 	for {
+		start := time.Now()
 		deployments, meta, err := f.nomadClient.Deployments().List(q)
+		helper.ObserveNomadQuery(f.Name(), start, err)
 		if err != nil {
 			log.Errorf("Unable to fetch deployments: %s", err)
 			time.Sleep(10 * time.Second)
@@ -155,23 +269,32 @@ func (f *Firehose) watch() {
 				continue
 			}
 
+			if !helper.GetNamespaces().Allowed(deployment.Namespace) {
+				continue
+			}
+
 			if deployment.ModifyIndex > newMax {
 				newMax = deployment.ModifyIndex
 			}
 
-			go func(DeploymentID string) {
-				fullDeployment, _, err := f.nomadClient.Deployments().Info(DeploymentID, &nomad.QueryOptions{})
-				if err != nil {
-					log.Errorf("Could not read deployment %s: %s", DeploymentID, err)
+			DeploymentID, namespace := deployment.ID, deployment.Namespace
+			f.pool.Submit(DeploymentID, f.checkpoint.Track(deployment.ModifyIndex), func(ack sink.AckFunc) {
+				var fullDeployment *nomad.Deployment
+				if !helper.ReadObject(f.stopCh, "deployment "+DeploymentID, ack, func() (err error) {
+					fullDeployment, _, err = f.nomadClient.Deployments().Info(DeploymentID, &nomad.QueryOptions{Namespace: namespace})
+					return err
+				}) {
 					return
 				}
 
-				f.Publish(fullDeployment)
-			}(deployment.ID)
+				f.Publish(fullDeployment, ack)
+			})
 		}
 
 		// Update WaitIndex and Last Change Time for next iteration
 		q.WaitIndex = meta.LastIndex
+		metrics.NomadIndex.Set(float64(q.WaitIndex), f.Name())
 		f.lastChangeTime = newMax
+		f.checkpoint.Advance(newMax)
 	}
 }
@@ -0,0 +1,276 @@
+package deployments
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of DeploymentEvent
+const (
+	DeploymentStarted       = "DeploymentStarted"
+	DeploymentCanaryPlaced  = "DeploymentCanaryPlaced"
+	DeploymentHealthChanged = "DeploymentHealthChanged"
+	DeploymentPromoted      = "DeploymentPromoted"
+	DeploymentFailed        = "DeploymentFailed"
+	DeploymentSuccessful    = "DeploymentSuccessful"
+	DeploymentCancelled     = "DeploymentCancelled"
+)
+
+// Finished deployments are forgotten once they haven't changed for this long
+const (
+	finishedDeploymentRetention = 1 * time.Hour
+	pruneInterval               = 10 * time.Minute
+)
+
+// terminalEvents are the events emitted when a deployment reaches a terminal status
+var terminalEvents = map[string]string{
+	"failed":     DeploymentFailed,
+	"successful": DeploymentSuccessful,
+	"cancelled":  DeploymentCancelled,
+}
+
+// DeploymentEvent is emitted instead of the full deployment when NOMAD_FIREHOSE_DEPLOYMENT_EVENTS=true
+type DeploymentEvent struct {
+	Type              string
+	DeploymentID      string
+	Namespace         string
+	Region            string
+	JobID             string
+	JobVersion        uint64
+	Status            string
+	StatusDescription string
+	ModifyIndex       uint64
+
+	// ChangedTaskGroups are the task groups the event is about, e.g. the groups that placed canaries
+	ChangedTaskGroups []string
+
+	// TaskGroups is the progress of every task group of the deployment
+	TaskGroups map[string]*TaskGroupProgress
+}
+
+// TaskGroupProgress is the state of a task group before and after the deployment changed,
+// Before is nil for task groups seen for the first time
+type TaskGroupProgress struct {
+	Before *TaskGroupCounters
+	After  *TaskGroupCounters
+}
+
+// TaskGroupCounters is the deployment state of a task group
+type TaskGroupCounters struct {
+	DesiredTotal    int
+	DesiredCanaries int
+	PlacedCanaries  int
+	PlacedAllocs    int
+	HealthyAllocs   int
+	UnhealthyAllocs int
+	Promoted        bool
+}
+
+// trackedDeployment is the last known state of a deployment
+type trackedDeployment struct {
+	deployment *nomad.Deployment
+	seenAt     time.Time
+}
+
+// deploymentState is the last known state of the deployments
+type deploymentState struct {
+	sync.Mutex
+	deployments map[string]*trackedDeployment
+	lastPrune   time.Time
+}
+
+// deploymentEventsEnabled returns true if NOMAD_FIREHOSE_DEPLOYMENT_EVENTS=true
+func deploymentEventsEnabled() bool {
+	return os.Getenv("NOMAD_FIREHOSE_DEPLOYMENT_EVENTS") == "true"
+}
+
+// seedDeployments reads the deployments that didn't change since the restored index, so
+// deployments running before the firehose started aren't reported as started. Deployments that
+// changed while the firehose was down are left out, so their replayed update is published
+func (f *Firehose) seedDeployments() {
+	start := time.Now()
+	deployments, _, err := f.nomadClient.Deployments().List(&nomad.QueryOptions{
+		AllowStale: true,
+		Namespace:  helper.GetNamespaces().Query(),
+	})
+	helper.ObserveNomadQuery(f.Name(), start, err)
+	if err != nil {
+		log.Errorf("Unable to seed the state of deployments: %s", err)
+		return
+	}
+
+	seeded := 0
+	for _, deployment := range deployments {
+		if f.seedDeployment(deployment) {
+			seeded++
+		}
+	}
+
+	log.Infof("Seeded the state of %d of %d deployments", seeded, len(deployments))
+}
+
+// seedDeployment records the state of the deployment if it didn't change since the restored index
+func (f *Firehose) seedDeployment(deployment *nomad.Deployment) bool {
+	if deployment.ModifyIndex > f.restoreIndex {
+		return false
+	}
+
+	f.state.Lock()
+	defer f.state.Unlock()
+
+	f.state.deployments[deployment.ID] = &trackedDeployment{deployment: deployment, seenAt: time.Now()}
+	return true
+}
+
+// publishEvents publishes the progress events of a deployment since it was last seen, ack is
+// called once all of them have been acknowledged
+func (f *Firehose) publishEvents(deployment *nomad.Deployment, ack sink.AckFunc) {
+	now := time.Now()
+
+	f.state.Lock()
+	tracked, known := f.state.deployments[deployment.ID]
+	if known && deployment.ModifyIndex <= tracked.deployment.ModifyIndex {
+		f.state.Unlock()
+		ack(nil)
+		return
+	}
+	f.state.deployments[deployment.ID] = &trackedDeployment{deployment: deployment, seenAt: now}
+	f.state.prune(now)
+	f.state.Unlock()
+
+	previous := &nomad.Deployment{}
+	if known {
+		previous = tracked.deployment
+	}
+
+	// A deployment not seen before only started while the firehose was down if it was created after the restored index
+	events := f.progressEvents(previous, deployment, !known && deployment.CreateIndex > f.restoreIndex)
+	if len(events) == 0 {
+		ack(nil)
+		return
+	}
+
+	ack = sink.AckAll(ack, len(events))
+	for _, event := range events {
+		b, err := json.Marshal(event)
+		if err != nil {
+			log.Error(err)
+			ack(nil)
+			continue
+		}
+
+		meta := sink.Metadata{
+			ID:     helper.EventID(event.Type, event.Region, event.DeploymentID, event.ModifyIndex),
+			Type:   helper.SnakeCase(strings.TrimPrefix(event.Type, "Deployment")),
+			Region: event.Region,
+			Index:  event.ModifyIndex,
+		}
+		f.sink.Put(sink.NewEventMessage(meta, b, ack))
+		metrics.EventsPublished.Inc(f.Name())
+	}
+}
+
+// progressEvents returns the events between the previous and current state of a deployment
+func (f *Firehose) progressEvents(previous, current *nomad.Deployment, started bool) []*DeploymentEvent {
+	progress := make(map[string]*TaskGroupProgress, len(current.TaskGroups))
+	for name, state := range current.TaskGroups {
+		progress[name] = &TaskGroupProgress{
+			Before: counters(previous.TaskGroups[name]),
+			After:  counters(state),
+		}
+	}
+
+	var canaries, health, promoted []string
+	for name, p := range progress {
+		before := p.Before
+		if before == nil {
+			before = &TaskGroupCounters{}
+		}
+
+		if p.After.PlacedCanaries > before.PlacedCanaries {
+			canaries = append(canaries, name)
+		}
+		if p.After.HealthyAllocs != before.HealthyAllocs || p.After.UnhealthyAllocs != before.UnhealthyAllocs {
+			health = append(health, name)
+		}
+		if p.After.Promoted && !before.Promoted {
+			promoted = append(promoted, name)
+		}
+	}
+
+	events := make([]*DeploymentEvent, 0)
+	add := func(eventType string, groups []string) {
+		sort.Strings(groups)
+		events = append(events, &DeploymentEvent{
+			Type:              eventType,
+			DeploymentID:      current.ID,
+			Namespace:         current.Namespace,
+			Region:            f.resolvedRegion,
+			JobID:             current.JobID,
+			JobVersion:        current.JobVersion,
+			Status:            current.Status,
+			StatusDescription: current.StatusDescription,
+			ModifyIndex:       current.ModifyIndex,
+			ChangedTaskGroups: groups,
+			TaskGroups:        progress,
+		})
+	}
+
+	if started {
+		add(DeploymentStarted, nil)
+	}
+	if len(canaries) > 0 {
+		add(DeploymentCanaryPlaced, canaries)
+	}
+	if len(health) > 0 {
+		add(DeploymentHealthChanged, health)
+	}
+	if len(promoted) > 0 {
+		add(DeploymentPromoted, promoted)
+	}
+	if eventType, ok := terminalEvents[current.Status]; ok && current.Status != previous.Status {
+		add(eventType, nil)
+	}
+
+	return events
+}
+
+func counters(state *nomad.DeploymentState) *TaskGroupCounters {
+	if state == nil {
+		return nil
+	}
+
+	return &TaskGroupCounters{
+		DesiredTotal:    state.DesiredTotal,
+		DesiredCanaries: state.DesiredCanaries,
+		PlacedCanaries:  len(state.PlacedCanaries),
+		PlacedAllocs:    state.PlacedAllocs,
+		HealthyAllocs:   state.HealthyAllocs,
+		UnhealthyAllocs: state.UnhealthyAllocs,
+		Promoted:        state.Promoted,
+	}
+}
+
+// prune forgets finished deployments that haven't changed for a while, the lock must be held
+func (s *deploymentState) prune(now time.Time) {
+	if now.Sub(s.lastPrune) < pruneInterval {
+		return
+	}
+	s.lastPrune = now
+
+	for id, tracked := range s.deployments {
+		if _, finished := terminalEvents[tracked.deployment.Status]; finished && now.Sub(tracked.seenAt) > finishedDeploymentRetention {
+			delete(s.deployments, id)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package deployments
+
+import (
+	"encoding/json"
+	"testing"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/sink"
+)
+
+// testSink records the messages put on it
+type testSink struct {
+	messages []*sink.Message
+}
+
+func (s *testSink) Start() error { return nil }
+func (s *testSink) Stop()        {}
+
+func (s *testSink) Put(message *sink.Message) error {
+	s.messages = append(s.messages, message)
+	message.Ack(nil)
+	return nil
+}
+
+func testDeployment(id, status string, createIndex, modifyIndex uint64) *nomad.Deployment {
+	return &nomad.Deployment{
+		ID:          id,
+		Namespace:   "default",
+		JobID:       id,
+		Status:      status,
+		CreateIndex: createIndex,
+		ModifyIndex: modifyIndex,
+		TaskGroups:  map[string]*nomad.DeploymentState{"web": {DesiredTotal: 1}},
+	}
+}
+
+func TestDeploymentChangesDuringDowntimeArePublished(t *testing.T) {
+	s := &testSink{}
+	f := &Firehose{
+		sink:         s,
+		restoreIndex: 100,
+		state:        &deploymentState{deployments: make(map[string]*trackedDeployment)},
+	}
+
+	// Restarted at index 100: "running" didn't change since, "failed" started before and failed
+	// at index 150, "successful" started and succeeded after the restored index
+	running := testDeployment("running", "running", 10, 50)
+	failed := testDeployment("failed", "failed", 60, 150)
+	successful := testDeployment("successful", "successful", 120, 130)
+
+	if !f.seedDeployment(running) {
+		t.Error("expected the running deployment to be seeded")
+	}
+	if f.seedDeployment(failed) || f.seedDeployment(successful) {
+		t.Error("expected deployments that changed while the firehose was down not to be seeded")
+	}
+
+	for _, deployment := range []*nomad.Deployment{running, failed, successful} {
+		f.publishEvents(deployment, func(err error) {
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+
+	var got []string
+	for _, message := range s.messages {
+		event := &DeploymentEvent{}
+		if err := json.Unmarshal(message.Data, event); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, event.DeploymentID+" "+event.Type)
+	}
+
+	want := []string{
+		"failed DeploymentFailed",
+		"successful DeploymentStarted",
+		"successful DeploymentSuccessful",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got events %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got events %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package deployments
+
+import (
+	"encoding/json"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+// startup applies the startup policy when there is no restore point, moving the last change index
+// to the current index of the deployment list, and returns the deployments to publish a snapshot of
+func (f *Firehose) startup() []*nomad.Deployment {
+	policy := helper.GetStartupPolicy()
+	if f.lastChangeTime != 0 || !policy.SkipHistory() {
+		return nil
+	}
+
+	// Deployments don't record when they changed, so there is no history to replay since a time
+	if policy.Mode == helper.StartupReplaySince {
+		log.Warnf("Deployments can't be replayed since a time, starting from now")
+	}
+
+	for {
+		start := time.Now()
+		deployments, meta, err := f.nomadClient.Deployments().List(&nomad.QueryOptions{
+			AllowStale: true,
+			Namespace:  helper.GetNamespaces().Query(),
+		})
+		helper.ObserveNomadQuery(f.Name(), start, err)
+		if err == nil {
+			log.Infof("No Last Change Time restore point, starting from index %d with the %s startup policy", meta.LastIndex, policy)
+			f.lastChangeTime = meta.LastIndex
+
+			if !policy.Snapshot() {
+				return nil
+			}
+			return deployments
+		}
+
+		log.Errorf("Unable to fetch deployments: %s", err)
+
+		select {
+		case <-f.stopCh:
+			return nil
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// publishSnapshot publishes the current state of the deployments that are not finished, flagged as a snapshot
+func (f *Firehose) publishSnapshot(deployments []*nomad.Deployment) {
+	for _, deployment := range deployments {
+		if !helper.GetNamespaces().Allowed(deployment.Namespace) {
+			continue
+		}
+
+		switch deployment.Status {
+		case "successful", "failed", "cancelled":
+			continue
+		}
+
+		b, err := json.Marshal(&Deployment{Deployment: deployment, Region: f.resolvedRegion, Snapshot: true})
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		meta := sink.Metadata{
+			ID:     helper.EventID("DeploymentSnapshot", f.resolvedRegion, deployment.ID, deployment.ModifyIndex),
+			Type:   "snapshot",
+			Region: f.resolvedRegion,
+			Index:  deployment.ModifyIndex,
+		}
+		f.sink.Put(sink.NewEventMessage(meta, b, f.checkpoint.Track(f.lastChangeTime)))
+		metrics.EventsPublished.Inc(f.Name())
+	}
+}
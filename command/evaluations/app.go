@@ -7,19 +7,35 @@ import (
 	"time"
 
 	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
 	"github.com/seatgeek/nomad-firehose/sink"
 	log "github.com/sirupsen/logrus"
 )
 
 // Firehose ...
 type Firehose struct {
+	checkpoint       *helper.Checkpoint
 	lastChangeIndex  uint64
 	lastChangeTimeCh chan interface{}
 	nomadClient      *nomad.Client
+	region           string // region to watch, empty for the region of the Nomad client
+	resolvedRegion   string // region events are annotated with
 	sink             sink.Sink
+	seen             map[string]*seenEvaluation // last published version of each evaluation
+	seeded           bool                       // true once the evaluations up to the restored index have been seen
+	lastPrune        time.Time
 	stopCh           chan struct{}
 }
 
+// Evaluation is the evaluation emitted by the firehose, annotated with its region and the
+// status it had when last published, empty for evaluations seen for the first time
+type Evaluation struct {
+	*nomad.Evaluation
+	Region         string
+	PreviousStatus string
+}
+
 // NewFirehose ...
 func NewFirehose() (*Firehose, error) {
 	nomadClient, err := nomad.NewClient(nomad.DefaultConfig())
@@ -27,22 +43,40 @@ func NewFirehose() (*Firehose, error) {
 		return nil, err
 	}
 
-	sink, err := sink.GetSink("evaluations")
+	return NewFirehoseWithClient(nomadClient, nil)
+}
+
+// NewFirehoseWithClient creates a Firehose using an existing Nomad client and sink,
+// if s is nil the sink configured by SINK_TYPE is created
+func NewFirehoseWithClient(nomadClient *nomad.Client, s sink.Sink) (*Firehose, error) {
+	if s == nil {
+		var err error
+		if s, err = sink.GetSink("evaluations"); err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	}
+
+	s, err := sink.ForFirehose(s, "evaluations")
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	return &Firehose{
 		nomadClient:      nomadClient,
-		sink:             sink,
+		sink:             s,
 		stopCh:           make(chan struct{}, 1),
 		lastChangeTimeCh: make(chan interface{}, 1),
 	}, nil
 }
 
 func (f *Firehose) Name() string {
-	return "evaluations"
+	return helper.RegionName("evaluations", f.region)
+}
+
+// SetRegion sets the Nomad region the firehose watches, the Nomad client must query the same region
+func (f *Firehose) SetRegion(region string) {
+	f.region = region
 }
 
 func (f *Firehose) UpdateCh() <-chan interface{} {
@@ -68,8 +102,19 @@ func (f *Firehose) Start() {
 	// Stop chan for all tasks to depend on
 	f.stopCh = make(chan struct{})
 
-	// watch for allocation changes
-	go f.watch()
+	// Only persist indexes the sink has acknowledged
+	f.checkpoint = helper.NewCheckpoint(f.lastChangeIndex)
+
+	f.seen = make(map[string]*seenEvaluation)
+
+	f.resolvedRegion = helper.ResolveRegion(f.nomadClient, f.region)
+
+	// watch for evaluation changes
+	if helper.EventStreamEnabled() {
+		go f.watchStream()
+	} else {
+		go f.watch()
+	}
 
 	// Save the last event time every 5s
 	go f.persistLastChangeTime(5 * time.Second)
@@ -87,7 +132,7 @@ func (f *Firehose) Stop() {
 	f.sink.Stop()
 }
 
-// Write the Last Change Time to Consul so if the process restarts,
+// Write the Last Change Time acknowledged by the sink to Consul so if the process restarts,
 // it will try to resume from where it left off, not emitting tons of double events for
 // old events
 func (f *Firehose) persistLastChangeTime(interval time.Duration) {
@@ -96,36 +141,88 @@ func (f *Firehose) persistLastChangeTime(interval time.Duration) {
 	for {
 		select {
 		case <-f.stopCh:
-			f.lastChangeTimeCh <- f.lastChangeIndex
+			f.lastChangeTimeCh <- f.checkpoint.Value()
 			break
 		case <-ticker.C:
-			f.lastChangeTimeCh <- f.lastChangeIndex
+			f.lastChangeTimeCh <- f.checkpoint.Value()
 		}
 	}
 }
 
-// Publish an update from the firehose
-func (f *Firehose) Publish(update *nomad.Evaluation) {
-	b, err := json.Marshal(update)
+// Publish an update from the firehose, ack is called once the sink acknowledged it
+func (f *Firehose) Publish(update *nomad.Evaluation, previousStatus string, ack sink.AckFunc) {
+	// Placement failures are only included for blocked evaluations, if enabled
+	evaluation := *update
+	evaluation.FailedTGAllocs = f.placementFailures(update)
+
+	b, err := json.Marshal(&Evaluation{Evaluation: &evaluation, Region: f.resolvedRegion, PreviousStatus: previousStatus})
 	if err != nil {
 		log.Error(err)
+		ack(nil)
+		return
 	}
 
-	f.sink.Put(b)
+	meta := sink.Metadata{
+		ID:     helper.EventID("evaluation", f.resolvedRegion, update.ID, update.ModifyIndex),
+		Type:   "updated",
+		Region: f.resolvedRegion,
+		Index:  update.ModifyIndex,
+	}
+	f.sink.Put(sink.NewEventMessage(meta, b, ack))
+	metrics.EventsPublished.Inc(f.Name())
+}
+
+// Continously consume the Nomad event stream and publish evaluation changes as updates,
+// falling back to blocking queries if the cluster does not support the event stream
+func (f *Firehose) watchStream() {
+	stream := helper.NewEventStream(f.nomadClient, f.Name(), "Evaluation")
+	err := stream.Subscribe(f.lastChangeIndex, f.stopCh, func(index uint64, events []*helper.StreamEvent) {
+		if index <= f.lastChangeIndex {
+			return
+		}
+
+		for _, event := range events {
+			evaluation := &nomad.Evaluation{}
+			if err := event.Decode("Evaluation", evaluation); err != nil {
+				log.Errorf("Unable to decode evaluation event: %s", err)
+				continue
+			}
+
+			// The stream may replay events when resuming
+			previousStatus, ok := f.observe(evaluation)
+			if !ok {
+				continue
+			}
+
+			f.Publish(evaluation, previousStatus, f.checkpoint.Track(index))
+		}
+
+		f.lastChangeIndex = index
+		f.checkpoint.Advance(index)
+	})
+
+	if err == helper.ErrEventStreamUnsupported {
+		log.Warn("Nomad event stream is not supported, falling back to blocking queries")
+		f.watch()
+	}
 }
 
-// Continously watch for changes to the allocation list and publish it as updates
+// Continously watch for changes to the evaluation list and publish every evaluation that was
+// created or changed since it was last seen
 func (f *Firehose) watch() {
 	q := &nomad.QueryOptions{
 		WaitIndex:  f.lastChangeIndex,
 		WaitTime:   5 * time.Minute,
 		AllowStale: true,
+		Namespace:  helper.GetNamespaces().Query(),
 	}
 
 	for {
 		log.Infof("Fetching evaluations from Nomad: %+v", q)
 
+		start := time.Now()
 		evaluations, meta, err := f.nomadClient.Evaluations().List(q)
+		helper.ObserveNomadQuery(f.Name(), start, err)
 		if err != nil {
 			log.Errorf("Unable to fetch evaluations: %s", err)
 			time.Sleep(10 * time.Second)
@@ -140,20 +237,43 @@ func (f *Firehose) watch() {
 
 		log.Infof("Evaluations index is changed (%d <> %d)", meta.LastIndex, f.lastChangeIndex)
 
-		// Iterate clients and find events that have changed since last run
+		// Iterate evaluations and find the ones that have changed since last seen
+		listed := make(map[string]bool, len(evaluations))
 		for _, evaluation := range evaluations {
-			if evaluation.ModifyIndex != f.lastChangeIndex {
+			listed[evaluation.ID] = true
+
+			if !helper.GetNamespaces().Allowed(evaluation.Namespace) {
 				continue
 			}
 
-			f.Publish(evaluation)
-			evaluation = nil
+			previousStatus, ok := f.observe(evaluation)
+			if !ok {
+				continue
+			}
+
+			// On startup, only record the evaluations published before the restored index
+			if !f.seeded && evaluation.ModifyIndex <= f.lastChangeIndex {
+				continue
+			}
+
+			f.Publish(evaluation, previousStatus, f.checkpoint.Track(evaluation.ModifyIndex))
+		}
+
+		f.seeded = true
+
+		// Forget the evaluations that were garbage collected
+		for id := range f.seen {
+			if !listed[id] {
+				delete(f.seen, id)
+			}
 		}
 
 		evaluations = nil
 
 		// Update WaitIndex and Last Change Time for next iteration
 		f.lastChangeIndex = meta.LastIndex
+		f.checkpoint.Advance(meta.LastIndex)
 		q.WaitIndex = meta.LastIndex
+		metrics.NomadIndex.Set(float64(q.WaitIndex), f.Name())
 	}
 }
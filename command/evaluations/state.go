@@ -0,0 +1,94 @@
+package evaluations
+
+import (
+	"os"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Finished evaluations are forgotten once they haven't changed for this long, as the
+	// event stream does not tell us when they are garbage collected
+	finishedEvaluationRetention = 1 * time.Hour
+	pruneInterval               = 10 * time.Minute
+)
+
+// seenEvaluation is the last version of an evaluation published by the firehose
+type seenEvaluation struct {
+	modifyIndex uint64
+	status      string
+	seenAt      time.Time
+}
+
+// placementFailuresEnabled returns true if NOMAD_FIREHOSE_EVALUATION_PLACEMENT_FAILURES=true,
+// including the placement failures (FailedTGAllocs) of blocked evaluations
+func placementFailuresEnabled() bool {
+	return os.Getenv("NOMAD_FIREHOSE_EVALUATION_PLACEMENT_FAILURES") == "true"
+}
+
+// observe records the evaluation and returns its previous status, ok is false if this version
+// of the evaluation was already published
+func (f *Firehose) observe(evaluation *nomad.Evaluation) (previousStatus string, ok bool) {
+	now := time.Now()
+	defer f.prune(now)
+
+	seen, known := f.seen[evaluation.ID]
+	if known && evaluation.ModifyIndex <= seen.modifyIndex {
+		return "", false
+	}
+
+	f.seen[evaluation.ID] = &seenEvaluation{
+		modifyIndex: evaluation.ModifyIndex,
+		status:      evaluation.Status,
+		seenAt:      now,
+	}
+
+	if known {
+		return seen.status, true
+	}
+
+	return "", true
+}
+
+// prune forgets finished evaluations that haven't changed for a while
+func (f *Firehose) prune(now time.Time) {
+	if now.Sub(f.lastPrune) < pruneInterval {
+		return
+	}
+	f.lastPrune = now
+
+	for id, seen := range f.seen {
+		switch seen.status {
+		case "complete", "failed", "canceled":
+			if now.Sub(seen.seenAt) > finishedEvaluationRetention {
+				delete(f.seen, id)
+			}
+		}
+	}
+}
+
+// placementFailures returns the placement failures of a blocked evaluation. Blocked evaluations
+// created by older Nomad versions don't have them, they are then read from the evaluation that
+// failed to place the allocations
+func (f *Firehose) placementFailures(evaluation *nomad.Evaluation) map[string]*nomad.AllocationMetric {
+	if evaluation.Status != "blocked" || !placementFailuresEnabled() {
+		return nil
+	}
+
+	if len(evaluation.FailedTGAllocs) > 0 || evaluation.PreviousEval == "" {
+		return evaluation.FailedTGAllocs
+	}
+
+	previous, _, err := f.nomadClient.Evaluations().Info(evaluation.PreviousEval, &nomad.QueryOptions{
+		AllowStale: true,
+		Namespace:  evaluation.Namespace,
+	})
+	if err != nil {
+		log.Errorf("Could not read evaluation %s: %s", evaluation.PreviousEval, err)
+		return nil
+	}
+
+	return previous.FailedTGAllocs
+}
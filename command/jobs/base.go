@@ -5,19 +5,39 @@ import (
 	"time"
 
 	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
 	"github.com/seatgeek/nomad-firehose/sink"
 	log "github.com/sirupsen/logrus"
 )
 
-type WatchJobListFunc func(job *nomad.JobListStub)
+// WatchJobListFunc is called for every changed job, ack must be attached to the published message
+type WatchJobListFunc func(job *JobListStub, ack sink.AckFunc)
+
+// WatchJobFunc is called with the full job for every job event on the Nomad event stream
+type WatchJobFunc func(job *nomad.Job, ack sink.AckFunc)
+
+// JobListStub is nomad.JobListStub annotated with its namespace, which the Nomad API client
+// we build against predates, and its region
+type JobListStub struct {
+	nomad.JobListStub
+	Namespace string
+	Region    string
+}
 
 // Firehose ...
 type FirehoseBase struct {
+	name             string
+	checkpoint       *helper.Checkpoint
 	lastChangeIndex  uint64
 	lastChangeTimeCh chan interface{}
 	nomadClient      *nomad.Client
+	pool             *helper.WorkerPool // reads changed jobs from Nomad
+	region           string             // region to watch, empty for the region of the Nomad client
+	resolvedRegion   string             // region events are annotated with
 	sink             sink.Sink
 	stopCh           chan struct{}
+	summaryChanges   bool // a job also changed when only its summary changed, which doesn't bump its ModifyIndex
 }
 
 // NewFirehose ...
@@ -27,19 +47,46 @@ func NewFirehoseBase() (*FirehoseBase, error) {
 		return nil, err
 	}
 
-	sink, err := sink.GetSink("jobs")
+	return NewFirehoseBaseWithClient(nomadClient, nil)
+}
+
+// NewFirehoseBaseWithClient creates a FirehoseBase using an existing Nomad client and sink,
+// if s is nil the sink configured by SINK_TYPE is created
+func NewFirehoseBaseWithClient(nomadClient *nomad.Client, s sink.Sink) (*FirehoseBase, error) {
+	if s == nil {
+		var err error
+		if s, err = sink.GetSink("jobs"); err != nil {
+			return nil, err
+		}
+	}
+
+	pool, err := helper.NewWorkerPool()
 	if err != nil {
 		return nil, err
 	}
 
 	return &FirehoseBase{
 		nomadClient:      nomadClient,
-		sink:             sink,
+		pool:             pool,
+		sink:             s,
 		stopCh:           make(chan struct{}, 1),
 		lastChangeTimeCh: make(chan interface{}, 1),
 	}, nil
 }
 
+// setName sets the name of the firehose type embedding the base, and applies its filter and
+// transform stages to the sink
+func (f *FirehoseBase) setName(name string) error {
+	s, err := sink.ForFirehose(f.sink, name)
+	if err != nil {
+		return err
+	}
+
+	f.name = name
+	f.sink = s
+	return nil
+}
+
 func (f *FirehoseBase) UpdateCh() <-chan interface{} {
 	return f.lastChangeTimeCh
 }
@@ -56,12 +103,27 @@ func (f *FirehoseBase) SetRestoreValue(restoreValue interface{}) error {
 	return nil
 }
 
-// Start the firehose
-func (f *FirehoseBase) Start(w WatchJobListFunc) {
+// Start the firehose, if s is nil or the event stream is disabled, blocking queries
+// against the job list are used
+func (f *FirehoseBase) Start(w WatchJobListFunc, s WatchJobFunc) {
 	go f.sink.Start()
 
-	// watch for allocation changes
-	go f.watch(w)
+	// Stop chan for all tasks to depend on
+	f.stopCh = make(chan struct{})
+
+	// Only persist indexes the sink has acknowledged
+	f.checkpoint = helper.NewCheckpoint(f.lastChangeIndex)
+
+	f.resolvedRegion = helper.ResolveRegion(f.nomadClient, f.region)
+
+	f.pool.Start(f.name)
+
+	// watch for job changes
+	if s != nil && helper.EventStreamEnabled() {
+		go f.watchStream(w, s)
+	} else {
+		go f.watch(w)
+	}
 
 	// Save the last event time every 5s
 	go f.persistLastChangeTime(5 * time.Second)
@@ -76,10 +138,11 @@ func (f *FirehoseBase) Start(w WatchJobListFunc) {
 // Stop the firehose
 func (f *FirehoseBase) Stop() {
 	close(f.stopCh)
+	f.pool.Stop()
 	f.sink.Stop()
 }
 
-// Write the Last Change Time to Consul so if the process restarts,
+// Write the Last Change Time acknowledged by the sink to Consul so if the process restarts,
 // it will try to resume from where it left off, not emitting tons of double events for
 // old events
 func (f *FirehoseBase) persistLastChangeTime(interval time.Duration) {
@@ -88,11 +151,40 @@ func (f *FirehoseBase) persistLastChangeTime(interval time.Duration) {
 	for {
 		select {
 		case <-f.stopCh:
-			f.lastChangeTimeCh <- f.lastChangeIndex
+			f.lastChangeTimeCh <- f.checkpoint.Value()
 			break
 		case <-ticker.C:
-			f.lastChangeTimeCh <- f.lastChangeIndex
+			f.lastChangeTimeCh <- f.checkpoint.Value()
+		}
+	}
+}
+
+// Continously consume the Nomad event stream and pass job changes to s,
+// falling back to blocking queries if the cluster does not support the event stream
+func (f *FirehoseBase) watchStream(w WatchJobListFunc, s WatchJobFunc) {
+	stream := helper.NewEventStream(f.nomadClient, f.name, "Job")
+	err := stream.Subscribe(f.lastChangeIndex, f.stopCh, func(index uint64, events []*helper.StreamEvent) {
+		if index <= f.lastChangeIndex {
+			return
+		}
+
+		for _, event := range events {
+			job := &nomad.Job{}
+			if err := event.Decode("Job", job); err != nil {
+				log.Errorf("Unable to decode job event: %s", err)
+				continue
+			}
+
+			s(job, f.checkpoint.Track(index))
 		}
+
+		f.lastChangeIndex = index
+		f.checkpoint.Advance(index)
+	})
+
+	if err == helper.ErrEventStreamUnsupported {
+		log.Warn("Nomad event stream is not supported, falling back to blocking queries")
+		f.watch(w)
 	}
 }
 
@@ -102,12 +194,15 @@ func (f *FirehoseBase) watch(w WatchJobListFunc) {
 		WaitIndex:  f.lastChangeIndex,
 		WaitTime:   5 * time.Minute,
 		AllowStale: true,
+		Namespace:  helper.GetNamespaces().Query(),
 	}
 
 	newMax := f.lastChangeIndex
 
 	for {
-		jobs, meta, err := f.nomadClient.Jobs().List(q)
+		start := time.Now()
+		jobs, meta, err := f.list(q)
+		helper.ObserveNomadQuery(f.name, start, err)
 		if err != nil {
 			log.Errorf("Unable to fetch jobs: %s", err)
 			time.Sleep(10 * time.Second)
@@ -127,19 +222,52 @@ func (f *FirehoseBase) watch(w WatchJobListFunc) {
 
 		// Iterate jobs and find events that have changed since last run
 		for _, job := range jobs {
-			if job.ModifyIndex <= f.lastChangeIndex {
+			index := f.changeIndex(job)
+			if index <= f.lastChangeIndex {
+				continue
+			}
+
+			if !helper.GetNamespaces().Allowed(job.Namespace) {
 				continue
 			}
 
-			if job.ModifyIndex > newMax {
-				newMax = job.ModifyIndex
+			if index > newMax {
+				newMax = index
 			}
 
-			w(job)
+			w(job, f.checkpoint.Track(index))
 		}
 
 		// Update WaitIndex and Last Change Time for next iteration
 		q.WaitIndex = meta.LastIndex
+		metrics.NomadIndex.Set(float64(q.WaitIndex), f.name)
 		f.lastChangeIndex = newMax
+		f.checkpoint.Advance(newMax)
 	}
 }
+
+// changeIndex returns the index a job last changed at, the index of its summary included if the
+// firehose watches summary changes
+func (f *FirehoseBase) changeIndex(job *JobListStub) uint64 {
+	index := job.ModifyIndex
+	if f.summaryChanges && job.JobSummary != nil && job.JobSummary.ModifyIndex > index {
+		index = job.JobSummary.ModifyIndex
+	}
+
+	return index
+}
+
+// list the jobs, including their namespace and region
+func (f *FirehoseBase) list(q *nomad.QueryOptions) ([]*JobListStub, *nomad.QueryMeta, error) {
+	var jobs []*JobListStub
+	meta, err := f.nomadClient.Raw().Query("/v1/jobs", &jobs, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, job := range jobs {
+		job.Region = f.resolvedRegion
+	}
+
+	return jobs, meta, nil
+}
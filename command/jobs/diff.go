@@ -0,0 +1,370 @@
+package jobs
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"strings"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+// JobVersionDiffType is the Type of JobVersionDiff events
+const JobVersionDiffType = "JobVersionDiff"
+
+// JobVersionDiff is emitted along with the job when NOMAD_FIREHOSE_JOB_DIFFS=true and the job
+// has a new version, summarizing what changed since the previous version
+type JobVersionDiff struct {
+	Type            string
+	Namespace       string
+	Region          string
+	JobID           string
+	Version         uint64
+	PreviousVersion *uint64 // nil for the first version of a job
+	SubmitTime      int64
+	Stable          bool
+
+	// Nomad doesn't record who submitted a job, Meta is the job meta where deploy tooling
+	// usually records it, VersionTag the tag of the version (Nomad 1.9+)
+	Meta       map[string]string
+	VersionTag json.RawMessage `json:",omitempty"`
+
+	TaskGroups  []*TaskGroupChange
+	Images      []*ValueChange
+	Env         []*EnvChange
+	Counts      []*ValueChange
+	Constraints []*ConstraintChange
+
+	// Diff is the full diff computed by Nomad
+	Diff json.RawMessage `json:",omitempty"`
+}
+
+// TaskGroupChange is a task group that was added, deleted or edited
+type TaskGroupChange struct {
+	Name  string
+	Type  string   // Added, Deleted or Edited
+	Tasks []string // tasks that were added, deleted or edited
+}
+
+// ValueChange is a value that changed in a task group or task
+type ValueChange struct {
+	TaskGroup string
+	Task      string `json:",omitempty"`
+	Old       string
+	New       string
+}
+
+// EnvChange is an environment variable that was added, deleted or edited, values are left out
+// as they may hold secrets
+type EnvChange struct {
+	TaskGroup string
+	Task      string
+	Key       string
+	Type      string
+}
+
+// ConstraintChange is a constraint that was added, deleted or edited, TaskGroup and Task are
+// empty for job constraints
+type ConstraintChange struct {
+	TaskGroup string `json:",omitempty"`
+	Task      string `json:",omitempty"`
+	Type      string
+	Old       string
+	New       string
+}
+
+// jobVersions is the response of /v1/job/:id/versions?diffs=true, newest first, Diffs[i] is the
+// diff between Versions[i] and Versions[i+1]
+type jobVersions struct {
+	Versions []*struct {
+		Version        uint64
+		JobModifyIndex uint64
+		SubmitTime     int64
+		Stable         bool
+		Meta           map[string]string
+		VersionTag     json.RawMessage
+	}
+	Diffs []json.RawMessage
+}
+
+type jobDiff struct {
+	Type       string
+	Objects    []*objectDiff
+	TaskGroups []*struct {
+		Type    string
+		Name    string
+		Fields  []*fieldDiff
+		Objects []*objectDiff
+		Tasks   []*struct {
+			Type    string
+			Name    string
+			Fields  []*fieldDiff
+			Objects []*objectDiff
+		}
+	}
+}
+
+type objectDiff struct {
+	Type    string
+	Name    string
+	Fields  []*fieldDiff
+	Objects []*objectDiff
+}
+
+type fieldDiff struct {
+	Type string
+	Name string
+	Old  string
+	New  string
+}
+
+// jobDiffsEnabled returns true if NOMAD_FIREHOSE_JOB_DIFFS=true
+func jobDiffsEnabled() bool {
+	return os.Getenv("NOMAD_FIREHOSE_JOB_DIFFS") == "true"
+}
+
+// publishWithDiff publishes the job, and the diffs of the versions it had since the last diffed one
+func (f *JobFirehose) publishWithDiff(job *nomad.Job, ack sink.AckFunc) {
+	if !jobDiffsEnabled() {
+		f.Publish(job, ack)
+		return
+	}
+
+	diffs, err := f.versionDiffs(job)
+	if err != nil {
+		ack(err)
+		return
+	}
+
+	ack = sink.AckAll(ack, 1+len(diffs))
+	f.Publish(job, ack)
+
+	for _, diff := range diffs {
+		b, err := json.Marshal(diff)
+		if err != nil {
+			log.Error(err)
+			ack(nil)
+			continue
+		}
+
+		// The diffs come from the same index as the job
+		meta := jobMetadata(diff.Type, "version_diff", diff.Region, job)
+		meta.ID = helper.EventID(diff.Type, diff.Region, diff.Namespace, diff.JobID, diff.Version)
+		f.sink.Put(sink.NewEventMessage(meta, b, ack))
+		metrics.EventsPublished.Inc(f.Name())
+	}
+}
+
+// versionDiffs returns the diffs of the versions of the job that weren't diffed yet, oldest first.
+// Updates of a job can be collapsed, so there may be several. The version is only recorded as
+// diffed once the versions were read, it returns an error if they couldn't be read before the
+// firehose stopped
+func (f *JobFirehose) versionDiffs(job *nomad.Job) ([]*JobVersionDiff, error) {
+	if job.ID == nil || job.Version == nil {
+		return nil, nil
+	}
+
+	namespace := ""
+	if job.Namespace != nil {
+		namespace = *job.Namespace
+	}
+
+	key := namespace + "/" + *job.ID
+
+	f.lock.Lock()
+	last, known := f.versions[key]
+	f.lock.Unlock()
+
+	if known && *job.Version <= last {
+		return nil, nil
+	}
+
+	// Versions submitted before a restart were diffed already
+	if !known && job.JobModifyIndex != nil && *job.JobModifyIndex <= f.restoreIndex {
+		f.recordVersion(key, *job.Version)
+		return nil, nil
+	}
+
+	versions := &jobVersions{}
+	var readErr error
+	if !helper.ReadObject(f.stopCh, "versions of job "+*job.ID, func(err error) { readErr = err }, func() error {
+		_, err := f.nomadClient.Raw().Query("/v1/job/"+url.PathEscape(*job.ID)+"/versions?diffs=true", versions, &nomad.QueryOptions{
+			AllowStale: true,
+			Namespace:  namespace,
+		})
+		return err
+	}) {
+		// The job was deleted along with its versions, it is still published
+		return nil, readErr
+	}
+
+	f.recordVersion(key, *job.Version)
+
+	return newVersionDiffs(versions, f.resolvedRegion, namespace, *job.ID, *job.Version, last, known, f.restoreIndex), nil
+}
+
+// recordVersion records version as the last diffed version of the job
+func (f *JobFirehose) recordVersion(key string, version uint64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if last, ok := f.versions[key]; !ok || version > last {
+		f.versions[key] = version
+	}
+}
+
+// newVersionDiffs returns the diffs of the versions after last up to current, oldest first. If no
+// version of the job was diffed yet, those submitted after restoreIndex are
+func newVersionDiffs(versions *jobVersions, region, namespace, jobID string, current, last uint64, known bool, restoreIndex uint64) []*JobVersionDiff {
+	diffs := make([]*JobVersionDiff, 0)
+
+	for i := len(versions.Versions) - 1; i >= 0; i-- {
+		version := versions.Versions[i]
+		if version.Version > current {
+			continue
+		}
+		if known && version.Version <= last {
+			continue
+		}
+		if !known && version.Version != current && version.JobModifyIndex <= restoreIndex {
+			continue
+		}
+
+		d := &JobVersionDiff{
+			Type:        JobVersionDiffType,
+			Namespace:   namespace,
+			Region:      region,
+			JobID:       jobID,
+			Version:     version.Version,
+			SubmitTime:  version.SubmitTime,
+			Stable:      version.Stable,
+			Meta:        version.Meta,
+			VersionTag:  version.VersionTag,
+			TaskGroups:  make([]*TaskGroupChange, 0),
+			Images:      make([]*ValueChange, 0),
+			Env:         make([]*EnvChange, 0),
+			Counts:      make([]*ValueChange, 0),
+			Constraints: make([]*ConstraintChange, 0),
+		}
+
+		if i < len(versions.Diffs) && i+1 < len(versions.Versions) {
+			d.PreviousVersion = &versions.Versions[i+1].Version
+			d.Diff = versions.Diffs[i]
+			if err := d.summarize(versions.Diffs[i]); err != nil {
+				log.Errorf("Could not decode diff of job %s version %d: %s", jobID, version.Version, err)
+			}
+		}
+
+		diffs = append(diffs, d)
+	}
+
+	if len(diffs) == 0 {
+		log.Warnf("Version %d of job %s was not found, it may have been garbage collected", current, jobID)
+	}
+
+	return diffs
+}
+
+// summarize the task groups, images, env keys, counts and constraints that changed in the diff
+func (d *JobVersionDiff) summarize(raw json.RawMessage) error {
+	diff := &jobDiff{}
+	if err := json.Unmarshal(raw, diff); err != nil {
+		return err
+	}
+
+	d.Constraints = append(d.Constraints, constraintChanges("", "", diff.Objects)...)
+
+	for _, group := range diff.TaskGroups {
+		if group.Type == "None" {
+			continue
+		}
+
+		change := &TaskGroupChange{Name: group.Name, Type: group.Type}
+		d.TaskGroups = append(d.TaskGroups, change)
+
+		for _, field := range group.Fields {
+			if field.Name == "Count" && field.Type != "None" {
+				d.Counts = append(d.Counts, &ValueChange{TaskGroup: group.Name, Old: field.Old, New: field.New})
+			}
+		}
+
+		d.Constraints = append(d.Constraints, constraintChanges(group.Name, "", group.Objects)...)
+
+		for _, task := range group.Tasks {
+			if task.Type == "None" {
+				continue
+			}
+
+			change.Tasks = append(change.Tasks, task.Name)
+
+			// Env is flattened in the task fields as Env[KEY]
+			for _, field := range task.Fields {
+				if field.Type != "None" && strings.HasPrefix(field.Name, "Env[") && strings.HasSuffix(field.Name, "]") {
+					d.Env = append(d.Env, &EnvChange{
+						TaskGroup: group.Name,
+						Task:      task.Name,
+						Key:       field.Name[len("Env[") : len(field.Name)-1],
+						Type:      field.Type,
+					})
+				}
+			}
+
+			for _, object := range task.Objects {
+				switch object.Name {
+				case "Config":
+					for _, field := range object.Fields {
+						if strings.EqualFold(field.Name, "image") && field.Type != "None" {
+							d.Images = append(d.Images, &ValueChange{TaskGroup: group.Name, Task: task.Name, Old: field.Old, New: field.New})
+						}
+					}
+				case "Env":
+					for _, field := range object.Fields {
+						if field.Type != "None" {
+							d.Env = append(d.Env, &EnvChange{TaskGroup: group.Name, Task: task.Name, Key: field.Name, Type: field.Type})
+						}
+					}
+				}
+			}
+
+			d.Constraints = append(d.Constraints, constraintChanges(group.Name, task.Name, task.Objects)...)
+		}
+	}
+
+	return nil
+}
+
+// constraintFields is the position of the constraint fields in their rendering
+var constraintFields = map[string]int{"LTarget": 0, "Operand": 1, "RTarget": 2}
+
+// constraintChanges returns the constraints that changed in objects, rendered as "LTarget Operand RTarget"
+func constraintChanges(group, task string, objects []*objectDiff) []*ConstraintChange {
+	changes := make([]*ConstraintChange, 0)
+
+	for _, object := range objects {
+		if object.Name != "Constraint" || object.Type == "None" {
+			continue
+		}
+
+		var old, new [3]string
+		for _, field := range object.Fields {
+			if n, ok := constraintFields[field.Name]; ok {
+				old[n], new[n] = field.Old, field.New
+			}
+		}
+
+		change := &ConstraintChange{TaskGroup: group, Task: task, Type: object.Type}
+		if object.Type != "Added" {
+			change.Old = strings.TrimSpace(strings.Join(old[:], " "))
+		}
+		if object.Type != "Deleted" {
+			change.New = strings.TrimSpace(strings.Join(new[:], " "))
+		}
+		changes = append(changes, change)
+	}
+
+	return changes
+}
@@ -0,0 +1,86 @@
+package jobs
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// testVersions returns the versions from newest to oldest, each submitted at index 100*version,
+// with a diff adding a task group named after the version
+func testVersions(newest uint64) *jobVersions {
+	versions := &jobVersions{}
+
+	for v := int(newest); v >= 0; v-- {
+		versions.Versions = append(versions.Versions, &struct {
+			Version        uint64
+			JobModifyIndex uint64
+			SubmitTime     int64
+			Stable         bool
+			Meta           map[string]string
+			VersionTag     json.RawMessage
+		}{Version: uint64(v), JobModifyIndex: 100 * uint64(v)})
+
+		if v > 0 {
+			versions.Diffs = append(versions.Diffs, json.RawMessage(`{"Type":"Edited","TaskGroups":[{"Type":"Added","Name":"v`+string(rune('0'+v))+`"}]}`))
+		}
+	}
+
+	return versions
+}
+
+func diffVersions(diffs []*JobVersionDiff) []uint64 {
+	versions := make([]uint64, 0, len(diffs))
+	for _, diff := range diffs {
+		versions = append(versions, diff.Version)
+	}
+	return versions
+}
+
+func TestNewVersionDiffs(t *testing.T) {
+	tests := []struct {
+		name         string
+		current      uint64
+		last         uint64
+		known        bool
+		restoreIndex uint64
+		want         []uint64
+	}{
+		{"next version", 3, 2, true, 0, []uint64{3}},
+		{"collapsed updates", 4, 2, true, 0, []uint64{3, 4}},
+		{"newer version than the update", 3, 1, true, 0, []uint64{2, 3}},
+		{"first update", 2, 0, false, 0, []uint64{0, 1, 2}},
+		{"first update after a restart", 4, 0, false, 200, []uint64{3, 4}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diffs := newVersionDiffs(testVersions(4), "global", "default", "web", test.current, test.last, test.known, test.restoreIndex)
+
+			got := diffVersions(diffs)
+			if len(got) != len(test.want) {
+				t.Fatalf("got versions %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("got versions %v, want %v", got, test.want)
+				}
+			}
+
+			for _, diff := range diffs {
+				if diff.Version == 0 {
+					if diff.PreviousVersion != nil {
+						t.Errorf("version 0 has previous version %d", *diff.PreviousVersion)
+					}
+					continue
+				}
+
+				if diff.PreviousVersion == nil || *diff.PreviousVersion != diff.Version-1 {
+					t.Errorf("version %d has previous version %v, want %d", diff.Version, diff.PreviousVersion, diff.Version-1)
+				}
+				if len(diff.TaskGroups) != 1 || diff.TaskGroups[0].Name != "v"+string(rune('0'+diff.Version)) {
+					t.Errorf("version %d has the diff of another version: %+v", diff.Version, diff.TaskGroups)
+				}
+			}
+		})
+	}
+}
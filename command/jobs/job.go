@@ -2,14 +2,22 @@ package jobs
 
 import (
 	"encoding/json"
+	"sync"
 
 	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/sink"
 	log "github.com/sirupsen/logrus"
 )
 
 // Firehose ...
 type JobFirehose struct {
 	FirehoseBase
+
+	lock         sync.Mutex
+	restoreIndex uint64            // versions submitted before were diffed before a restart
+	versions     map[string]uint64 // last diffed version by namespace and job
 }
 
 // NewFirehose ...
@@ -19,35 +27,92 @@ func NewJobFirehose() (*JobFirehose, error) {
 		return nil, err
 	}
 
-	return &JobFirehose{FirehoseBase: *base}, nil
+	f := &JobFirehose{FirehoseBase: *base}
+	if err := f.setName(f.Name()); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// NewJobFirehoseWithClient creates a JobFirehose using an existing Nomad client and sink
+func NewJobFirehoseWithClient(nomadClient *nomad.Client, s sink.Sink) (*JobFirehose, error) {
+	base, err := NewFirehoseBaseWithClient(nomadClient, s)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &JobFirehose{FirehoseBase: *base}
+	if err := f.setName(f.Name()); err != nil {
+		return nil, err
+	}
+
+	return f, nil
 }
 
 func (f *JobFirehose) Name() string {
-	return "jobs"
+	return helper.RegionName("jobs", f.region)
+}
+
+// SetRegion sets the Nomad region the firehose watches, the Nomad client must query the same region
+func (f *JobFirehose) SetRegion(region string) {
+	f.region = region
+	f.name = f.Name()
 }
 
-// Publish an update from the firehose
-func (f *JobFirehose) Publish(update *nomad.Job) {
+// Publish an update from the firehose, ack is called once the sink acknowledged it
+func (f *JobFirehose) Publish(update *nomad.Job, ack sink.AckFunc) {
 	b, err := json.Marshal(update)
 	if err != nil {
 		log.Error(err)
+		ack(nil)
+		return
 	}
 
-	f.sink.Put(b)
+	f.sink.Put(sink.NewEventMessage(jobMetadata("job", "updated", f.resolvedRegion, update), b, ack))
+	metrics.EventsPublished.Inc(f.Name())
 }
 
 func (f *JobFirehose) Start() {
-	f.FirehoseBase.Start(f.watchJobList)
+	f.restoreIndex = f.lastChangeIndex
+	f.versions = make(map[string]uint64)
+
+	f.FirehoseBase.Start(f.watchJobList, f.publishWithDiff)
 }
 
-func (f *JobFirehose) watchJobList(job *nomad.JobListStub) {
-	go func(jobID string) {
-		fullJob, _, err := f.nomadClient.Jobs().Info(jobID, &nomad.QueryOptions{})
-		if err != nil {
-			log.Errorf("Could not read job %s: %s", jobID, err)
+func (f *JobFirehose) watchJobList(job *JobListStub, ack sink.AckFunc) {
+	jobID, namespace := job.ID, job.Namespace
+	f.pool.Submit(namespace+"/"+jobID, ack, func(ack sink.AckFunc) {
+		var fullJob *nomad.Job
+		if !helper.ReadObject(f.stopCh, "job "+jobID, ack, func() (err error) {
+			fullJob, _, err = f.nomadClient.Jobs().Info(jobID, &nomad.QueryOptions{Namespace: namespace})
+			return err
+		}) {
 			return
 		}
 
-		f.Publish(fullJob)
-	}(job.ID)
+		f.publishWithDiff(fullJob, ack)
+	})
+}
+
+// jobMetadata returns the metadata of a job event, identified by region, namespace, ID and ModifyIndex
+func jobMetadata(idType, eventType, region string, job *nomad.Job) sink.Metadata {
+	var namespace, id string
+	var modifyIndex uint64
+	if job.Namespace != nil {
+		namespace = *job.Namespace
+	}
+	if job.ID != nil {
+		id = *job.ID
+	}
+	if job.ModifyIndex != nil {
+		modifyIndex = *job.ModifyIndex
+	}
+
+	return sink.Metadata{
+		ID:     helper.EventID(idType, region, namespace, id, modifyIndex),
+		Type:   eventType,
+		Region: region,
+		Index:  modifyIndex,
+	}
 }
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 
 	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/sink"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,27 +22,63 @@ func NewJobListStubFirehose() (*JobListStubFirehose, error) {
 		return nil, err
 	}
 
-	return &JobListStubFirehose{FirehoseBase: *base}, nil
+	f := &JobListStubFirehose{FirehoseBase: *base}
+	if err := f.setName(f.Name()); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// NewJobListStubFirehoseWithClient creates a JobListStubFirehose using an existing Nomad client and sink
+func NewJobListStubFirehoseWithClient(nomadClient *nomad.Client, s sink.Sink) (*JobListStubFirehose, error) {
+	base, err := NewFirehoseBaseWithClient(nomadClient, s)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &JobListStubFirehose{FirehoseBase: *base}
+	if err := f.setName(f.Name()); err != nil {
+		return nil, err
+	}
+
+	return f, nil
 }
 
 func (f *JobListStubFirehose) Name() string {
-	return "jobliststub"
+	return helper.RegionName("jobliststub", f.region)
+}
+
+// SetRegion sets the Nomad region the firehose watches, the Nomad client must query the same region
+func (f *JobListStubFirehose) SetRegion(region string) {
+	f.region = region
+	f.name = f.Name()
 }
 
 func (f *JobListStubFirehose) Start() {
-	f.FirehoseBase.Start(f.watchJobList)
+	// The event stream only carries full jobs, not list stubs
+	f.FirehoseBase.Start(f.watchJobList, nil)
 }
 
-// Publish an update from the firehose
-func (f *JobListStubFirehose) Publish(update *nomad.JobListStub) {
+// Publish an update from the firehose, ack is called once the sink acknowledged it
+func (f *JobListStubFirehose) Publish(update *JobListStub, ack sink.AckFunc) {
 	b, err := json.Marshal(update)
 	if err != nil {
 		log.Error(err)
+		ack(nil)
+		return
 	}
 
-	f.sink.Put(b)
+	meta := sink.Metadata{
+		ID:     helper.EventID("jobliststub", f.resolvedRegion, update.Namespace, update.ID, update.ModifyIndex),
+		Type:   "updated",
+		Region: f.resolvedRegion,
+		Index:  update.ModifyIndex,
+	}
+	f.sink.Put(sink.NewEventMessage(meta, b, ack))
+	metrics.EventsPublished.Inc(f.Name())
 }
 
-func (f *JobListStubFirehose) watchJobList(job *nomad.JobListStub) {
-	f.Publish(job)
+func (f *JobListStubFirehose) watchJobList(job *JobListStub, ack sink.AckFunc) {
+	f.Publish(job, ack)
 }
@@ -0,0 +1,190 @@
+package jobs
+
+import (
+	"encoding/json"
+	"reflect"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+// JobStatusChangeType is the Type of JobStatusChange events
+const JobStatusChangeType = "JobStatusChange"
+
+// JobStatusChange is emitted when the status, stop flag or task group summary of a job changed,
+// the previous values are empty for jobs seen for the first time
+type JobStatusChange struct {
+	Type              string
+	Namespace         string
+	Region            string
+	JobID             string
+	ParentID          string
+	Name              string
+	JobType           string
+	ModifyIndex       uint64
+	Index             uint64   // greater of ModifyIndex and the ModifyIndex of the summary
+	ChangedFields     []string // Status, Stop and/or Summary
+	Status            string
+	PreviousStatus    string
+	StatusDescription string
+	Stop              bool
+	PreviousStop      bool
+	Summary           map[string]nomad.TaskGroupSummary
+	PreviousSummary   map[string]nomad.TaskGroupSummary
+}
+
+// JobStatusFirehose emits the status transitions and summary count changes of jobs, rather
+// than every change of the job list stubs
+type JobStatusFirehose struct {
+	FirehoseBase
+
+	jobs map[string]*JobListStub // last known stub by namespace and job
+}
+
+// NewJobStatusFirehose ...
+func NewJobStatusFirehose() (*JobStatusFirehose, error) {
+	base, err := NewFirehoseBase()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &JobStatusFirehose{FirehoseBase: *base}
+	f.summaryChanges = true
+	if err := f.setName(f.Name()); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// NewJobStatusFirehoseWithClient creates a JobStatusFirehose using an existing Nomad client and sink
+func NewJobStatusFirehoseWithClient(nomadClient *nomad.Client, s sink.Sink) (*JobStatusFirehose, error) {
+	base, err := NewFirehoseBaseWithClient(nomadClient, s)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &JobStatusFirehose{FirehoseBase: *base}
+	f.summaryChanges = true
+	if err := f.setName(f.Name()); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *JobStatusFirehose) Name() string {
+	return helper.RegionName("jobstatus", f.region)
+}
+
+// SetRegion sets the Nomad region the firehose watches, the Nomad client must query the same region
+func (f *JobStatusFirehose) SetRegion(region string) {
+	f.region = region
+	f.name = f.Name()
+}
+
+func (f *JobStatusFirehose) Start() {
+	f.jobs = make(map[string]*JobListStub)
+	f.seed()
+
+	// The event stream only carries full jobs, without their summary
+	f.FirehoseBase.Start(f.watchJobList, nil)
+}
+
+// seed the last known state of the jobs that didn't change since the restored index, as the
+// job list only hands changed jobs to watchJobList
+func (f *JobStatusFirehose) seed() {
+	jobs, _, err := f.list(&nomad.QueryOptions{
+		AllowStale: true,
+		Namespace:  helper.GetNamespaces().Query(),
+	})
+	if err != nil {
+		log.Errorf("Unable to seed the status of jobs: %s", err)
+		return
+	}
+
+	for _, job := range jobs {
+		if f.changeIndex(job) <= f.lastChangeIndex {
+			f.jobs[job.Namespace+"/"+job.ID] = job
+		}
+	}
+}
+
+// Publish an update from the firehose, ack is called once the sink acknowledged it
+func (f *JobStatusFirehose) Publish(update *JobStatusChange, ack sink.AckFunc) {
+	b, err := json.Marshal(update)
+	if err != nil {
+		log.Error(err)
+		ack(nil)
+		return
+	}
+
+	meta := sink.Metadata{
+		ID:     helper.EventID(update.Type, update.Region, update.Namespace, update.JobID, update.Index),
+		Type:   "status_changed",
+		Region: update.Region,
+		Index:  update.Index,
+	}
+	f.sink.Put(sink.NewEventMessage(meta, b, ack))
+	metrics.EventsPublished.Inc(f.Name())
+}
+
+func (f *JobStatusFirehose) watchJobList(job *JobListStub, ack sink.AckFunc) {
+	key := job.Namespace + "/" + job.ID
+	previous, known := f.jobs[key]
+	f.jobs[key] = job
+
+	if !known {
+		previous = &JobListStub{}
+	}
+
+	current, before := summary(job), summary(previous)
+
+	changed := make([]string, 0)
+	if job.Status != previous.Status {
+		changed = append(changed, "Status")
+	}
+	if job.Stop != previous.Stop {
+		changed = append(changed, "Stop")
+	}
+	if !reflect.DeepEqual(current, before) {
+		changed = append(changed, "Summary")
+	}
+
+	if len(changed) == 0 {
+		ack(nil)
+		return
+	}
+
+	f.Publish(&JobStatusChange{
+		Type:              JobStatusChangeType,
+		Namespace:         job.Namespace,
+		Region:            job.Region,
+		JobID:             job.ID,
+		ParentID:          job.ParentID,
+		Name:              job.Name,
+		JobType:           job.Type,
+		ModifyIndex:       job.ModifyIndex,
+		Index:             f.changeIndex(job),
+		ChangedFields:     changed,
+		Status:            job.Status,
+		PreviousStatus:    previous.Status,
+		StatusDescription: job.StatusDescription,
+		Stop:              job.Stop,
+		PreviousStop:      previous.Stop,
+		Summary:           current,
+		PreviousSummary:   before,
+	}, ack)
+}
+
+// summary returns the task group summaries of a job, nil if it has none
+func summary(job *JobListStub) map[string]nomad.TaskGroupSummary {
+	if job.JobSummary == nil || len(job.JobSummary.Summary) == 0 {
+		return nil
+	}
+
+	return job.JobSummary.Summary
+}
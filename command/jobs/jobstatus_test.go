@@ -0,0 +1,86 @@
+package jobs
+
+import (
+	"encoding/json"
+	"testing"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/sink"
+)
+
+// testSink records the messages put on it
+type testSink struct {
+	messages []*sink.Message
+}
+
+func (s *testSink) Start() error { return nil }
+func (s *testSink) Stop()        {}
+
+func (s *testSink) Put(message *sink.Message) error {
+	s.messages = append(s.messages, message)
+	message.Ack(nil)
+	return nil
+}
+
+func jobStub(modifyIndex, summaryIndex uint64, running int) *JobListStub {
+	return &JobListStub{
+		JobListStub: nomad.JobListStub{
+			ID:          "web",
+			Status:      "running",
+			ModifyIndex: modifyIndex,
+			JobSummary: &nomad.JobSummary{
+				Summary:     map[string]nomad.TaskGroupSummary{"frontend": {Running: running}},
+				ModifyIndex: summaryIndex,
+			},
+		},
+		Namespace: "default",
+	}
+}
+
+func TestJobStatusSummaryOnlyChange(t *testing.T) {
+	s := &testSink{}
+	f := &JobStatusFirehose{
+		FirehoseBase: FirehoseBase{sink: s, summaryChanges: true, lastChangeIndex: 20},
+		jobs:         map[string]*JobListStub{"default/web": jobStub(10, 20, 1)},
+	}
+
+	// Only the summary changed, the ModifyIndex of the job is unchanged
+	job := jobStub(10, 30, 3)
+	if index := f.changeIndex(job); index != 30 {
+		t.Fatalf("expected the job to have changed at index 30, got %d", index)
+	}
+
+	f.watchJobList(job, nil)
+
+	if len(s.messages) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(s.messages))
+	}
+
+	var event JobStatusChange
+	if err := json.Unmarshal(s.messages[0].Data, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(event.ChangedFields) != 1 || event.ChangedFields[0] != "Summary" {
+		t.Errorf("expected only the summary to change, got %v", event.ChangedFields)
+	}
+	if event.Index != 30 || s.messages[0].Index != 30 {
+		t.Errorf("expected the event to be at index 30, got %d", event.Index)
+	}
+	if event.PreviousSummary["frontend"].Running != 1 || event.Summary["frontend"].Running != 3 {
+		t.Errorf("unexpected summaries %v -> %v", event.PreviousSummary, event.Summary)
+	}
+}
+
+func TestJobStatusUnchangedSummaryIsSkipped(t *testing.T) {
+	f := &JobStatusFirehose{FirehoseBase: FirehoseBase{summaryChanges: true}}
+
+	if index := f.changeIndex(jobStub(10, 5, 1)); index != 10 {
+		t.Errorf("expected the ModifyIndex of the job, got %d", index)
+	}
+
+	f.summaryChanges = false
+	if index := f.changeIndex(jobStub(10, 30, 1)); index != 10 {
+		t.Errorf("expected the summary to be ignored, got %d", index)
+	}
+}
@@ -0,0 +1,267 @@
+package jobs
+
+import (
+	"encoding/json"
+	"net/url"
+	"sort"
+	"sync"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+// ScalingEvent is a scaling event of a task group, annotated with the job, the task group
+// status and its scaling policy. Count is nil for events that didn't change the count, e.g.
+// the autoscaler reporting an error
+type ScalingEvent struct {
+	Namespace     string
+	Region        string
+	JobID         string
+	GroupName     string
+	Count         *int64
+	PreviousCount int64
+	Error         bool
+	Message       string
+	Meta          map[string]interface{}
+	EvalID        *string
+	Time          uint64
+	CreateIndex   uint64
+
+	// Current status of the task group
+	Desired   int
+	Placed    int
+	Running   int
+	Healthy   int
+	Unhealthy int
+
+	// Policy is the scaling policy of the task group, nil if it has none
+	Policy *ScalingPolicy
+}
+
+// ScalingPolicy is a scaling policy of /v1/scaling/policy/:id (Nomad 0.11+), the Nomad API client
+// we build against predates scaling policies
+type ScalingPolicy struct {
+	ID      string
+	Type    string
+	Enabled bool
+	Min     *int64
+	Max     *int64
+	Policy  map[string]interface{}
+	Target  map[string]string
+}
+
+// jobScaleStatus is the response of /v1/job/:id/scale
+type jobScaleStatus struct {
+	JobID      string
+	Namespace  string
+	TaskGroups map[string]*struct {
+		Desired   int
+		Placed    int
+		Running   int
+		Healthy   int
+		Unhealthy int
+		Events    []*ScalingEvent
+	}
+}
+
+// ScalingFirehose emits the scaling events of task groups, read every time their job changed
+type ScalingFirehose struct {
+	FirehoseBase
+
+	lock         sync.Mutex
+	restoreIndex uint64            // events created before were published before a restart
+	seen         map[string]uint64 // highest published event CreateIndex by namespace, job and group
+}
+
+// NewScalingFirehose ...
+func NewScalingFirehose() (*ScalingFirehose, error) {
+	base, err := NewFirehoseBase()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &ScalingFirehose{FirehoseBase: *base}
+	if err := f.setName(f.Name()); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// NewScalingFirehoseWithClient creates a ScalingFirehose using an existing Nomad client and sink
+func NewScalingFirehoseWithClient(nomadClient *nomad.Client, s sink.Sink) (*ScalingFirehose, error) {
+	base, err := NewFirehoseBaseWithClient(nomadClient, s)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &ScalingFirehose{FirehoseBase: *base}
+	if err := f.setName(f.Name()); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *ScalingFirehose) Name() string {
+	return helper.RegionName("scaling", f.region)
+}
+
+// SetRegion sets the Nomad region the firehose watches, the Nomad client must query the same region
+func (f *ScalingFirehose) SetRegion(region string) {
+	f.region = region
+	f.name = f.Name()
+}
+
+// Publish a scaling event from the firehose, ack is called once the sink acknowledged it
+func (f *ScalingFirehose) Publish(update *ScalingEvent, ack sink.AckFunc) {
+	b, err := json.Marshal(update)
+	if err != nil {
+		log.Error(err)
+		ack(nil)
+		return
+	}
+
+	meta := sink.Metadata{
+		ID:     helper.EventID("scaling", update.Region, update.Namespace, update.JobID, update.GroupName, update.CreateIndex),
+		Type:   "event",
+		Region: update.Region,
+		Index:  update.CreateIndex,
+	}
+	f.sink.Put(sink.NewEventMessage(meta, b, ack))
+	metrics.EventsPublished.Inc(f.Name())
+}
+
+func (f *ScalingFirehose) Start() {
+	f.restoreIndex = f.lastChangeIndex
+	f.seen = make(map[string]uint64)
+
+	f.FirehoseBase.Start(f.watchJobList, f.watchJob)
+}
+
+func (f *ScalingFirehose) watchJobList(job *JobListStub, ack sink.AckFunc) {
+	f.pool.Submit(job.Namespace+"/"+job.ID, ack, func(ack sink.AckFunc) {
+		f.publishScalingEvents(job.ID, job.Namespace, ack)
+	})
+}
+
+func (f *ScalingFirehose) watchJob(job *nomad.Job, ack sink.AckFunc) {
+	if job.ID == nil {
+		ack(nil)
+		return
+	}
+
+	namespace := ""
+	if job.Namespace != nil {
+		namespace = *job.Namespace
+	}
+
+	jobID := *job.ID
+	f.pool.Submit(namespace+"/"+jobID, ack, func(ack sink.AckFunc) {
+		f.publishScalingEvents(jobID, namespace, ack)
+	})
+}
+
+// publishScalingEvents reads the scaling events of a job, and publishes the ones that were not
+// published yet, oldest first
+func (f *ScalingFirehose) publishScalingEvents(jobID, namespace string, ack sink.AckFunc) {
+	status := &jobScaleStatus{}
+	if !helper.ReadObject(f.stopCh, "scaling status of job "+jobID, ack, func() error {
+		_, err := f.nomadClient.Raw().Query("/v1/job/"+url.PathEscape(jobID)+"/scale", status, &nomad.QueryOptions{
+			AllowStale: true,
+			Namespace:  namespace,
+		})
+		return err
+	}) {
+		return
+	}
+
+	events := make([]*ScalingEvent, 0)
+	for name, group := range status.TaskGroups {
+		key := namespace + "/" + jobID + "/" + name
+
+		f.lock.Lock()
+		seen, ok := f.seen[key]
+		if !ok {
+			seen = f.restoreIndex
+		}
+
+		newest := seen
+		for _, event := range group.Events {
+			if event.CreateIndex <= seen {
+				continue
+			}
+
+			if event.CreateIndex > newest {
+				newest = event.CreateIndex
+			}
+
+			event.Namespace = namespace
+			event.Region = f.resolvedRegion
+			event.JobID = jobID
+			event.GroupName = name
+			event.Desired = group.Desired
+			event.Placed = group.Placed
+			event.Running = group.Running
+			event.Healthy = group.Healthy
+			event.Unhealthy = group.Unhealthy
+			events = append(events, event)
+		}
+		f.seen[key] = newest
+		f.lock.Unlock()
+	}
+
+	if len(events) == 0 {
+		ack(nil)
+		return
+	}
+
+	policies := f.policies(jobID, namespace)
+	for _, event := range events {
+		event.Policy = policies[event.GroupName]
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].CreateIndex < events[j].CreateIndex
+	})
+
+	ack = sink.AckAll(ack, len(events))
+	for _, event := range events {
+		f.Publish(event, ack)
+	}
+}
+
+// policies returns the scaling policies of the task groups of a job, by group name
+func (f *ScalingFirehose) policies(jobID, namespace string) map[string]*ScalingPolicy {
+	policies := make(map[string]*ScalingPolicy)
+
+	var stubs []*ScalingPolicy
+	_, err := f.nomadClient.Raw().Query("/v1/scaling/policies?job="+url.QueryEscape(jobID), &stubs, &nomad.QueryOptions{
+		AllowStale: true,
+		Namespace:  namespace,
+	})
+	if err != nil {
+		log.Errorf("Could not read scaling policies of job %s: %s", jobID, err)
+		return policies
+	}
+
+	for _, stub := range stubs {
+		policy := &ScalingPolicy{}
+		if _, err := f.nomadClient.Raw().Query("/v1/scaling/policy/"+url.PathEscape(stub.ID), policy, &nomad.QueryOptions{
+			AllowStale: true,
+			Namespace:  namespace,
+		}); err != nil {
+			log.Errorf("Could not read scaling policy %s: %s", stub.ID, err)
+			continue
+		}
+
+		if group, ok := policy.Target["Group"]; ok {
+			policies[group] = policy
+		}
+	}
+
+	return policies
+}
@@ -0,0 +1,163 @@
+package multi
+
+import (
+	"fmt"
+	"strings"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/backend"
+	"github.com/seatgeek/nomad-firehose/command/allocations"
+	"github.com/seatgeek/nomad-firehose/command/deployments"
+	"github.com/seatgeek/nomad-firehose/command/evaluations"
+	"github.com/seatgeek/nomad-firehose/command/jobs"
+	"github.com/seatgeek/nomad-firehose/command/nodes"
+	"github.com/seatgeek/nomad-firehose/command/services"
+	"github.com/seatgeek/nomad-firehose/command/volumes"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types is the list of firehose types the multi command can run
+var Types = []string{"allocations", "nodes", "evaluations", "jobs", "jobliststubs", "deployments", "volumes", "services", "scaling", "jobstatus"}
+
+// ParseTypes parses a comma separated list of firehose types, an empty list means all types
+func ParseTypes(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return Types, nil
+	}
+
+	seen := make(map[string]bool)
+	types := make([]string, 0)
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+
+		if !isValidType(name) {
+			return nil, fmt.Errorf("Invalid firehose type: %s, Valid values: %s", name, strings.Join(Types, ", "))
+		}
+
+		seen[name] = true
+		types = append(types, name)
+	}
+
+	return types, nil
+}
+
+func isValidType(name string) bool {
+	for _, t := range Types {
+		if t == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runner is a firehose that can watch a specific Nomad region
+type runner interface {
+	helper.Runner
+	SetRegion(region string)
+}
+
+// Run the firehose types in a single process, for each of the Nomad regions (or the region
+// of the Nomad client if regions is empty)
+//
+// Each firehose is run by its own Manager, so it keeps its own lock and checkpoint key per region,
+// but they all share one Nomad client per region, one backend and, if sharedSink is set, one sink
+func Run(types []string, regions []string, sharedSink bool) error {
+	RegisterEventTypes()
+
+	b, err := backend.GetBackend()
+	if err != nil {
+		return err
+	}
+
+	var s sink.Sink
+	if sharedSink {
+		shared, err := sink.GetSink("multi")
+		if err != nil {
+			return err
+		}
+
+		s = sink.NewSharedSink(shared)
+	}
+
+	if len(regions) == 0 {
+		regions = []string{""}
+	}
+
+	managers := make([]*helper.Manager, 0, len(types)*len(regions))
+	names := make([]string, 0, len(types)*len(regions))
+	for _, region := range regions {
+		config := nomad.DefaultConfig()
+		if region != "" {
+			config.Region = region
+		}
+
+		nomadClient, err := nomad.NewClient(config)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range types {
+			r, err := newRunner(name, nomadClient, s)
+			if err != nil {
+				return err
+			}
+
+			r.SetRegion(region)
+			managers = append(managers, helper.NewManagerWithBackend(r, b))
+			names = append(names, r.Name())
+		}
+	}
+
+	log.Infof("Starting firehoses: %s", strings.Join(names, ", "))
+
+	errCh := make(chan error, len(managers))
+	for _, manager := range managers {
+		go func(m *helper.Manager) {
+			errCh <- m.Start()
+		}(manager)
+	}
+
+	// Wait for all managers to stop, and fail as soon as one of them does
+	for range managers {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newRunner creates the firehose for a type, s may be nil to create a sink per firehose
+func newRunner(name string, nomadClient *nomad.Client, s sink.Sink) (runner, error) {
+	switch name {
+	case "allocations":
+		return allocations.NewFirehoseWithClient(nomadClient, s)
+	case "nodes":
+		return nodes.NewFirehoseWithClient(nomadClient, s)
+	case "evaluations":
+		return evaluations.NewFirehoseWithClient(nomadClient, s)
+	case "jobs":
+		return jobs.NewJobFirehoseWithClient(nomadClient, s)
+	case "jobliststubs":
+		return jobs.NewJobListStubFirehoseWithClient(nomadClient, s)
+	case "deployments":
+		return deployments.NewFirehoseWithClient(nomadClient, s)
+	case "volumes":
+		return volumes.NewFirehoseWithClient(nomadClient, s)
+	case "services":
+		return services.NewFirehoseWithClient(nomadClient, s)
+	case "scaling":
+		return jobs.NewScalingFirehoseWithClient(nomadClient, s)
+	case "jobstatus":
+		return jobs.NewJobStatusFirehoseWithClient(nomadClient, s)
+	default:
+		return nil, fmt.Errorf("Invalid firehose type: %s, Valid values: %s", name, strings.Join(Types, ", "))
+	}
+}
@@ -0,0 +1,129 @@
+package multi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/command/allocations"
+	"github.com/seatgeek/nomad-firehose/command/deployments"
+	"github.com/seatgeek/nomad-firehose/command/evaluations"
+	"github.com/seatgeek/nomad-firehose/command/jobs"
+	"github.com/seatgeek/nomad-firehose/command/nodes"
+	"github.com/seatgeek/nomad-firehose/command/services"
+	"github.com/seatgeek/nomad-firehose/command/volumes"
+	"github.com/seatgeek/nomad-firehose/sink"
+)
+
+// eventTypes is the Go type of the events of each firehose type, by the Type of their metadata
+var eventTypes = map[string]map[string]interface{}{
+	"allocations": {
+		"task_event":   allocations.AllocationUpdate{},
+		"state_change": allocations.AllocationStateChange{},
+		"snapshot":     allocations.AllocationSnapshot{},
+	},
+	"nodes": {
+		"updated":  nodes.Node{},
+		"changed":  nodes.NodeChange{},
+		"snapshot": nodes.Node{},
+	},
+	"evaluations": {
+		"updated": evaluations.Evaluation{},
+	},
+	"jobs": {
+		"updated":      nomad.Job{},
+		"version_diff": jobs.JobVersionDiff{},
+	},
+	"jobliststub": {
+		"updated": jobs.JobListStub{},
+	},
+	"jobstatus": {
+		"status_changed": jobs.JobStatusChange{},
+	},
+	"deployments": {
+		"updated":        deployments.Deployment{},
+		"snapshot":       deployments.Deployment{},
+		"started":        deployments.DeploymentEvent{},
+		"canary_placed":  deployments.DeploymentEvent{},
+		"health_changed": deployments.DeploymentEvent{},
+		"promoted":       deployments.DeploymentEvent{},
+		"failed":         deployments.DeploymentEvent{},
+		"successful":     deployments.DeploymentEvent{},
+		"cancelled":      deployments.DeploymentEvent{},
+	},
+	"volumes": {
+		"claimed":                   volumes.VolumeEvent{},
+		"unclaimed":                 volumes.VolumeEvent{},
+		"schedulability_changed":    volumes.VolumeEvent{},
+		"host_volume_state_changed": volumes.VolumeEvent{},
+		"plugin_health_changed":     volumes.PluginEvent{},
+	},
+	"services": {
+		"registered":     services.ServiceEvent{},
+		"deregistered":   services.ServiceEvent{},
+		"health_changed": services.ServiceEvent{},
+	},
+	"scaling": {
+		"event": jobs.ScalingEvent{},
+	},
+}
+
+// RegisterEventTypes registers the Go types of the events of every firehose type with the sinks,
+// for them to encode events as Avro
+func RegisterEventTypes() {
+	for firehose, types := range eventTypes {
+		for eventType, v := range types {
+			sink.RegisterEventType(firehose, eventType, v)
+		}
+	}
+}
+
+// WriteSchemas writes the Avro schema of every event type to dir as <firehose>.<type>.avsc, or to
+// w as a JSON array if dir is empty
+func WriteSchemas(dir string, w io.Writer) error {
+	RegisterEventTypes()
+
+	schemas, err := sink.AvroSchemas()
+	if err != nil {
+		return err
+	}
+
+	if dir == "" {
+		list := make([]json.RawMessage, 0, len(schemas))
+		for _, schema := range schemas {
+			list = append(list, json.RawMessage(schema.Schema))
+		}
+
+		b, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, schema := range schemas {
+		var b bytes.Buffer
+		if err := json.Indent(&b, []byte(schema.Schema), "", "  "); err != nil {
+			return err
+		}
+		b.WriteString("\n")
+
+		name := filepath.Join(dir, fmt.Sprintf("%s.%s.avsc", schema.Firehose, schema.Type))
+		if err := ioutil.WriteFile(name, b.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
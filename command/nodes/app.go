@@ -6,19 +6,34 @@ import (
 	"time"
 
 	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
 	"github.com/seatgeek/nomad-firehose/sink"
 	log "github.com/sirupsen/logrus"
 )
 
 // Firehose ...
 type Firehose struct {
+	checkpoint        *helper.Checkpoint
 	lastChangeIndex   uint64
 	lastChangeIndexCh chan interface{}
 	nomadClient       *nomad.Client
+	pool              *helper.WorkerPool // reads changed nodes from Nomad
+	region            string             // region to watch, empty for the region of the Nomad client
+	restoreIndex      uint64             // nodes that changed since were not seen before a restart
+	resolvedRegion    string             // region events are annotated with
 	sink              sink.Sink
+	state             *nodeState // last known state of nodes, nil unless node changes are enabled
 	stopCh            chan struct{}
 }
 
+// Node is the node emitted by the firehose, annotated with its region, nodes are not namespaced
+type Node struct {
+	*nomad.Node
+	Region   string
+	Snapshot bool `json:",omitempty"` // set for the current state emitted by the full-snapshot startup policy
+}
+
 // NewFirehose ...
 func NewFirehose() (*Firehose, error) {
 	nomadClient, err := nomad.NewClient(nomad.DefaultConfig())
@@ -26,21 +41,45 @@ func NewFirehose() (*Firehose, error) {
 		return nil, err
 	}
 
-	sink, err := sink.GetSink("nodes")
+	return NewFirehoseWithClient(nomadClient, nil)
+}
+
+// NewFirehoseWithClient creates a Firehose using an existing Nomad client and sink,
+// if s is nil the sink configured by SINK_TYPE is created
+func NewFirehoseWithClient(nomadClient *nomad.Client, s sink.Sink) (*Firehose, error) {
+	if s == nil {
+		var err error
+		if s, err = sink.GetSink("nodes"); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := sink.ForFirehose(s, "nodes")
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := helper.NewWorkerPool()
 	if err != nil {
 		return nil, err
 	}
 
 	return &Firehose{
 		nomadClient:       nomadClient,
-		sink:              sink,
+		pool:              pool,
+		sink:              s,
 		stopCh:            make(chan struct{}, 1),
 		lastChangeIndexCh: make(chan interface{}, 1),
 	}, nil
 }
 
 func (f *Firehose) Name() string {
-	return "nodes"
+	return helper.RegionName("nodes", f.region)
+}
+
+// SetRegion sets the Nomad region the firehose watches, the Nomad client must query the same region
+func (f *Firehose) SetRegion(region string) {
+	f.region = region
 }
 
 func (f *Firehose) UpdateCh() <-chan interface{} {
@@ -66,8 +105,36 @@ func (f *Firehose) Start() {
 	// Stop chan for all tasks to depend on
 	f.stopCh = make(chan struct{})
 
-	// watch for allocation changes
-	go f.watch()
+	// Without a restore point, start where the startup policy asks for
+	snapshot := f.startup()
+	select {
+	case <-f.stopCh:
+		return
+	default:
+	}
+
+	// Only persist indexes the sink has acknowledged
+	f.checkpoint = helper.NewCheckpoint(f.lastChangeIndex)
+
+	f.resolvedRegion = helper.ResolveRegion(f.nomadClient, f.region)
+
+	f.pool.Start(f.Name())
+
+	// Emit what changed on nodes rather than the full nodes
+	if nodeChangesEnabled() {
+		f.restoreIndex = f.lastChangeIndex
+		f.state = &nodeState{nodes: make(map[string]*nomad.Node)}
+		f.seedNodes()
+	}
+
+	f.publishSnapshot(snapshot)
+
+	// watch for node changes
+	if helper.EventStreamEnabled() {
+		go f.watchStream()
+	} else {
+		go f.watch()
+	}
 
 	// Save the last event time every 5s
 	go f.persistLastChangeTime(5 * time.Second)
@@ -82,10 +149,11 @@ func (f *Firehose) Start() {
 // Stop the firehose
 func (f *Firehose) Stop() {
 	close(f.stopCh)
+	f.pool.Stop()
 	f.sink.Stop()
 }
 
-// Write the Last Change Time to Consul so if the process restarts,
+// Write the Last Change Time acknowledged by the sink to Consul so if the process restarts,
 // it will try to resume from where it left off, not emitting tons of double events for
 // old events
 func (f *Firehose) persistLastChangeTime(interval time.Duration) {
@@ -94,22 +162,66 @@ func (f *Firehose) persistLastChangeTime(interval time.Duration) {
 	for {
 		select {
 		case <-f.stopCh:
-			f.lastChangeIndexCh <- f.lastChangeIndex
+			f.lastChangeIndexCh <- f.checkpoint.Value()
 			break
 		case <-ticker.C:
-			f.lastChangeIndexCh <- f.lastChangeIndex
+			f.lastChangeIndexCh <- f.checkpoint.Value()
 		}
 	}
 }
 
-// Publish an update from the firehose
-func (f *Firehose) Publish(update *nomad.Node) {
-	b, err := json.Marshal(update)
+// Publish an update from the firehose, ack is called once the sink acknowledged it
+func (f *Firehose) Publish(update *nomad.Node, ack sink.AckFunc) {
+	if f.state != nil {
+		f.publishChange(update, ack)
+		return
+	}
+
+	b, err := json.Marshal(&Node{Node: update, Region: f.resolvedRegion})
 	if err != nil {
 		log.Error(err)
+		ack(nil)
+		return
 	}
 
-	f.sink.Put(b)
+	meta := sink.Metadata{
+		ID:     helper.EventID("node", f.resolvedRegion, update.ID, update.ModifyIndex),
+		Type:   "updated",
+		Region: f.resolvedRegion,
+		Index:  update.ModifyIndex,
+	}
+	f.sink.Put(sink.NewEventMessage(meta, b, ack))
+	metrics.EventsPublished.Inc(f.Name())
+}
+
+// Continously consume the Nomad event stream and publish node changes as updates,
+// falling back to blocking queries if the cluster does not support the event stream
+func (f *Firehose) watchStream() {
+	stream := helper.NewEventStream(f.nomadClient, f.Name(), "Node")
+	err := stream.Subscribe(f.lastChangeIndex, f.stopCh, func(index uint64, events []*helper.StreamEvent) {
+		if index <= f.lastChangeIndex {
+			return
+		}
+
+		// The event payload is the full node, so there is no need to read it back from Nomad
+		for _, event := range events {
+			node := &nomad.Node{}
+			if err := event.Decode("Node", node); err != nil {
+				log.Errorf("Unable to decode node event: %s", err)
+				continue
+			}
+
+			f.Publish(node, f.checkpoint.Track(index))
+		}
+
+		f.lastChangeIndex = index
+		f.checkpoint.Advance(index)
+	})
+
+	if err == helper.ErrEventStreamUnsupported {
+		log.Warn("Nomad event stream is not supported, falling back to blocking queries")
+		f.watch()
+	}
 }
 
 // Continously watch for changes to the allocation list and publish it as updates
@@ -123,7 +235,9 @@ func (f *Firehose) watch() {
 	newMax := f.lastChangeIndex
 
 	for {
+		start := time.Now()
 		clients, meta, err := f.nomadClient.Nodes().List(q)
+		helper.ObserveNomadQuery(f.Name(), start, err)
 		if err != nil {
 			log.Errorf("Unable to fetch clients: %s", err)
 			time.Sleep(10 * time.Second)
@@ -151,19 +265,24 @@ func (f *Firehose) watch() {
 				newMax = client.ModifyIndex
 			}
 
-			go func(clientId string) {
-				fullClient, _, err := f.nomadClient.Nodes().Info(clientId, &nomad.QueryOptions{})
-				if err != nil {
-					log.Errorf("Could not read client %s: %s", clientId, err)
+			clientId := client.ID
+			f.pool.Submit(clientId, f.checkpoint.Track(client.ModifyIndex), func(ack sink.AckFunc) {
+				var fullClient *nomad.Node
+				if !helper.ReadObject(f.stopCh, "client "+clientId, ack, func() (err error) {
+					fullClient, _, err = f.nomadClient.Nodes().Info(clientId, &nomad.QueryOptions{})
+					return err
+				}) {
 					return
 				}
 
-				f.Publish(fullClient)
-			}(client.ID)
+				f.Publish(fullClient, ack)
+			})
 		}
 
 		// Update WaitIndex and Last Change Time for next iteration
 		q.WaitIndex = meta.LastIndex
+		metrics.NomadIndex.Set(float64(q.WaitIndex), f.Name())
 		f.lastChangeIndex = newMax
+		f.checkpoint.Advance(newMax)
 	}
 }
@@ -0,0 +1,79 @@
+package nodes
+
+import (
+	"encoding/json"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+// startup applies the startup policy when there is no restore point, moving the last change index
+// to the current index of the node list, and returns the nodes to publish a snapshot of
+func (f *Firehose) startup() []*nomad.NodeListStub {
+	policy := helper.GetStartupPolicy()
+	if f.lastChangeIndex != 0 || !policy.SkipHistory() {
+		return nil
+	}
+
+	// Nodes don't record when they changed, so there is no history to replay since a time
+	if policy.Mode == helper.StartupReplaySince {
+		log.Warnf("Nodes can't be replayed since a time, starting from now")
+	}
+
+	for {
+		start := time.Now()
+		nodes, meta, err := f.nomadClient.Nodes().List(&nomad.QueryOptions{AllowStale: true})
+		helper.ObserveNomadQuery(f.Name(), start, err)
+		if err == nil {
+			log.Infof("No Last Change Time restore point, starting from index %d with the %s startup policy", meta.LastIndex, policy)
+			f.lastChangeIndex = meta.LastIndex
+
+			if !policy.Snapshot() {
+				return nil
+			}
+			return nodes
+		}
+
+		log.Errorf("Unable to fetch clients: %s", err)
+
+		select {
+		case <-f.stopCh:
+			return nil
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// publishSnapshot publishes the current state of the nodes that are not down, flagged as a snapshot
+func (f *Firehose) publishSnapshot(nodes []*nomad.NodeListStub) {
+	for _, stub := range nodes {
+		if stub.Status == "down" {
+			continue
+		}
+
+		node, _, err := f.nomadClient.Nodes().Info(stub.ID, &nomad.QueryOptions{AllowStale: true})
+		if err != nil {
+			log.Errorf("Could not read client %s: %s", stub.ID, err)
+			continue
+		}
+
+		b, err := json.Marshal(&Node{Node: node, Region: f.resolvedRegion, Snapshot: true})
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		meta := sink.Metadata{
+			ID:     helper.EventID("NodeSnapshot", f.resolvedRegion, node.ID, node.ModifyIndex),
+			Type:   "snapshot",
+			Region: f.resolvedRegion,
+			Index:  node.ModifyIndex,
+		}
+		f.sink.Put(sink.NewEventMessage(meta, b, f.checkpoint.Track(f.lastChangeIndex)))
+		metrics.EventsPublished.Inc(f.Name())
+	}
+}
@@ -0,0 +1,245 @@
+package nodes
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+// NodeChangeType is the Type of NodeChange events
+const NodeChangeType = "NodeChange"
+
+// NodeChange is emitted instead of the full node when NOMAD_FIREHOSE_NODE_CHANGES=true, with
+// the old and new value of each field that changed and the node events recorded since
+type NodeChange struct {
+	Type          string
+	NodeID        string
+	Name          string
+	Datacenter    string
+	NodeClass     string
+	Region        string
+	ModifyIndex   uint64
+	Registered    bool // true if the node registered after the restored index, Old values are empty for nodes not seen before
+	ChangedFields []string
+	Changes       map[string]*FieldChange
+	Events        []*nomad.NodeEvent
+}
+
+// FieldChange is the old and new value of a node field. Attributes, meta and drivers are
+// reported per key, e.g. "Meta.rack" or "Drivers.docker"
+type FieldChange struct {
+	Old interface{}
+	New interface{}
+}
+
+// DriverHealth is the part of a node driver NodeChange reports changes of
+type DriverHealth struct {
+	Detected          bool
+	Healthy           bool
+	HealthDescription string
+}
+
+// nodeState is the last known state of the nodes
+type nodeState struct {
+	sync.Mutex
+	nodes map[string]*nomad.Node
+}
+
+// nodeChangesEnabled returns true if NOMAD_FIREHOSE_NODE_CHANGES=true
+func nodeChangesEnabled() bool {
+	return os.Getenv("NOMAD_FIREHOSE_NODE_CHANGES") == "true"
+}
+
+// seedNodes reads the nodes that didn't change since the restored index, so the first change of
+// each node after startup can be diffed. Nodes that changed while the firehose was down are left
+// out, so their replayed update is published
+func (f *Firehose) seedNodes() {
+	start := time.Now()
+	nodes, _, err := f.nomadClient.Nodes().List(&nomad.QueryOptions{AllowStale: true})
+	helper.ObserveNomadQuery(f.Name(), start, err)
+	if err != nil {
+		log.Errorf("Unable to seed the state of nodes: %s", err)
+		return
+	}
+
+	seeded := 0
+	for _, stub := range nodes {
+		if stub.ModifyIndex > f.restoreIndex {
+			continue
+		}
+
+		node, _, err := f.nomadClient.Nodes().Info(stub.ID, &nomad.QueryOptions{AllowStale: true})
+		if err != nil {
+			log.Errorf("Unable to seed the state of node %s: %s", stub.ID, err)
+			continue
+		}
+
+		if f.seedNode(node) {
+			seeded++
+		}
+	}
+
+	log.Infof("Seeded the state of %d of %d nodes", seeded, len(nodes))
+}
+
+// seedNode records the state of the node if it didn't change since the restored index
+func (f *Firehose) seedNode(node *nomad.Node) bool {
+	if node.ModifyIndex > f.restoreIndex {
+		return false
+	}
+
+	f.state.Lock()
+	defer f.state.Unlock()
+
+	if previous, ok := f.state.nodes[node.ID]; !ok || node.ModifyIndex > previous.ModifyIndex {
+		f.state.nodes[node.ID] = node
+	}
+	return true
+}
+
+// publishChange publishes what changed on the node since it was last seen, if anything
+func (f *Firehose) publishChange(node *nomad.Node, ack sink.AckFunc) {
+	f.state.Lock()
+	previous, known := f.state.nodes[node.ID]
+	if known && node.ModifyIndex <= previous.ModifyIndex {
+		f.state.Unlock()
+		ack(nil)
+		return
+	}
+	f.state.nodes[node.ID] = node
+	f.state.Unlock()
+
+	if !known {
+		previous = &nomad.Node{}
+	}
+
+	change := &NodeChange{
+		Type:        NodeChangeType,
+		NodeID:      node.ID,
+		Name:        node.Name,
+		Datacenter:  node.Datacenter,
+		NodeClass:   node.NodeClass,
+		Region:      f.resolvedRegion,
+		ModifyIndex: node.ModifyIndex,
+		Registered:  !known && node.CreateIndex > f.restoreIndex,
+		Changes:     diffNodes(previous, node),
+		Events:      newEvents(previous, node),
+	}
+
+	if len(change.Changes) == 0 && len(change.Events) == 0 {
+		ack(nil)
+		return
+	}
+
+	change.ChangedFields = make([]string, 0, len(change.Changes))
+	for name := range change.Changes {
+		change.ChangedFields = append(change.ChangedFields, name)
+	}
+	sort.Strings(change.ChangedFields)
+
+	b, err := json.Marshal(change)
+	if err != nil {
+		log.Error(err)
+		ack(nil)
+		return
+	}
+
+	meta := sink.Metadata{
+		ID:     helper.EventID(change.Type, change.Region, change.NodeID, change.ModifyIndex),
+		Type:   "changed",
+		Region: change.Region,
+		Index:  change.ModifyIndex,
+	}
+	f.sink.Put(sink.NewEventMessage(meta, b, ack))
+	metrics.EventsPublished.Inc(f.Name())
+}
+
+// diffNodes returns the changes between the previous and current state of a node
+func diffNodes(previous, current *nomad.Node) map[string]*FieldChange {
+	changes := make(map[string]*FieldChange)
+
+	compare := func(name string, old, new interface{}) {
+		if !reflect.DeepEqual(old, new) {
+			changes[name] = &FieldChange{Old: old, New: new}
+		}
+	}
+
+	compare("Status", previous.Status, current.Status)
+	compare("StatusDescription", previous.StatusDescription, current.StatusDescription)
+	compare("Drain", previous.Drain, current.Drain)
+	compare("DrainStrategy", previous.DrainStrategy, current.DrainStrategy)
+	compare("SchedulingEligibility", previous.SchedulingEligibility, current.SchedulingEligibility)
+
+	diffMaps(changes, "Attributes.", previous.Attributes, current.Attributes)
+	diffMaps(changes, "Meta.", previous.Meta, current.Meta)
+
+	drivers := make(map[string]bool)
+	for name := range previous.Drivers {
+		drivers[name] = true
+	}
+	for name := range current.Drivers {
+		drivers[name] = true
+	}
+	for name := range drivers {
+		compare("Drivers."+name, driverHealth(previous.Drivers[name]), driverHealth(current.Drivers[name]))
+	}
+
+	return changes
+}
+
+// diffMaps adds a change for each key of old and new whose value differs, a missing key is nil
+func diffMaps(changes map[string]*FieldChange, prefix string, old, new map[string]string) {
+	for k, v := range old {
+		if n, ok := new[k]; !ok {
+			changes[prefix+k] = &FieldChange{Old: v}
+		} else if n != v {
+			changes[prefix+k] = &FieldChange{Old: v, New: n}
+		}
+	}
+
+	for k, v := range new {
+		if _, ok := old[k]; !ok {
+			changes[prefix+k] = &FieldChange{New: v}
+		}
+	}
+}
+
+func driverHealth(driver *nomad.DriverInfo) *DriverHealth {
+	if driver == nil {
+		return nil
+	}
+
+	return &DriverHealth{
+		Detected:          driver.Detected,
+		Healthy:           driver.Healthy,
+		HealthDescription: driver.HealthDescription,
+	}
+}
+
+// newEvents returns the node events newer than the newest event of the previous state
+func newEvents(previous, current *nomad.Node) []*nomad.NodeEvent {
+	var newest time.Time
+	for _, event := range previous.Events {
+		if event.Timestamp.After(newest) {
+			newest = event.Timestamp
+		}
+	}
+
+	events := make([]*nomad.NodeEvent, 0)
+	for _, event := range current.Events {
+		if event.Timestamp.After(newest) {
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
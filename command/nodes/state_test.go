@@ -0,0 +1,100 @@
+package nodes
+
+import (
+	"encoding/json"
+	"testing"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/sink"
+)
+
+// testSink records the messages put on it
+type testSink struct {
+	messages []*sink.Message
+}
+
+func (s *testSink) Start() error { return nil }
+func (s *testSink) Stop()        {}
+
+func (s *testSink) Put(message *sink.Message) error {
+	s.messages = append(s.messages, message)
+	message.Ack(nil)
+	return nil
+}
+
+func testNode(id string, createIndex, modifyIndex uint64, eligibility string) *nomad.Node {
+	return &nomad.Node{
+		ID:                    id,
+		Name:                  id,
+		Status:                "ready",
+		SchedulingEligibility: eligibility,
+		CreateIndex:           createIndex,
+		ModifyIndex:           modifyIndex,
+	}
+}
+
+func TestNodeChangesDuringDowntimeArePublished(t *testing.T) {
+	s := &testSink{}
+	f := &Firehose{
+		sink:         s,
+		restoreIndex: 100,
+		state:        &nodeState{nodes: make(map[string]*nomad.Node)},
+	}
+
+	// Restarted at index 100: worker-1 didn't change since, worker-2 was drained at index 150 and
+	// worker-3 registered at index 120
+	unchanged := testNode("worker-1", 10, 50, "eligible")
+	drained := testNode("worker-2", 10, 150, "ineligible")
+	registered := testNode("worker-3", 120, 120, "eligible")
+
+	if !f.seedNode(unchanged) {
+		t.Error("expected worker-1 to be seeded")
+	}
+	if f.seedNode(drained) || f.seedNode(registered) {
+		t.Error("expected nodes that changed while the firehose was down not to be seeded")
+	}
+
+	// The watch replays the nodes that changed since the restored index
+	acked := 0
+	ack := func(err error) {
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		acked++
+	}
+	for _, node := range []*nomad.Node{drained, registered} {
+		f.publishChange(node, ack)
+	}
+
+	if acked != 2 {
+		t.Errorf("expected 2 acks, got %d", acked)
+	}
+	if len(s.messages) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(s.messages))
+	}
+
+	var events []*NodeChange
+	for _, message := range s.messages {
+		event := &NodeChange{}
+		if err := json.Unmarshal(message.Data, event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+
+	if events[0].NodeID != "worker-2" || events[0].Registered {
+		t.Errorf("expected worker-2 to have changed without registering, got %+v", events[0])
+	}
+	if change := events[0].Changes["SchedulingEligibility"]; change == nil || change.New != "ineligible" {
+		t.Errorf("expected worker-2 to become ineligible, got %+v", events[0].Changes)
+	}
+	if events[1].NodeID != "worker-3" || !events[1].Registered {
+		t.Errorf("expected worker-3 to have registered, got %+v", events[1])
+	}
+
+	// A replayed update of the seeded node that didn't change is not published
+	f.publishChange(unchanged, ack)
+	if len(s.messages) != 2 {
+		t.Errorf("expected the unchanged node not to be published, got %d events", len(s.messages))
+	}
+}
@@ -0,0 +1,625 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultCheckInterval = 30 * time.Second
+
+// Firehose ...
+type Firehose struct {
+	checkpoint        *helper.Checkpoint
+	lastChangeIndex   uint64
+	lastChangeIndexCh chan interface{}
+	nomadClient       *nomad.Client
+	region            string // region to watch, empty for the region of the Nomad client
+	resolvedRegion    string // region events are annotated with
+	sink              sink.Sink
+	stopCh            chan struct{}
+
+	lock          sync.Mutex
+	registrations map[string]*ServiceRegistration // registered service instances by ID
+	restored      map[string]*ServiceRegistration // instances registered before a restart, until the services are listed
+	checks        map[string]string               // last known status of checks by allocation and check ID
+	services      map[string]*serviceInstances    // instances of each service by namespace and name, as last read
+
+	// Deregistered instances the sink didn't acknowledge yet, by ID. They are persisted with the
+	// registrations so they are deregistered again after a restart
+	deregisteredLock sync.Mutex
+	deregistered     map[string]*ServiceRegistration
+
+	synced     chan struct{} // closed once the registered services were first listed
+	syncedOnce sync.Once
+}
+
+// NewFirehose ...
+func NewFirehose() (*Firehose, error) {
+	nomadClient, err := nomad.NewClient(nomad.DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFirehoseWithClient(nomadClient, nil)
+}
+
+// NewFirehoseWithClient creates a Firehose using an existing Nomad client and sink,
+// if s is nil the sink configured by SINK_TYPE is created
+func NewFirehoseWithClient(nomadClient *nomad.Client, s sink.Sink) (*Firehose, error) {
+	if s == nil {
+		var err error
+		if s, err = sink.GetSink("services"); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := sink.ForFirehose(s, "services")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Firehose{
+		nomadClient:       nomadClient,
+		sink:              s,
+		stopCh:            make(chan struct{}, 1),
+		lastChangeIndexCh: make(chan interface{}, 1),
+	}, nil
+}
+
+func (f *Firehose) Name() string {
+	return helper.RegionName("services", f.region)
+}
+
+// SetRegion sets the Nomad region the firehose watches, the Nomad client must query the same region
+func (f *Firehose) SetRegion(region string) {
+	f.region = region
+}
+
+func (f *Firehose) UpdateCh() <-chan interface{} {
+	return f.lastChangeIndexCh
+}
+
+func (f *Firehose) SetRestoreValue(restoreValue interface{}) error {
+	switch restoreValue.(type) {
+	case int:
+		f.lastChangeIndex = uint64(restoreValue.(int))
+	case int64:
+		f.lastChangeIndex = uint64(restoreValue.(int64))
+	default:
+		return fmt.Errorf("Unknown restore type '%T' with value '%+v'", restoreValue, restoreValue)
+	}
+	return nil
+}
+
+// SetRestoreState restores the registrations known before a restart, so the instances that were
+// deregistered while the firehose was down are published once the services are listed
+func (f *Firehose) SetRestoreState(state []byte) error {
+	f.restored = make(map[string]*ServiceRegistration)
+	if state == nil {
+		return nil
+	}
+
+	var registrations []*ServiceRegistration
+	if err := json.Unmarshal(state, &registrations); err != nil {
+		return fmt.Errorf("Invalid restore state: %s", err)
+	}
+
+	for _, registration := range registrations {
+		f.restored[registration.ID] = registration
+	}
+	return nil
+}
+
+// Start the firehose
+func (f *Firehose) Start() {
+	go f.sink.Start()
+
+	// Stop chan for all tasks to depend on
+	f.stopCh = make(chan struct{})
+
+	// Only persist indexes the sink has acknowledged
+	f.checkpoint = helper.NewCheckpoint(f.lastChangeIndex)
+
+	f.resolvedRegion = helper.ResolveRegion(f.nomadClient, f.region)
+
+	f.registrations = make(map[string]*ServiceRegistration)
+	f.deregistered = make(map[string]*ServiceRegistration)
+	f.checks = make(map[string]string)
+	f.services = make(map[string]*serviceInstances)
+	f.synced = make(chan struct{})
+	f.syncedOnce = sync.Once{}
+
+	// watch for service registration changes
+	if helper.EventStreamEnabled() {
+		go f.watchStream()
+	} else {
+		go f.watch()
+	}
+
+	// watch for check status changes
+	interval, err := checkInterval()
+	if err != nil {
+		log.Error(err)
+	} else if interval > 0 {
+		go f.watchChecks(interval)
+	}
+
+	// Save the last event time every 5s
+	go f.persistLastChangeTime(5 * time.Second)
+
+	// wait forever for a stop signal to happen
+	select {
+	case <-f.stopCh:
+		return
+	}
+}
+
+// Stop the firehose
+func (f *Firehose) Stop() {
+	close(f.stopCh)
+	f.sink.Stop()
+}
+
+// Write the Last Change Time acknowledged by the sink to Consul so if the process restarts,
+// it will try to resume from where it left off, not emitting tons of double events for
+// old events. The known registrations are written along with it
+func (f *Firehose) persistLastChangeTime(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		select {
+		case <-f.stopCh:
+			f.lastChangeIndexCh <- f.snapshot()
+			break
+		case <-ticker.C:
+			f.lastChangeIndexCh <- f.snapshot()
+		}
+	}
+}
+
+// snapshot returns the checkpoint along with the known registrations, including the restored ones
+// that weren't listed yet and the deregistered ones the sink didn't acknowledge yet. The checkpoint
+// is read first, so the registrations are never older than it
+func (f *Firehose) snapshot() interface{} {
+	value := f.checkpoint.Value()
+
+	registrations := make([]*ServiceRegistration, 0)
+
+	f.lock.Lock()
+	for _, registration := range f.registrations {
+		registrations = append(registrations, registration)
+	}
+	for id, registration := range f.restored {
+		if _, ok := f.registrations[id]; !ok {
+			registrations = append(registrations, registration)
+		}
+	}
+	f.lock.Unlock()
+
+	f.deregisteredLock.Lock()
+	for _, registration := range f.deregistered {
+		registrations = append(registrations, registration)
+	}
+	f.deregisteredLock.Unlock()
+
+	state, err := json.Marshal(registrations)
+	if err != nil {
+		log.Errorf("Unable to encode the registrations: %s", err)
+		return value
+	}
+
+	return &helper.Snapshot{Value: value, State: state}
+}
+
+// Publish an event from the firehose, ack is called once the sink acknowledged it
+func (f *Firehose) Publish(eventType string, registration *ServiceRegistration, ack sink.AckFunc) {
+	event := f.newEvent(eventType, registration)
+	f.publish(helper.EventID(event.Type, event.Region, event.Namespace, event.ServiceID, event.ModifyIndex), event.ModifyIndex, event, ack)
+}
+
+// publish an event with its event ID and the index it comes from, 0 for check status changes
+func (f *Firehose) publish(id string, index uint64, event *ServiceEvent, ack sink.AckFunc) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Error(err)
+		if ack != nil {
+			ack(nil)
+		}
+		return
+	}
+
+	meta := sink.Metadata{
+		ID:     id,
+		Type:   helper.SnakeCase(strings.TrimPrefix(event.Type, "Service")),
+		Region: event.Region,
+		Index:  index,
+	}
+	f.sink.Put(sink.NewEventMessage(meta, b, ack))
+	metrics.EventsPublished.Inc(f.Name())
+}
+
+func (f *Firehose) newEvent(eventType string, registration *ServiceRegistration) *ServiceEvent {
+	return &ServiceEvent{
+		Type:        eventType,
+		Region:      f.resolvedRegion,
+		Namespace:   registration.Namespace,
+		ServiceName: registration.ServiceName,
+		ServiceID:   registration.ID,
+		Datacenter:  registration.Datacenter,
+		NodeID:      registration.NodeID,
+		JobID:       registration.JobID,
+		AllocID:     registration.AllocID,
+		Address:     registration.Address,
+		Port:        registration.Port,
+		Tags:        registration.Tags,
+		ModifyIndex: registration.ModifyIndex,
+	}
+}
+
+// Continously consume the Nomad event stream and publish service registrations and
+// deregistrations, falling back to blocking queries if the cluster does not support the event stream
+func (f *Firehose) watchStream() {
+	// The stream only has changes, the registered services are needed for check statuses
+	for {
+		registrations, meta, err := f.list(&nomad.QueryOptions{AllowStale: true})
+		if err == nil {
+			f.sync(registrations, 0, false)
+			f.deregisterRestored(registrations, meta.LastIndex)
+			f.markSynced()
+			break
+		}
+
+		log.Errorf("Unable to fetch services: %s", err)
+
+		select {
+		case <-f.stopCh:
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+
+	stream := helper.NewEventStream(f.nomadClient, f.Name(), "Service")
+	err := stream.Subscribe(f.lastChangeIndex, f.stopCh, func(index uint64, events []*helper.StreamEvent) {
+		if index <= f.lastChangeIndex {
+			return
+		}
+
+		for _, event := range events {
+			registration := &ServiceRegistration{}
+			if err := event.Decode("Service", registration); err != nil {
+				log.Errorf("Unable to decode service event: %s", err)
+				continue
+			}
+
+			switch event.Type {
+			case "ServiceRegistration":
+				f.sync([]*ServiceRegistration{registration}, index, false)
+			case "ServiceDeregistration":
+				f.lock.Lock()
+				f.deregister(registration, index)
+				f.lock.Unlock()
+			}
+		}
+
+		f.lastChangeIndex = index
+		f.checkpoint.Advance(index)
+	})
+
+	if err == helper.ErrEventStreamUnsupported {
+		log.Warn("Nomad event stream is not supported, falling back to blocking queries")
+		f.watch()
+	}
+}
+
+// Continously watch for changes to the service list and publish registrations and deregistrations
+func (f *Firehose) watch() {
+	// The first query doesn't block, the registered services are needed for check statuses even
+	// if none changed since the last change index, and sync skips those published before
+	q := &nomad.QueryOptions{
+		WaitTime:   5 * time.Minute,
+		AllowStale: true,
+	}
+
+	for {
+		start := time.Now()
+		registrations, meta, err := f.list(q)
+		helper.ObserveNomadQuery(f.Name(), start, err)
+		if err != nil {
+			log.Errorf("Unable to fetch services: %s", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		// Only work if the WaitIndex have changed
+		if meta.LastIndex == q.WaitIndex {
+			log.Debugf("Services index is unchanged (%d == %d)", meta.LastIndex, q.WaitIndex)
+			continue
+		}
+
+		log.Debugf("Services index is changed (%d <> %d)", meta.LastIndex, q.WaitIndex)
+
+		f.sync(registrations, meta.LastIndex, true)
+		f.deregisterRestored(registrations, meta.LastIndex)
+		f.markSynced()
+
+		// Update WaitIndex and Last Change Time for next iteration
+		q.WaitIndex = meta.LastIndex
+		metrics.NomadIndex.Set(float64(q.WaitIndex), f.Name())
+		f.lastChangeIndex = meta.LastIndex
+		f.checkpoint.Advance(meta.LastIndex)
+	}
+}
+
+// sync the known registrations, publishing the ones registered since the last change index.
+// If complete is set, registrations is the full list and the known registrations missing from
+// it are published as deregistered at index
+func (f *Firehose) sync(registrations []*ServiceRegistration, index uint64, complete bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	listed := make(map[string]bool, len(registrations))
+	for _, registration := range registrations {
+		listed[registration.ID] = true
+
+		if !helper.GetNamespaces().Allowed(registration.Namespace) {
+			continue
+		}
+
+		previous, known := f.registrations[registration.ID]
+		if known && registration.ModifyIndex <= previous.ModifyIndex {
+			continue
+		}
+
+		f.registrations[registration.ID] = registration
+
+		// Registrations older than the last change index were published before a restart
+		if known || registration.ModifyIndex <= f.lastChangeIndex {
+			continue
+		}
+
+		position := index
+		if position == 0 {
+			position = registration.ModifyIndex
+		}
+
+		f.Publish(ServiceRegistered, registration, f.checkpoint.Track(position))
+	}
+
+	if !complete {
+		return
+	}
+
+	for id, registration := range f.registrations {
+		if !listed[id] {
+			f.deregister(registration, index)
+		}
+	}
+}
+
+// deregisterRestored publishes the registrations known before a restart that are missing from the
+// full list of registrations at index, they were deregistered while the firehose was down
+func (f *Firehose) deregisterRestored(registrations []*ServiceRegistration, index uint64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	listed := make(map[string]bool, len(registrations))
+	for _, registration := range registrations {
+		listed[registration.ID] = true
+	}
+
+	for id, registration := range f.restored {
+		if !listed[id] && helper.GetNamespaces().Allowed(registration.Namespace) {
+			f.deregister(registration, index)
+		}
+	}
+
+	f.restored = nil
+}
+
+// deregister forgets a registration and publishes its deregistration at index, f.lock must be held.
+// It is kept in the persisted state until the sink acknowledged it
+func (f *Firehose) deregister(registration *ServiceRegistration, index uint64) {
+	delete(f.registrations, registration.ID)
+
+	f.deregisteredLock.Lock()
+	f.deregistered[registration.ID] = registration
+	f.deregisteredLock.Unlock()
+
+	ack := f.checkpoint.Track(index)
+	f.Publish(ServiceDeregistered, registration, func(err error) {
+		ack(err)
+		if err != nil {
+			return
+		}
+
+		f.deregisteredLock.Lock()
+		delete(f.deregistered, registration.ID)
+		f.deregisteredLock.Unlock()
+	})
+}
+
+// markSynced records that the registered services were listed, so their checks can be seeded
+func (f *Firehose) markSynced() {
+	f.syncedOnce.Do(func() {
+		close(f.synced)
+	})
+}
+
+// list all service registrations, q is used to block on the service list
+func (f *Firehose) list(q *nomad.QueryOptions) ([]*ServiceRegistration, *nomad.QueryMeta, error) {
+	q.Namespace = helper.GetNamespaces().Query()
+
+	var services []*serviceListStub
+	meta, err := f.nomadClient.Raw().Query("/v1/services", &services, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	registrations := make([]*ServiceRegistration, 0)
+	read := make(map[string]*serviceInstances)
+	for _, namespace := range services {
+		if !helper.GetNamespaces().Allowed(namespace.Namespace) {
+			continue
+		}
+
+		for _, service := range namespace.Services {
+			key := namespace.Namespace + "/" + service.ServiceName
+
+			// Only read the instances of the services that changed since they were last read,
+			// services listed without a ModifyIndex are read every time
+			if last, ok := f.services[key]; ok && service.ModifyIndex != 0 && service.ModifyIndex == last.modifyIndex {
+				read[key] = last
+				registrations = append(registrations, last.instances...)
+				continue
+			}
+
+			var instances []*ServiceRegistration
+			_, err := f.nomadClient.Raw().Query("/v1/service/"+url.PathEscape(service.ServiceName), &instances, &nomad.QueryOptions{
+				AllowStale: true,
+				Namespace:  namespace.Namespace,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+
+			read[key] = &serviceInstances{modifyIndex: service.ModifyIndex, instances: instances}
+			registrations = append(registrations, instances...)
+		}
+	}
+
+	// Forget the services that are gone
+	f.services = read
+
+	return registrations, meta, nil
+}
+
+// checkInterval returns how often check statuses are read, from NOMAD_FIREHOSE_SERVICE_CHECK_INTERVAL
+// (default: 30s, 0 disables health change events)
+func checkInterval() (time.Duration, error) {
+	v := os.Getenv("NOMAD_FIREHOSE_SERVICE_CHECK_INTERVAL")
+	if v == "" {
+		return defaultCheckInterval, nil
+	}
+
+	if v == "0" {
+		return 0, nil
+	}
+
+	interval, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid NOMAD_FIREHOSE_SERVICE_CHECK_INTERVAL %q: %s", v, err)
+	}
+
+	return interval, nil
+}
+
+// Periodically read the checks of the allocations with registered services and publish the
+// checks whose status changed. Nomad doesn't emit events for check results, and only keeps
+// them on the clients running the allocations
+func (f *Firehose) watchChecks(interval time.Duration) {
+	// Seeding before the services are listed would record no checks, and report every check
+	// as changed on the next poll
+	select {
+	case <-f.stopCh:
+		return
+	case <-f.synced:
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	seed := true
+
+	for {
+		f.pollChecks(seed)
+		seed = false
+
+		select {
+		case <-f.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollChecks reads the checks of every allocation with registered services once, if seed is
+// set the statuses are only recorded
+func (f *Firehose) pollChecks(seed bool) {
+	// Services of each allocation, by service name
+	f.lock.Lock()
+	allocations := make(map[string]map[string]*ServiceRegistration)
+	for _, registration := range f.registrations {
+		if allocations[registration.AllocID] == nil {
+			allocations[registration.AllocID] = make(map[string]*ServiceRegistration)
+		}
+		allocations[registration.AllocID][registration.ServiceName] = registration
+	}
+	f.lock.Unlock()
+
+	checks := make(map[string]string, len(f.checks))
+	polledAt := time.Now()
+	for allocID, services := range allocations {
+		var namespace string
+		for _, registration := range services {
+			namespace = registration.Namespace
+			break
+		}
+
+		var results map[string]*checkResult
+		_, err := f.nomadClient.Raw().Query("/v1/client/allocation/"+url.PathEscape(allocID)+"/checks", &results, &nomad.QueryOptions{
+			Namespace: namespace,
+		})
+		if err != nil {
+			// Checks are only available on Nomad 1.4+, and the allocation may be gone
+			log.Debugf("Unable to fetch checks of allocation %s: %s", allocID, err)
+
+			// Keep the statuses we know, so they aren't reported as new on the next read
+			for key, status := range f.checks {
+				if strings.HasPrefix(key, allocID+"/") {
+					checks[key] = status
+				}
+			}
+			continue
+		}
+
+		for id, result := range results {
+			key := allocID + "/" + id
+			checks[key] = result.Status
+
+			previous, known := f.checks[key]
+			if seed || (known && previous == result.Status) {
+				continue
+			}
+
+			registration, ok := services[result.Service]
+			if !ok {
+				continue
+			}
+
+			event := f.newEvent(ServiceHealthChanged, registration)
+			event.Check = result.Check
+			event.OldStatus = previous
+			event.NewStatus = result.Status
+			event.Output = result.Output
+
+			// Check statuses are not resumed after a restart, there is no index to checkpoint, nor
+			// to identify the event with, so it is identified by the time it was read at
+			id := helper.EventID(event.Type, event.Region, event.Namespace, event.ServiceID, result.ID, polledAt.UnixNano())
+			f.publish(id, 0, event, nil)
+		}
+	}
+
+	// Forget the checks of allocations that are gone
+	f.checks = checks
+}
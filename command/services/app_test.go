@@ -0,0 +1,182 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/sink"
+)
+
+// testSink records the messages put on it, and acknowledges them unless it is held
+type testSink struct {
+	messages []*sink.Message
+	hold     bool
+}
+
+func (s *testSink) Start() error { return nil }
+func (s *testSink) Stop()        {}
+
+func (s *testSink) Put(message *sink.Message) error {
+	s.messages = append(s.messages, message)
+	if !s.hold {
+		message.Ack(nil)
+	}
+	return nil
+}
+
+func (s *testSink) events(t *testing.T) []*ServiceEvent {
+	events := make([]*ServiceEvent, 0, len(s.messages))
+	for _, message := range s.messages {
+		event := &ServiceEvent{}
+		if err := json.Unmarshal(message.Data, event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func testFirehose(s sink.Sink, restoreIndex uint64) *Firehose {
+	return &Firehose{
+		sink:            s,
+		lastChangeIndex: restoreIndex,
+		checkpoint:      helper.NewCheckpoint(restoreIndex),
+		registrations:   make(map[string]*ServiceRegistration),
+		deregistered:    make(map[string]*ServiceRegistration),
+		services:        make(map[string]*serviceInstances),
+	}
+}
+
+func testRegistration(id string, modifyIndex uint64) *ServiceRegistration {
+	return &ServiceRegistration{ID: id, ServiceName: "redis", Namespace: "default", CreateIndex: modifyIndex, ModifyIndex: modifyIndex}
+}
+
+func TestDeregistrationsDuringDowntimeArePublished(t *testing.T) {
+	s := &testSink{}
+	f := testFirehose(s, 100)
+
+	// redis-1 and redis-2 were registered before the restart at index 100, redis-2 was
+	// deregistered and redis-3 registered while the firehose was down
+	state, err := json.Marshal([]*ServiceRegistration{testRegistration("redis-1", 10), testRegistration("redis-2", 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetRestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := []*ServiceRegistration{testRegistration("redis-1", 10), testRegistration("redis-3", 120)}
+	f.sync(listed, 150, true)
+	f.deregisterRestored(listed, 150)
+
+	events := s.events(t)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %+v", events)
+	}
+	if events[0].Type != ServiceRegistered || events[0].ServiceID != "redis-3" {
+		t.Errorf("expected redis-3 to be registered, got %+v", events[0])
+	}
+	if events[1].Type != ServiceDeregistered || events[1].ServiceID != "redis-2" {
+		t.Errorf("expected redis-2 to be deregistered, got %+v", events[1])
+	}
+
+	// The restored registrations are only deregistered once
+	f.deregisterRestored(listed, 160)
+	if len(s.messages) != 2 {
+		t.Errorf("expected no more events, got %d", len(s.messages))
+	}
+}
+
+func TestSnapshotKeepsUnacknowledgedDeregistrations(t *testing.T) {
+	s := &testSink{hold: true}
+	f := testFirehose(s, 100)
+
+	f.sync([]*ServiceRegistration{testRegistration("redis-1", 110), testRegistration("redis-2", 120)}, 130, true)
+	f.checkpoint.Advance(130)
+	s.messages[0].Ack(nil)
+	s.messages[1].Ack(nil)
+
+	f.sync([]*ServiceRegistration{testRegistration("redis-1", 110)}, 140, true)
+	f.checkpoint.Advance(140)
+
+	snapshot, ok := f.snapshot().(*helper.Snapshot)
+	if !ok {
+		t.Fatal("expected a snapshot")
+	}
+	if snapshot.Value != uint64(139) {
+		t.Errorf("expected the checkpoint to stay before the deregistration, got %v", snapshot.Value)
+	}
+
+	var registrations []*ServiceRegistration
+	if err := json.Unmarshal(snapshot.State, &registrations); err != nil {
+		t.Fatal(err)
+	}
+	if len(registrations) != 2 {
+		t.Errorf("expected the unacknowledged deregistration to be persisted, got %d registrations", len(registrations))
+	}
+
+	// Once acknowledged, the deregistered instance is forgotten
+	s.messages[2].Ack(nil)
+	snapshot = f.snapshot().(*helper.Snapshot)
+	if err := json.Unmarshal(snapshot.State, &registrations); err != nil {
+		t.Fatal(err)
+	}
+	if len(registrations) != 1 || registrations[0].ID != "redis-1" {
+		t.Errorf("expected only redis-1 to be persisted, got %+v", registrations)
+	}
+}
+
+func TestListOnlyReadsChangedServices(t *testing.T) {
+	modifyIndex := map[string]uint64{"redis": 10, "web": 20}
+	reads := make(map[string]int)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Nomad-Index", "100")
+		w.Header().Set("X-Nomad-LastContact", "0")
+
+		if r.URL.Path == "/v1/services" {
+			json.NewEncoder(w).Encode([]map[string]interface{}{{
+				"Namespace": "default",
+				"Services": []map[string]interface{}{
+					{"ServiceName": "redis", "ModifyIndex": modifyIndex["redis"]},
+					{"ServiceName": "web", "ModifyIndex": modifyIndex["web"]},
+				},
+			}})
+			return
+		}
+
+		name := r.URL.Path[len("/v1/service/"):]
+		reads[name]++
+		json.NewEncoder(w).Encode([]*ServiceRegistration{testRegistration(name+"-1", modifyIndex[name])})
+	}))
+	defer srv.Close()
+
+	client, err := nomad.NewClient(&nomad.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := testFirehose(&testSink{}, 0)
+	f.nomadClient = client
+
+	if _, _, err := f.list(&nomad.QueryOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	modifyIndex["web"] = 30
+	registrations, _, err := f.list(&nomad.QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reads["redis"] != 1 || reads["web"] != 2 {
+		t.Errorf("expected only the changed service to be read again, got %v", reads)
+	}
+	if len(registrations) != 2 {
+		t.Errorf("expected the instances of both services, got %d", len(registrations))
+	}
+}
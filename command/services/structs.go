@@ -0,0 +1,74 @@
+package services
+
+// Types of ServiceEvent
+const (
+	ServiceRegistered    = "ServiceRegistered"
+	ServiceDeregistered  = "ServiceDeregistered"
+	ServiceHealthChanged = "ServiceHealthChanged"
+)
+
+// ServiceEvent is emitted when a service instance is registered or deregistered in the Nomad
+// service catalog, or when the status of one of its checks changed
+type ServiceEvent struct {
+	Type        string
+	Region      string
+	Namespace   string
+	ServiceName string
+	ServiceID   string
+	Datacenter  string
+	NodeID      string
+	JobID       string
+	AllocID     string
+	Address     string
+	Port        int
+	Tags        []string
+	ModifyIndex uint64
+
+	// Check is the name of the check whose status changed from OldStatus to NewStatus
+	// ("success", "failure" or "pending"), for health change events
+	Check     string `json:",omitempty"`
+	OldStatus string `json:",omitempty"`
+	NewStatus string `json:",omitempty"`
+	Output    string `json:",omitempty"`
+}
+
+// ServiceRegistration is an instance of a Nomad service (Nomad 1.3+), the Nomad API client we
+// build against predates Nomad service discovery
+type ServiceRegistration struct {
+	ID          string
+	ServiceName string
+	Namespace   string
+	NodeID      string
+	Datacenter  string
+	JobID       string
+	AllocID     string
+	Tags        []string
+	Address     string
+	Port        int
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// serviceListStub is an entry of /v1/services, the services of a namespace
+type serviceListStub struct {
+	Namespace string
+	Services  []struct {
+		ServiceName string
+		ModifyIndex uint64
+	}
+}
+
+// serviceInstances are the instances of a service, read at the ModifyIndex of the service
+type serviceInstances struct {
+	modifyIndex uint64
+	instances   []*ServiceRegistration
+}
+
+// checkResult is the latest result of a check of /v1/client/allocation/:id/checks (Nomad 1.4+)
+type checkResult struct {
+	ID      string
+	Check   string
+	Service string
+	Status  string
+	Output  string
+}
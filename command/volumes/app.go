@@ -0,0 +1,512 @@
+package volumes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+// Firehose ...
+type Firehose struct {
+	checkpoint        *helper.Checkpoint
+	lastChangeIndex   uint64
+	lastChangeIndexCh chan interface{}
+	restoreIndex      uint64 // changes up to it were published before a restart
+	nomadClient       *nomad.Client
+	region            string // region to watch, empty for the region of the Nomad client
+	resolvedRegion    string // region events are annotated with
+	sink              sink.Sink
+	stopCh            chan struct{}
+
+	lock    sync.Mutex
+	scanned map[string]uint64 // index each watched list was published up to, see advance
+
+	// Last known state, each map is only used by the goroutine watching it
+	volumes     map[string]*csiVolume      // keyed by namespace/ID
+	plugins     map[string]*csiPluginStub  // keyed by ID
+	hostVolumes map[string]*hostVolumeStub // keyed by namespace/ID
+}
+
+// pollFunc reads a list from Nomad and publishes what changed since it was last read, if
+// seed is set it is the first read, see seeds
+type pollFunc func(q *nomad.QueryOptions, seed bool) (*nomad.QueryMeta, error)
+
+// NewFirehose ...
+func NewFirehose() (*Firehose, error) {
+	nomadClient, err := nomad.NewClient(nomad.DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFirehoseWithClient(nomadClient, nil)
+}
+
+// NewFirehoseWithClient creates a Firehose using an existing Nomad client and sink,
+// if s is nil the sink configured by SINK_TYPE is created
+func NewFirehoseWithClient(nomadClient *nomad.Client, s sink.Sink) (*Firehose, error) {
+	if s == nil {
+		var err error
+		if s, err = sink.GetSink("volumes"); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := sink.ForFirehose(s, "volumes")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Firehose{
+		nomadClient:       nomadClient,
+		sink:              s,
+		stopCh:            make(chan struct{}, 1),
+		lastChangeIndexCh: make(chan interface{}, 1),
+	}, nil
+}
+
+func (f *Firehose) Name() string {
+	return helper.RegionName("volumes", f.region)
+}
+
+// SetRegion sets the Nomad region the firehose watches, the Nomad client must query the same region
+func (f *Firehose) SetRegion(region string) {
+	f.region = region
+}
+
+func (f *Firehose) UpdateCh() <-chan interface{} {
+	return f.lastChangeIndexCh
+}
+
+func (f *Firehose) SetRestoreValue(restoreValue interface{}) error {
+	switch restoreValue.(type) {
+	case int:
+		f.lastChangeIndex = uint64(restoreValue.(int))
+	case int64:
+		f.lastChangeIndex = uint64(restoreValue.(int64))
+	default:
+		return fmt.Errorf("Unknown restore type '%T' with value '%+v'", restoreValue, restoreValue)
+	}
+	return nil
+}
+
+// Start the firehose
+func (f *Firehose) Start() {
+	go f.sink.Start()
+
+	// Stop chan for all tasks to depend on
+	f.stopCh = make(chan struct{})
+
+	// Only persist indexes the sink has acknowledged
+	f.checkpoint = helper.NewCheckpoint(f.lastChangeIndex)
+
+	f.resolvedRegion = helper.ResolveRegion(f.nomadClient, f.region)
+
+	f.restoreIndex = f.lastChangeIndex
+	f.volumes = make(map[string]*csiVolume)
+	f.plugins = make(map[string]*csiPluginStub)
+	f.hostVolumes = make(map[string]*hostVolumeStub)
+
+	// Events are diffs against the last known state, which is seeded from the first read of
+	// each list, objects that changed since the restored index are published against an empty state
+	lists := map[string]pollFunc{
+		"CSI volumes":  f.pollVolumes,
+		"CSI plugins":  f.pollPlugins,
+		"host volumes": f.pollHostVolumes,
+	}
+
+	f.scanned = make(map[string]uint64, len(lists))
+	for what := range lists {
+		f.scanned[what] = f.restoreIndex
+	}
+
+	for what, poll := range lists {
+		go f.watch(what, poll)
+	}
+
+	// Save the last event time every 5s
+	go f.persistLastChangeTime(5 * time.Second)
+
+	// wait forever for a stop signal to happen
+	select {
+	case <-f.stopCh:
+		return
+	}
+}
+
+// Stop the firehose
+func (f *Firehose) Stop() {
+	close(f.stopCh)
+	f.sink.Stop()
+}
+
+// Write the Last Change Time acknowledged by the sink to Consul so if the process restarts,
+// it will try to resume from where it left off, not emitting tons of double events for
+// old events
+func (f *Firehose) persistLastChangeTime(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		select {
+		case <-f.stopCh:
+			f.lastChangeIndexCh <- f.checkpoint.Value()
+			break
+		case <-ticker.C:
+			f.lastChangeIndexCh <- f.checkpoint.Value()
+		}
+	}
+}
+
+// Publish an event from the firehose, tracked at index
+func (f *Firehose) Publish(event identifiedEvent, index uint64) {
+	ack := f.checkpoint.Track(index)
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Error(err)
+		ack(nil)
+		return
+	}
+
+	f.sink.Put(sink.NewEventMessage(event.metadata(), b, ack))
+	metrics.EventsPublished.Inc(f.Name())
+}
+
+// Continously watch a list with blocking queries, until stopCh is closed or the list is not
+// supported by the Nomad cluster
+func (f *Firehose) watch(what string, poll pollFunc) {
+	q := &nomad.QueryOptions{
+		WaitTime:   5 * time.Minute,
+		AllowStale: true,
+	}
+
+	seed := true
+
+	for {
+		select {
+		case <-f.stopCh:
+			return
+		default:
+		}
+
+		start := time.Now()
+		meta, err := poll(q, seed)
+		helper.ObserveNomadQuery(f.Name(), start, err)
+		if err != nil {
+			if unsupported(err) {
+				log.Warnf("Nomad does not support %s, not watching them: %s", what, err)
+				f.unwatch(what)
+				return
+			}
+
+			log.Errorf("Unable to fetch %s: %s", what, err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		seed = false
+
+		// Only work if the WaitIndex have changed
+		if meta.LastIndex == q.WaitIndex {
+			log.Debugf("%s index is unchanged (%d == %d)", what, meta.LastIndex, q.WaitIndex)
+			continue
+		}
+
+		q.WaitIndex = meta.LastIndex
+		metrics.NomadIndex.Set(float64(q.WaitIndex), f.Name())
+		f.advance(what, meta.LastIndex)
+	}
+}
+
+// advance records that the list was published up to index. The lists are watched separately,
+// so the checkpoint only advances to the lowest index of all lists, and a list that is behind
+// doesn't lose its changes after a restart
+func (f *Firehose) advance(what string, index uint64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.scanned[what] = index
+	f.advanceCheckpoint()
+}
+
+// unwatch stops holding the checkpoint back for a list that is no longer watched
+func (f *Firehose) unwatch(what string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.scanned, what)
+	f.advanceCheckpoint()
+}
+
+// advanceCheckpoint advances the checkpoint to the lowest index of the watched lists, f.lock
+// must be held
+func (f *Firehose) advanceCheckpoint() {
+	if len(f.scanned) == 0 {
+		return
+	}
+
+	var lowest uint64
+	first := true
+	for _, index := range f.scanned {
+		if first || index < lowest {
+			lowest, first = index, false
+		}
+	}
+
+	f.checkpoint.Advance(lowest)
+}
+
+// unsupported returns true if Nomad rejected the query because it doesn't know the endpoint
+// or volume type, e.g. host volumes before Nomad 1.10, other errors may be transient
+func unsupported(err error) bool {
+	if helper.IsNotFound(err) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "response code: 400") && strings.Contains(msg, "volume type")
+}
+
+// seeds returns true if an object read at modifyIndex on the first read of a list only seeds
+// the last known state: it was published before a restart, or the firehose has no restore point
+func (f *Firehose) seeds(seed bool, modifyIndex uint64) bool {
+	return seed && (f.restoreIndex == 0 || modifyIndex <= f.restoreIndex)
+}
+
+// pollVolumes publishes the claims and schedulability changes of CSI volumes
+func (f *Firehose) pollVolumes(q *nomad.QueryOptions, seed bool) (*nomad.QueryMeta, error) {
+	q.Namespace = helper.GetNamespaces().Query()
+
+	var stubs []*csiVolumeStub
+	meta, err := f.nomadClient.Raw().Query("/v1/volumes?type=csi", &stubs, q)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make(map[string]bool, len(stubs))
+	for _, stub := range stubs {
+		key := stub.Namespace + "/" + stub.ID
+		listed[key] = true
+
+		if !helper.GetNamespaces().Allowed(stub.Namespace) {
+			continue
+		}
+
+		previous, known := f.volumes[key]
+		if known && stub.ModifyIndex <= previous.ModifyIndex {
+			continue
+		}
+
+		// The list only has the number of claims, read the volume for the claiming allocations.
+		// If the firehose stops first, the list isn't advanced past the volume
+		volume := &csiVolume{}
+		var readErr error
+		if !helper.ReadObject(f.stopCh, "CSI volume "+stub.ID, func(err error) { readErr = err }, func() error {
+			_, err := f.nomadClient.Raw().Query("/v1/volume/csi/"+url.PathEscape(stub.ID), volume, &nomad.QueryOptions{
+				AllowStale: true,
+				Namespace:  stub.Namespace,
+			})
+			return err
+		}) {
+			if readErr != nil {
+				return nil, readErr
+			}
+
+			// The volume was deregistered since it was listed
+			continue
+		}
+
+		f.volumes[key] = volume
+		if f.seeds(seed, volume.ModifyIndex) {
+			continue
+		}
+
+		// Volumes registered (or changed while the firehose was not running) since the last
+		// read are reported with their claims only
+		if !known {
+			previous = &csiVolume{csiVolumeStub: csiVolumeStub{Schedulable: volume.Schedulable}}
+		}
+
+		f.publishVolumeChanges(previous, volume)
+	}
+
+	for key := range f.volumes {
+		if !listed[key] {
+			delete(f.volumes, key)
+		}
+	}
+
+	return meta, nil
+}
+
+// publishVolumeChanges publishes the claims, releases and schedulability change between the
+// previous and current state of a CSI volume
+func (f *Firehose) publishVolumeChanges(previous, current *csiVolume) {
+	event := func(eventType string) *VolumeEvent {
+		return &VolumeEvent{
+			Type:        eventType,
+			Region:      f.resolvedRegion,
+			Namespace:   current.Namespace,
+			VolumeID:    current.ID,
+			Name:        current.Name,
+			PluginID:    current.PluginID,
+			ModifyIndex: current.ModifyIndex,
+		}
+	}
+
+	claims := func(mode string, before, after map[string]json.RawMessage) {
+		for _, id := range keys(after) {
+			if _, ok := before[id]; !ok {
+				e := event(VolumeClaimed)
+				e.AllocationID, e.AccessMode = id, mode
+				f.Publish(e, current.ModifyIndex)
+			}
+		}
+
+		for _, id := range keys(before) {
+			if _, ok := after[id]; !ok {
+				e := event(VolumeUnclaimed)
+				e.AllocationID, e.AccessMode = id, mode
+				f.Publish(e, current.ModifyIndex)
+			}
+		}
+	}
+
+	claims("read", previous.ReadAllocs, current.ReadAllocs)
+	claims("write", previous.WriteAllocs, current.WriteAllocs)
+
+	if previous.Schedulable != current.Schedulable {
+		e := event(VolumeSchedulabilityChanged)
+		e.Old, e.New = previous.Schedulable, current.Schedulable
+		f.Publish(e, current.ModifyIndex)
+	}
+}
+
+// pollPlugins publishes the health changes of CSI plugins
+func (f *Firehose) pollPlugins(q *nomad.QueryOptions, seed bool) (*nomad.QueryMeta, error) {
+	var plugins []*csiPluginStub
+	meta, err := f.nomadClient.Raw().Query("/v1/plugins?type=csi", &plugins, q)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make(map[string]bool, len(plugins))
+	for _, plugin := range plugins {
+		listed[plugin.ID] = true
+
+		previous, known := f.plugins[plugin.ID]
+		if known && plugin.ModifyIndex <= previous.ModifyIndex {
+			continue
+		}
+
+		f.plugins[plugin.ID] = plugin
+		if f.seeds(seed, plugin.ModifyIndex) {
+			continue
+		}
+
+		current := plugin.health()
+
+		var previousHealth *PluginHealth
+		if known {
+			previousHealth = previous.health()
+			if *previousHealth == *current {
+				continue
+			}
+		}
+
+		f.Publish(&PluginEvent{
+			Type:        PluginHealthChanged,
+			Region:      f.resolvedRegion,
+			PluginID:    plugin.ID,
+			Provider:    plugin.Provider,
+			ModifyIndex: plugin.ModifyIndex,
+			Healthy:     current.healthy(),
+			Previous:    previousHealth,
+			Current:     current,
+		}, plugin.ModifyIndex)
+	}
+
+	for id := range f.plugins {
+		if !listed[id] {
+			delete(f.plugins, id)
+		}
+	}
+
+	return meta, nil
+}
+
+// pollHostVolumes publishes the state changes of dynamic host volumes
+func (f *Firehose) pollHostVolumes(q *nomad.QueryOptions, seed bool) (*nomad.QueryMeta, error) {
+	q.Namespace = helper.GetNamespaces().Query()
+
+	var volumes []*hostVolumeStub
+	meta, err := f.nomadClient.Raw().Query("/v1/volumes?type=host", &volumes, q)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make(map[string]bool, len(volumes))
+	for _, volume := range volumes {
+		key := volume.Namespace + "/" + volume.ID
+		listed[key] = true
+
+		if !helper.GetNamespaces().Allowed(volume.Namespace) {
+			continue
+		}
+
+		previous, known := f.hostVolumes[key]
+		if known && volume.ModifyIndex <= previous.ModifyIndex {
+			continue
+		}
+
+		f.hostVolumes[key] = volume
+		if f.seeds(seed, volume.ModifyIndex) || (known && previous.State == volume.State) {
+			continue
+		}
+
+		event := &VolumeEvent{
+			Type:        HostVolumeStateChanged,
+			Region:      f.resolvedRegion,
+			Namespace:   volume.Namespace,
+			VolumeID:    volume.ID,
+			Name:        volume.Name,
+			PluginID:    volume.PluginID,
+			NodeID:      volume.NodeID,
+			ModifyIndex: volume.ModifyIndex,
+			New:         volume.State,
+		}
+		if known {
+			event.Old = previous.State
+		}
+
+		f.Publish(event, volume.ModifyIndex)
+	}
+
+	for key := range f.hostVolumes {
+		if !listed[key] {
+			delete(f.hostVolumes, key)
+		}
+	}
+
+	return meta, nil
+}
+
+// keys returns the sorted keys of m
+func keys(m map[string]json.RawMessage) []string {
+	k := make([]string, 0, len(m))
+	for key := range m {
+		k = append(k, key)
+	}
+	sort.Strings(k)
+
+	return k
+}
@@ -0,0 +1,72 @@
+package volumes
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/seatgeek/nomad-firehose/helper"
+)
+
+func TestUnsupported(t *testing.T) {
+	tests := []struct {
+		err      string
+		expected bool
+	}{
+		{"Unexpected response code: 404 (Resource not found)", true},
+		{"Unexpected response code: 400 (unsupported volume type: host)", true},
+		{"Unexpected response code: 400 (Invalid namespace)", false},
+		{"Unexpected response code: 500 (rpc error: No cluster leader)", false},
+		{"dial tcp 127.0.0.1:4646: connect: connection refused", false},
+	}
+
+	for _, test := range tests {
+		if result := unsupported(errors.New(test.err)); result != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.err, test.expected, result)
+		}
+	}
+}
+
+func TestSeeds(t *testing.T) {
+	f := &Firehose{}
+
+	// Without a restore point the first read only seeds the state
+	if !f.seeds(true, 100) {
+		t.Error("expected the first read to seed the state without a restore point")
+	}
+
+	f.restoreIndex = 50
+	if !f.seeds(true, 50) {
+		t.Error("expected objects published before the restart to seed the state")
+	}
+	if f.seeds(true, 51) {
+		t.Error("expected objects changed since the restore point to be published")
+	}
+	if f.seeds(false, 10) {
+		t.Error("expected later reads to publish changes")
+	}
+}
+
+func TestAdvanceToTheLowestListIndex(t *testing.T) {
+	f := &Firehose{
+		checkpoint: helper.NewCheckpoint(10),
+		scanned:    map[string]uint64{"CSI volumes": 10, "CSI plugins": 10, "host volumes": 10},
+	}
+
+	// The host volumes list is behind, the checkpoint doesn't move past it
+	f.advance("CSI volumes", 50)
+	f.advance("CSI plugins", 40)
+	if value := f.checkpoint.Value(); value != 10 {
+		t.Errorf("expected the checkpoint to stay at 10, got %d", value)
+	}
+
+	f.advance("host volumes", 30)
+	if value := f.checkpoint.Value(); value != 30 {
+		t.Errorf("expected the checkpoint to advance to 30, got %d", value)
+	}
+
+	// A list that isn't supported doesn't hold the checkpoint back
+	f.unwatch("host volumes")
+	if value := f.checkpoint.Value(); value != 40 {
+		t.Errorf("expected the checkpoint to advance to 40, got %d", value)
+	}
+}
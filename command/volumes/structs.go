@@ -0,0 +1,143 @@
+package volumes
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/sink"
+)
+
+// Types of VolumeEvent and PluginEvent
+const (
+	VolumeClaimed               = "VolumeClaimed"
+	VolumeUnclaimed             = "VolumeUnclaimed"
+	VolumeSchedulabilityChanged = "VolumeSchedulabilityChanged"
+	HostVolumeStateChanged      = "HostVolumeStateChanged"
+	PluginHealthChanged         = "PluginHealthChanged"
+)
+
+// VolumeEvent is emitted when a CSI volume is claimed or unclaimed by an allocation or its
+// schedulability changed, or when the state of a dynamic host volume changed
+type VolumeEvent struct {
+	Type        string
+	Region      string
+	Namespace   string
+	VolumeID    string
+	Name        string
+	PluginID    string
+	NodeID      string `json:",omitempty"` // host volumes only
+	ModifyIndex uint64
+
+	// AllocationID and AccessMode ("read" or "write") of the claim, for claim events
+	AllocationID string `json:",omitempty"`
+	AccessMode   string `json:",omitempty"`
+
+	// Old and New value, for schedulability and state changes
+	Old interface{} `json:",omitempty"`
+	New interface{} `json:",omitempty"`
+}
+
+// PluginEvent is emitted when the number of healthy controllers or nodes of a CSI plugin changed
+type PluginEvent struct {
+	Type        string
+	Region      string
+	PluginID    string
+	Provider    string
+	ModifyIndex uint64
+	Healthy     bool // true if all expected controllers and nodes are healthy
+	Previous    *PluginHealth
+	Current     *PluginHealth
+}
+
+// PluginHealth is the number of healthy and expected controllers and nodes of a CSI plugin
+type PluginHealth struct {
+	ControllerRequired  bool
+	ControllersHealthy  int
+	ControllersExpected int
+	NodesHealthy        int
+	NodesExpected       int
+}
+
+// identifiedEvent is an event with a deterministic event ID
+type identifiedEvent interface {
+	metadata() sink.Metadata
+}
+
+func (e *VolumeEvent) metadata() sink.Metadata {
+	return sink.Metadata{
+		ID:     helper.EventID(e.Type, e.Region, e.Namespace, e.VolumeID, e.ModifyIndex, e.AllocationID, e.AccessMode),
+		Type:   helper.SnakeCase(strings.TrimPrefix(e.Type, "Volume")),
+		Region: e.Region,
+		Index:  e.ModifyIndex,
+	}
+}
+
+func (e *PluginEvent) metadata() sink.Metadata {
+	return sink.Metadata{
+		ID:     helper.EventID(e.Type, e.Region, e.PluginID, e.ModifyIndex),
+		Type:   helper.SnakeCase(e.Type),
+		Region: e.Region,
+		Index:  e.ModifyIndex,
+	}
+}
+
+// csiVolumeStub is an entry of /v1/volumes?type=csi, the Nomad API client we build against
+// predates CSI
+type csiVolumeStub struct {
+	ID          string
+	Namespace   string
+	Name        string
+	PluginID    string
+	Schedulable bool
+	ModifyIndex uint64
+}
+
+// csiVolume is the part of /v1/volume/csi/:id holding the claims, allocations are keyed by ID
+type csiVolume struct {
+	csiVolumeStub
+	ReadAllocs  map[string]json.RawMessage
+	WriteAllocs map[string]json.RawMessage
+}
+
+// csiPluginStub is an entry of /v1/plugins?type=csi
+type csiPluginStub struct {
+	ID                  string
+	Provider            string
+	ControllerRequired  bool
+	ControllersHealthy  int
+	ControllersExpected int
+	NodesHealthy        int
+	NodesExpected       int
+	ModifyIndex         uint64
+}
+
+// hostVolumeStub is an entry of /v1/volumes?type=host (Nomad 1.10+ dynamic host volumes)
+type hostVolumeStub struct {
+	ID          string
+	Namespace   string
+	Name        string
+	NodeID      string
+	PluginID    string
+	State       string
+	ModifyIndex uint64
+}
+
+func (p *csiPluginStub) health() *PluginHealth {
+	return &PluginHealth{
+		ControllerRequired:  p.ControllerRequired,
+		ControllersHealthy:  p.ControllersHealthy,
+		ControllersExpected: p.ControllersExpected,
+		NodesHealthy:        p.NodesHealthy,
+		NodesExpected:       p.NodesExpected,
+	}
+}
+
+// healthy returns true if all expected controllers and nodes are healthy
+func (h *PluginHealth) healthy() bool {
+	if h.ControllerRequired && h.ControllersHealthy < h.ControllersExpected {
+		return false
+	}
+
+	return h.NodesHealthy >= h.NodesExpected
+}
@@ -0,0 +1,90 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/hashicorp/go-bexpr"
+	"github.com/hashicorp/go-bexpr/grammar"
+)
+
+// Expression is a parsed filter expression, evaluated against the JSON representation of an event
+//
+// The syntax is the Nomad / Consul API filtering language (go-bexpr):
+//
+//	TaskEvent.Type == "Terminated" and TaskFailed == true
+//	Namespace != "default" or not (Name matches "^web-")
+//	"gpu" in Meta or Drivers.docker is not empty
+//
+// Selectors are dot separated field names of the emitted JSON
+type Expression struct {
+	source string
+
+	// bexpr caches compiled regular expressions in the evaluator as it evaluates them
+	lock      sync.Mutex
+	evaluator *bexpr.Evaluator
+}
+
+// Parse an expression
+func Parse(source string) (*Expression, error) {
+	evaluator, err := bexpr.CreateEvaluator(source)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter %q: %s", source, err)
+	}
+
+	// bexpr only compiles regular expressions once it evaluates them, check them up front
+	ast, err := grammar.Parse("", []byte(source))
+	if err == nil {
+		err = checkRegexps(ast.(grammar.Expression))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter %q: %s", source, err)
+	}
+
+	return &Expression{source: source, evaluator: evaluator}, nil
+}
+
+// checkRegexps returns an error if a regular expression of a matches operator is invalid
+func checkRegexps(e grammar.Expression) error {
+	switch e := e.(type) {
+	case *grammar.UnaryExpression:
+		return checkRegexps(e.Operand)
+
+	case *grammar.BinaryExpression:
+		if err := checkRegexps(e.Left); err != nil {
+			return err
+		}
+		return checkRegexps(e.Right)
+
+	case *grammar.MatchExpression:
+		if e.Operator == grammar.MatchMatches || e.Operator == grammar.MatchNotMatches {
+			_, err := regexp.Compile(e.Value.Raw)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Evaluate the expression against a JSON decoded value. It returns an error if the expression
+// can't be evaluated against it, e.g. when a selector is missing from the event or the value
+// doesn't have the type of the field
+func (e *Expression) Evaluate(v interface{}) (result bool, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	// bexpr panics on operators that don't apply to a value, e.g. "is empty" on null or a number
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = false, fmt.Errorf("%v", r)
+		}
+	}()
+
+	return e.evaluator.Evaluate(v)
+}
+
+// String returns the expression source
+func (e *Expression) String() string {
+	return e.source
+}
@@ -0,0 +1,183 @@
+package filter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testEvent = `{
+	"Name": "web-1",
+	"Count": 3,
+	"Failed": true,
+	"Tags": ["a", "b"],
+	"Meta": {"team": "core"},
+	"Empty": "",
+	"Null": null,
+	"TaskEvent": {"Type": "Terminated", "ExitCode": 1}
+}`
+
+func TestExpressionEvaluate(t *testing.T) {
+	var event interface{}
+	if err := json.Unmarshal([]byte(testEvent), &event); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expression string
+		expected   bool
+	}{
+		// Comparisons
+		{`Name == "web-1"`, true},
+		{`Name != "web-1"`, false},
+		{`Count == 3`, true},
+		{`Count != 3`, false},
+		{`Failed == true`, true},
+		{`Failed != false`, true},
+		{`TaskEvent.Type == Terminated`, true},
+		{`TaskEvent.ExitCode != 0`, true},
+
+		// in, contains and matches
+		{`"a" in Tags`, true},
+		{`"c" in Tags`, false},
+		{`"c" not in Tags`, true},
+		{`"team" in Meta`, true},
+		{`Tags contains "b"`, true},
+		{`Tags not contains "b"`, false},
+		{`Name contains "eb"`, true},
+		{`Meta contains "owner"`, false},
+		{`Name matches "^web-[0-9]+$"`, true},
+		{`Name not matches "^web-"`, false},
+
+		// is empty
+		{`Empty is empty`, true},
+		{`Name is empty`, false},
+		{`Tags is not empty`, true},
+		{`Meta is empty`, false},
+
+		// Logical operators and precedence: not binds tighter than and, and tighter than or
+		{`Failed == true and Count == 3`, true},
+		{`Failed == true and Count == 4`, false},
+		{`Failed == false or Count == 3`, true},
+		{`not Failed == true`, false},
+		{`not Failed == false and Count == 3`, true},
+		{`Count == 4 and Count == 3 or Name == "web-1"`, true},
+		{`Name == "web-1" or Count == 4 and Count == 3`, true},
+		{`(Name == "web-1" or Count == 4) and Count == 3`, true},
+		{`Count == 4 and (Count == 3 or Name == "web-1")`, false},
+		{`not (Count == 4 or Failed == false)`, true},
+	}
+
+	for _, test := range tests {
+		e, err := Parse(test.expression)
+		if err != nil {
+			t.Errorf("%s: %s", test.expression, err)
+			continue
+		}
+
+		result, err := e.Evaluate(event)
+		if err != nil {
+			t.Errorf("%s: %s", test.expression, err)
+			continue
+		}
+
+		if result != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.expression, test.expected, result)
+		}
+	}
+}
+
+func TestExpressionEvaluateErrors(t *testing.T) {
+	var event interface{}
+	if err := json.Unmarshal([]byte(testEvent), &event); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []string{
+		`Missing == "x"`,
+		`Missing != "x"`,
+		`TaskEvent.Missing.Deeper == "x"`,
+		`"x" in Missing`,
+		`Missing is empty`,
+		`Count == "three"`,
+		`Null is empty`,
+		`Count is empty`,
+	}
+
+	for _, source := range tests {
+		e, err := Parse(source)
+		if err != nil {
+			t.Errorf("%s: %s", source, err)
+			continue
+		}
+
+		if _, err := e.Evaluate(event); err == nil {
+			t.Errorf("%s: expected an evaluation error", source)
+		}
+	}
+}
+
+func TestFilterSkipsExpressionsThatDontApply(t *testing.T) {
+	f, err := New(Rules{Include: []string{`Missing == "x"`, `Name == "web-1"`}, Exclude: []string{`Other != "y"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.Match([]byte(testEvent)) {
+		t.Error("expected expressions on missing fields not to match, and the event to be included")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`Name`,
+		`Name ==`,
+		`Name = "x"`,
+		`Name == "x`,
+		`(Name == "x"`,
+		`Name == "x")`,
+		`Name == "x" and`,
+		`Name is full`,
+		`Name not equals "x"`,
+		`"x" in`,
+		`Name matches "("`,
+		`not Name not matches "("`,
+		`Name == "x" Name == "y"`,
+	}
+
+	for _, source := range tests {
+		if _, err := Parse(source); err == nil {
+			t.Errorf("%q: expected a parse error", source)
+		}
+	}
+}
+
+func TestForFirehoseCommandName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "filter.json")
+	if err := ioutil.WriteFile(path, []byte(`{"jobliststubs": {"include": ["Status == \"running\""]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Configure("", "", path); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure("", "", "")
+
+	f, err := ForFirehose("jobliststub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f == nil || f.MatchValue(map[string]interface{}{"Status": "dead"}) {
+		t.Error("expected the jobliststubs rules to apply to the jobliststub firehose")
+	}
+}
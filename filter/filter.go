@@ -0,0 +1,169 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// allFirehoses is the key of the filter file rules applying to every firehose type
+const allFirehoses = "*"
+
+// firehoseNames maps the subcommands of the firehose types whose internal name differs to it,
+// so the filter file can be keyed by either
+var firehoseNames = map[string]string{"jobliststubs": "jobliststub"}
+
+// Rules is the include / exclude expressions of a firehose type
+type Rules struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// Filter decides which events of a firehose type reach the sink
+//
+// An event is kept if it matches any include expression (or there is none), and does not
+// match any exclude expression
+type Filter struct {
+	include []*Expression
+	exclude []*Expression
+}
+
+var (
+	defaultRules  Rules
+	firehoseRules map[string]Rules
+)
+
+// Configure the filters from the --filter-include / --filter-exclude expressions, applied to all
+// firehose types, and the --filter-file holding rules per firehose type. All expressions are
+// parsed up front so invalid filters are reported at startup
+func Configure(include, exclude, path string) error {
+	defaultRules = Rules{}
+	firehoseRules = make(map[string]Rules)
+
+	if include != "" {
+		defaultRules.Include = append(defaultRules.Include, include)
+	}
+
+	if exclude != "" {
+		defaultRules.Exclude = append(defaultRules.Exclude, exclude)
+	}
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Could not read filter file: %s", err)
+		}
+
+		if err := json.Unmarshal(data, &firehoseRules); err != nil {
+			return fmt.Errorf("Could not parse filter file %s: %s", path, err)
+		}
+	}
+
+	if _, err := New(defaultRules); err != nil {
+		return err
+	}
+
+	for name, rules := range firehoseRules {
+		if _, err := New(rules); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// ForFirehose returns the filter configured for a firehose type, nil if it has no rules
+func ForFirehose(name string) (*Filter, error) {
+	rules := Rules{
+		Include: append([]string{}, defaultRules.Include...),
+		Exclude: append([]string{}, defaultRules.Exclude...),
+	}
+
+	keys := []string{allFirehoses, name}
+	for command, n := range firehoseNames {
+		if n == name {
+			keys = append(keys, command)
+		}
+	}
+
+	for _, key := range keys {
+		rules.Include = append(rules.Include, firehoseRules[key].Include...)
+		rules.Exclude = append(rules.Exclude, firehoseRules[key].Exclude...)
+	}
+
+	if len(rules.Include) == 0 && len(rules.Exclude) == 0 {
+		return nil, nil
+	}
+
+	log.WithField("type", name).Infof("Filtering events, include: %q exclude: %q", rules.Include, rules.Exclude)
+	return New(rules)
+}
+
+// New creates a Filter from rules
+func New(rules Rules) (*Filter, error) {
+	f := &Filter{}
+
+	for _, source := range rules.Include {
+		e, err := Parse(source)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, e)
+	}
+
+	for _, source := range rules.Exclude {
+		e, err := Parse(source)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, e)
+	}
+
+	return f, nil
+}
+
+// Match returns true if the JSON encoded event should be sent to the sink
+func (f *Filter) Match(data []byte) bool {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		log.Warnf("[filter] Could not decode event, not filtering it: %s", err)
+		return true
+	}
+
+	return f.MatchValue(v)
+}
+
+// MatchValue returns true if the JSON decoded event should be sent to the sink
+func (f *Filter) MatchValue(v interface{}) bool {
+	for _, e := range f.exclude {
+		if matches(e, v) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+
+	for _, e := range f.include {
+		if matches(e, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches returns true if the expression matches the JSON decoded event, an expression that can't
+// be evaluated against the event (e.g. a selector missing from it) doesn't match it
+func matches(e *Expression, v interface{}) bool {
+	result, err := e.Evaluate(v)
+	if err != nil {
+		log.Debugf("[filter] %q doesn't apply to the event: %s", e, err)
+		return false
+	}
+
+	return result
+}
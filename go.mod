@@ -12,29 +12,35 @@ require (
 	github.com/eapache/queue v1.1.0 // indirect
 	github.com/frankban/quicktest v1.8.1 // indirect
 	github.com/garyburd/redigo v1.6.0
-	github.com/go-stack/stack v1.7.0 // indirect
+	github.com/go-stack/stack v1.8.1 // indirect
 	github.com/gorhill/cronexpr v0.0.0-20140423231348-a557574d6c02 // indirect
 	github.com/hashicorp/consul v1.3.0
+	github.com/hashicorp/go-bexpr v0.1.10
 	github.com/hashicorp/go-uuid v1.0.2 // indirect
 	github.com/hashicorp/memberlist v0.2.0 // indirect
 	github.com/hashicorp/nomad v0.8.6
 	github.com/hashicorp/raft v1.0.1-0.20180117202925-077966dbc90f // indirect
 	github.com/hashicorp/serf v0.8.2-0.20180809141758-19bbd39e421b // indirect
 	github.com/hashicorp/vault/api v1.0.4 // indirect
+	github.com/linkedin/goavro/v2 v2.9.8
 	github.com/mitchellh/hashstructure v0.0.0-20160118175604-1ef5c71b025a // indirect
 	github.com/mongodb/mongo-go-driver v0.0.17
 	github.com/nsqio/go-nsq v1.0.7
 	github.com/pierrec/lz4 v2.4.1+incompatible // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/client_golang v1.12.2
 	github.com/rcrowley/go-metrics v0.0.0-20181016184325-3113b8401b8a // indirect
 	github.com/seatgeek/logrus-gelf-formatter v0.0.0-20180829220724-ce23ecb3f367
-	github.com/sirupsen/logrus v1.0.2-0.20170719154753-00386b3fbd63
+	github.com/sirupsen/logrus v1.8.1
 	github.com/streadway/amqp v0.0.0-20181107104731-27835f1a64e9
-	github.com/stretchr/testify v1.5.1 // indirect
 	github.com/tidwall/pretty v1.0.1 // indirect
 	github.com/ugorji/go v0.0.0-20170620060102-0053ebfd9d0e // indirect
 	github.com/xdg/scram v0.0.0-20180714160537-b32d4bd2c91c // indirect
 	github.com/xdg/stringprep v1.0.1-0.20180714160509-73f8eece6fdc // indirect
-	golang.org/x/net v0.0.0-20200202094626-16171245cfb2 // indirect
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/protobuf v1.27.1 // indirect
 	gopkg.in/urfave/cli.v1 v1.20.0
 )
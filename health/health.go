@@ -0,0 +1,396 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Blocking queries wait up to 5 minutes (plus jitter) for a change, so a successful
+	// query may legitimately be this old
+	nomadMaxAge = 6 * time.Minute
+
+	// A message a sink hasn't acknowledged nor failed for this long means the sink hangs
+	sinkMaxAge = 5 * time.Minute
+
+	defaultGracePeriod = 1 * time.Minute
+)
+
+// component tracks the outcome of calls to a dependency (Nomad or a sink)
+type component struct {
+	lastSuccess  time.Time
+	failingSince time.Time
+	lastError    string
+
+	// Messages put on a sink and not acknowledged nor failed yet, by put time
+	inFlight map[uint64]time.Time
+	nextID   uint64
+
+	// Messages that could not be handed to the sink at all
+	dropped uint64
+}
+
+// put records a message put on the component, returning its ID for done
+func (c *component) put(now time.Time) uint64 {
+	if c.inFlight == nil {
+		c.inFlight = make(map[uint64]time.Time)
+	}
+
+	c.nextID++
+	c.inFlight[c.nextID] = now
+	return c.nextID
+}
+
+// done records the outcome of a message put on the component
+func (c *component) done(id uint64, err error) {
+	delete(c.inFlight, id)
+
+	if err != nil {
+		c.failed(err)
+	} else {
+		c.succeeded()
+	}
+}
+
+// oldestInFlight returns when the oldest message in flight was put, zero if there is none
+func (c *component) oldestInFlight() time.Time {
+	var oldest time.Time
+	for _, t := range c.inFlight {
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+
+	return oldest
+}
+
+func (c *component) succeeded() {
+	c.lastSuccess = time.Now()
+	c.failingSince = time.Time{}
+	c.lastError = ""
+}
+
+func (c *component) failed(err error) {
+	if c.failingSince.IsZero() {
+		c.failingSince = time.Now()
+	}
+	c.lastError = err.Error()
+}
+
+// healthy returns false if the component has been failing for longer than the grace period,
+// or if maxAge is set and the last success is older than it
+func (c *component) healthy(now time.Time, maxAge time.Duration) bool {
+	if !c.failingSince.IsZero() && now.Sub(c.failingSince) > gracePeriod {
+		return false
+	}
+
+	if maxAge > 0 && !c.lastSuccess.IsZero() && now.Sub(c.lastSuccess) > maxAge {
+		return false
+	}
+
+	return true
+}
+
+// responsive returns false if a message in flight is older than maxAge, as a sink that hangs
+// neither succeeds nor fails
+func (c *component) responsive(now time.Time, maxAge time.Duration) bool {
+	oldest := c.oldestInFlight()
+	return oldest.IsZero() || now.Sub(oldest) <= maxAge
+}
+
+func (c *component) report(now time.Time, maxAge time.Duration) *ComponentReport {
+	r := &ComponentReport{
+		Healthy:   c.healthy(now, maxAge),
+		LastError: c.lastError,
+	}
+
+	if !c.lastSuccess.IsZero() {
+		t := c.lastSuccess
+		r.LastSuccess = &t
+	}
+
+	if !c.failingSince.IsZero() {
+		t := c.failingSince
+		r.FailingSince = &t
+	}
+
+	return r
+}
+
+// firehose is the state of a single firehose type run by this process
+type firehose struct {
+	leader      bool
+	leaderSince time.Time
+	nomad       component
+}
+
+var (
+	lock        sync.Mutex
+	firehoses   = make(map[string]*firehose)
+	sinks       = make(map[string]*component)
+	gracePeriod = defaultGracePeriod
+)
+
+func init() {
+	if v := os.Getenv("NOMAD_FIREHOSE_HEALTH_GRACE_PERIOD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid NOMAD_FIREHOSE_HEALTH_GRACE_PERIOD, must be a duration: %s", err)
+		}
+		gracePeriod = d
+	}
+}
+
+// getFirehose returns the state of a firehose, lock must be held
+func getFirehose(name string) *firehose {
+	f, ok := firehoses[name]
+	if !ok {
+		f = &firehose{}
+		firehoses[name] = f
+	}
+
+	return f
+}
+
+// getSink returns the state of a sink, lock must be held
+func getSink(name string) *component {
+	s, ok := sinks[name]
+	if !ok {
+		s = &component{}
+		sinks[name] = s
+	}
+
+	return s
+}
+
+// SetLeader records if the process holds the lock of a firehose type
+func SetLeader(name string, leader bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	f := getFirehose(name)
+	if leader && !f.leader {
+		f.leaderSince = time.Now()
+		f.nomad = component{}
+	}
+	f.leader = leader
+}
+
+// NomadQuery records the outcome of a query the firehose made to Nomad
+func NomadQuery(name string, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err != nil {
+		getFirehose(name).nomad.failed(err)
+	} else {
+		getFirehose(name).nomad.succeeded()
+	}
+}
+
+// SinkWrite records the outcome of writing a message (or a probe) to a sink
+func SinkWrite(name string, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err != nil {
+		getSink(name).failed(err)
+	} else {
+		getSink(name).succeeded()
+	}
+}
+
+// SinkPut records a message put on a sink, the returned func must be called with the outcome
+// of writing it
+func SinkPut(name string) func(err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	id := getSink(name).put(time.Now())
+
+	return func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		getSink(name).done(id, err)
+	}
+}
+
+// SinkDropped records a message that could not be handed to a sink, e.g. because its queue stayed
+// full. The sink fails until it writes a message again
+func SinkDropped(name string, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	s := getSink(name)
+	s.dropped++
+	s.failed(err)
+}
+
+// SinkLastSuccess returns when a sink last accepted a message or probe
+func SinkLastSuccess(name string) time.Time {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return getSink(name).lastSuccess
+}
+
+// ComponentReport is the health of Nomad or a sink, as seen by the firehose
+type ComponentReport struct {
+	Healthy        bool
+	LastSuccess    *time.Time `json:",omitempty"`
+	FailingSince   *time.Time `json:",omitempty"`
+	LastError      string     `json:",omitempty"`
+	InFlight       int        `json:",omitempty"` // messages put on a sink and not written yet
+	OldestInFlight *time.Time `json:",omitempty"` // when the oldest of them was put
+	Dropped        uint64     `json:",omitempty"` // messages that could not be handed to a sink
+}
+
+// FirehoseReport is the health of a firehose type
+type FirehoseReport struct {
+	Status string
+	Leader bool
+	Nomad  *ComponentReport `json:",omitempty"`
+}
+
+// Report is the health of the process
+type Report struct {
+	Status    string
+	Healthy   bool
+	Ready     bool
+	Firehoses map[string]*FirehoseReport
+	Sinks     map[string]*ComponentReport
+}
+
+// GetReport computes the health of the process
+//
+// The process is healthy unless a firehose it is leader for, or a sink, has been failing for
+// longer than the grace period, or a sink hasn't written a message put on it for sinkMaxAge. Standby processes are healthy but passive. It is ready when
+// it holds the lock of at least one firehose type and is healthy
+func GetReport() *Report {
+	lock.Lock()
+	defer lock.Unlock()
+
+	now := time.Now()
+	report := &Report{
+		Healthy:   true,
+		Firehoses: make(map[string]*FirehoseReport),
+		Sinks:     make(map[string]*ComponentReport),
+	}
+
+	leaders := 0
+
+	names := make([]string, 0, len(firehoses))
+	for name := range firehoses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := firehoses[name]
+
+		if !f.leader {
+			report.Firehoses[name] = &FirehoseReport{Status: "standby"}
+			continue
+		}
+
+		leaders++
+
+		// Give the firehose the grace period to make its first query after acquiring the lock
+		nomad := f.nomad
+		if nomad.lastSuccess.IsZero() && nomad.failingSince.IsZero() && now.Sub(f.leaderSince) > gracePeriod {
+			nomad.failingSince = f.leaderSince
+			nomad.lastError = "no query to Nomad has completed since acquiring the lock"
+		}
+
+		r := &FirehoseReport{
+			Status: "active",
+			Leader: true,
+			Nomad:  nomad.report(now, nomadMaxAge),
+		}
+
+		if !r.Nomad.Healthy {
+			r.Status = "failing"
+			report.Healthy = false
+		}
+
+		report.Firehoses[name] = r
+	}
+
+	for name, s := range sinks {
+		r := sinkReport(s, now)
+		if !r.Healthy {
+			report.Healthy = false
+		}
+
+		report.Sinks[name] = r
+	}
+
+	report.Ready = report.Healthy && leaders > 0
+
+	switch {
+	case !report.Healthy:
+		report.Status = "failing"
+	case leaders == 0:
+		report.Status = "standby"
+	default:
+		report.Status = "active"
+	}
+
+	return report
+}
+
+// sinkReport returns the health of a sink. Idle sinks may not have written anything for long,
+// so their recency is the age of the oldest message they were handed but didn't write yet
+func sinkReport(s *component, now time.Time) *ComponentReport {
+	r := s.report(now, 0)
+	r.Dropped = s.dropped
+
+	if oldest := s.oldestInFlight(); !oldest.IsZero() {
+		r.InFlight = len(s.inFlight)
+		r.OldestInFlight = &oldest
+
+		if !s.responsive(now, sinkMaxAge) {
+			r.Healthy = false
+			if r.LastError == "" {
+				r.LastError = "a message put on the sink " + now.Sub(oldest).Round(time.Second).String() + " ago was not written yet"
+			}
+		}
+	}
+
+	return r
+}
+
+// HealthzHandler returns 200 if the process is healthy (active or standby), 503 otherwise
+func HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := GetReport()
+		writeReport(w, report, report.Healthy)
+	})
+}
+
+// ReadyHandler returns 200 if the process holds a lock and is healthy, 503 otherwise
+func ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := GetReport()
+		writeReport(w, report, report.Ready)
+	})
+}
+
+func writeReport(w http.ResponseWriter, report *Report, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,46 @@
+package health
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSinkInFlightMaxAge(t *testing.T) {
+	now := time.Now()
+	s := &component{}
+	s.succeeded()
+
+	id := s.put(now)
+
+	if r := sinkReport(s, now.Add(sinkMaxAge-time.Second)); !r.Healthy || r.InFlight != 1 {
+		t.Errorf("expected a sink with a recent message in flight to be healthy, got %+v", r)
+	}
+
+	if r := sinkReport(s, now.Add(sinkMaxAge+time.Second)); r.Healthy || r.LastError == "" {
+		t.Errorf("expected a sink that hangs to be failing, got %+v", r)
+	}
+
+	s.done(id, nil)
+
+	if r := sinkReport(s, now.Add(sinkMaxAge+time.Second)); !r.Healthy || r.InFlight != 0 {
+		t.Errorf("expected an idle sink to be healthy, got %+v", r)
+	}
+}
+
+func TestSinkFailingForGracePeriod(t *testing.T) {
+	now := time.Now()
+	s := &component{}
+
+	s.done(s.put(now), errors.New("connection refused"))
+
+	if r := sinkReport(s, now.Add(gracePeriod+time.Second)); r.Healthy || r.LastError != "connection refused" {
+		t.Errorf("expected a failing sink to be unhealthy after the grace period, got %+v", r)
+	}
+
+	s.done(s.put(now), nil)
+
+	if r := sinkReport(s, now.Add(gracePeriod+time.Second)); !r.Healthy {
+		t.Errorf("expected a sink that recovered to be healthy, got %+v", r)
+	}
+}
@@ -0,0 +1,82 @@
+package helper
+
+import (
+	"sync"
+
+	"github.com/seatgeek/nomad-firehose/sink"
+)
+
+// Checkpoint tracks the position (a Nomad index or an event time) of every message handed
+// to a sink, and computes the highest position at which all messages have been acknowledged
+type Checkpoint struct {
+	lock      sync.Mutex
+	committed uint64         // highest position at which all messages have been acknowledged
+	scanned   uint64         // highest position the firehose has handed all messages to the sink for
+	pending   map[uint64]int // number of unacknowledged messages per position
+}
+
+// NewCheckpoint creates a Checkpoint resuming from a restored position
+func NewCheckpoint(position uint64) *Checkpoint {
+	return &Checkpoint{
+		committed: position,
+		scanned:   position,
+		pending:   make(map[uint64]int),
+	}
+}
+
+// Track a message at position, the returned AckFunc must be attached to the message
+//
+// A message that could not be written is never acknowledged, so the checkpoint won't move
+// past it and the message will be emitted again after a restart
+func (c *Checkpoint) Track(position uint64) sink.AckFunc {
+	c.lock.Lock()
+	c.pending[position]++
+	c.lock.Unlock()
+
+	var once sync.Once
+	return func(err error) {
+		if err != nil {
+			return
+		}
+
+		once.Do(func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+
+			c.pending[position]--
+			if c.pending[position] <= 0 {
+				delete(c.pending, position)
+			}
+		})
+	}
+}
+
+// Advance marks that every message up to and including position has been tracked
+func (c *Checkpoint) Advance(position uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if position > c.scanned {
+		c.scanned = position
+	}
+}
+
+// Value returns the highest position at which all messages have been acknowledged
+func (c *Checkpoint) Value() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	value := c.scanned
+	for position := range c.pending {
+		if position > 0 && position-1 < value {
+			value = position - 1
+		}
+	}
+
+	// Never move backwards, positions at or below the committed one won't be emitted again
+	if value > c.committed {
+		c.committed = value
+	}
+
+	return c.committed
+}
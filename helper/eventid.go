@@ -0,0 +1,37 @@
+package helper
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// EventID returns the deterministic ID of an event, made of its type and the parts identifying
+// it (e.g. the region, object ID and ModifyIndex) joined with "/", so an event emitted again after
+// a restart gets the same ID. Empty parts are left out
+func EventID(eventType string, parts ...interface{}) string {
+	id := []string{eventType}
+	for _, part := range parts {
+		if s := fmt.Sprint(part); s != "" {
+			id = append(id, s)
+		}
+	}
+
+	return strings.Join(id, "/")
+}
+
+// SnakeCase converts a CamelCase event type to snake_case, e.g. HealthChanged to health_changed
+func SnakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
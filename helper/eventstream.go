@@ -0,0 +1,175 @@
+package helper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/seatgeek/nomad-firehose/health"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrEventStreamUnsupported is returned by EventStream.Subscribe when the Nomad
+// cluster does not expose /v1/event/stream (Nomad < 1.0)
+var ErrEventStreamUnsupported = errors.New("Nomad event stream is not supported by the cluster")
+
+// StreamEvent is a single event emitted by the Nomad event stream
+type StreamEvent struct {
+	Topic      string
+	Type       string
+	Key        string
+	Namespace  string
+	FilterKeys []string
+	Index      uint64
+	Payload    map[string]json.RawMessage
+}
+
+// Decode the payload stored under key (e.g. "Allocation" or "Node") into out
+//
+// The Nomad API client we build against is older than the event stream, so
+// fields that changed type in newer Nomad versions are skipped rather than
+// failing the whole event
+func (e *StreamEvent) Decode(key string, out interface{}) error {
+	raw, ok := e.Payload[key]
+	if !ok {
+		return fmt.Errorf("Event %s/%s has no %s payload", e.Topic, e.Type, key)
+	}
+
+	err := json.Unmarshal(raw, out)
+	if _, ok := err.(*json.UnmarshalTypeError); ok {
+		log.Debugf("Ignoring incompatible field in %s/%s payload: %s", e.Topic, e.Type, err)
+		return nil
+	}
+
+	return err
+}
+
+// streamFrame is a single line of the event stream, heartbeats are empty frames
+type streamFrame struct {
+	Index  uint64
+	Events []*StreamEvent
+}
+
+// EventStreamHandler is called for every batch of events sharing the same Nomad index
+type EventStreamHandler func(index uint64, events []*StreamEvent)
+
+// EventStream subscribes to the Nomad event stream for a set of topics
+type EventStream struct {
+	client   *nomad.Client
+	firehose string
+	topics   []string
+	logger   *log.Entry
+}
+
+// NewEventStream creates an EventStream for a firehose, subscribing to all keys of the provided topics
+func NewEventStream(client *nomad.Client, firehose string, topics ...string) *EventStream {
+	return &EventStream{
+		client:   client,
+		firehose: firehose,
+		topics:   topics,
+		logger:   log.WithField("event_stream", strings.Join(topics, ",")),
+	}
+}
+
+// EventStreamEnabled returns false if the event stream has been disabled by setting
+// NOMAD_FIREHOSE_EVENT_STREAM=false, forcing blocking queries to be used
+func EventStreamEnabled() bool {
+	return os.Getenv("NOMAD_FIREHOSE_EVENT_STREAM") != "false"
+}
+
+// Subscribe to the event stream starting at index, and call h for every batch of events
+//
+// Subscribe will reconnect from the last seen index if the stream breaks, and only return
+// once stopCh is closed, or with ErrEventStreamUnsupported if the cluster does not support it
+func (s *EventStream) Subscribe(index uint64, stopCh <-chan struct{}, h EventStreamHandler) error {
+	connected := false
+
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		default:
+		}
+
+		s.logger.Infof("Subscribing to Nomad event stream from index %d", index)
+
+		q := &nomad.QueryOptions{
+			AllowStale: true,
+			Namespace:  GetNamespaces().Query(),
+		}
+
+		body, err := s.client.Raw().Response(s.endpoint(index), q)
+		if err != nil {
+			if !connected && strings.Contains(err.Error(), "404") {
+				return ErrEventStreamUnsupported
+			}
+
+			metrics.NomadErrors.Inc(s.firehose)
+			health.NomadQuery(s.firehose, err)
+			s.logger.Errorf("Unable to subscribe to event stream: %s", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		connected = true
+
+		// Close the body on stop, so the blocking decode below returns
+		doneCh := make(chan struct{})
+		go func() {
+			select {
+			case <-stopCh:
+				body.Close()
+			case <-doneCh:
+			}
+		}()
+
+		decoder := json.NewDecoder(body)
+		for {
+			var frame streamFrame
+			if err := decoder.Decode(&frame); err != nil {
+				s.logger.Warnf("Event stream closed: %s", err)
+				break
+			}
+
+			// Nomad sends a heartbeat every 10s, so any frame means the stream is healthy
+			health.NomadQuery(s.firehose, nil)
+
+			// Heartbeat
+			if frame.Index == 0 {
+				continue
+			}
+
+			// Drop events of namespaces we don't watch, when watching a list of namespaces
+			events := make([]*StreamEvent, 0, len(frame.Events))
+			for _, event := range frame.Events {
+				if GetNamespaces().Allowed(event.Namespace) {
+					events = append(events, event)
+				}
+			}
+
+			h(frame.Index, events)
+			index = frame.Index
+			metrics.NomadIndex.Set(float64(index), s.firehose)
+		}
+
+		close(doneCh)
+		body.Close()
+	}
+}
+
+// endpoint returns the event stream path for the topics, resuming from index
+func (s *EventStream) endpoint(index uint64) string {
+	params := url.Values{}
+	for _, topic := range s.topics {
+		params.Add("topic", topic+":*")
+	}
+	params.Set("index", fmt.Sprintf("%d", index))
+
+	return "/v1/event/stream?" + params.Encode()
+}
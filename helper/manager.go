@@ -5,10 +5,11 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
-	"strings"
 	"time"
 
-	consulapi "github.com/hashicorp/consul/api"
+	"github.com/seatgeek/nomad-firehose/backend"
+	"github.com/seatgeek/nomad-firehose/health"
+	"github.com/seatgeek/nomad-firehose/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -20,28 +21,44 @@ type Runner interface {
 	UpdateCh() <-chan interface{}
 }
 
+// StatefulRunner is implemented by runners keeping state that can't be read back from Nomad after
+// a restart. They send a Snapshot on their UpdateCh instead of their last change time
+type StatefulRunner interface {
+	Runner
+	SetRestoreState(state []byte) error
+}
+
+// Snapshot is the last change time of a StatefulRunner along with its state. The state is
+// persisted first, so the restored state is never older than the restored last change time
+type Snapshot struct {
+	Value interface{}
+	State []byte
+}
+
 func NewManager(r Runner) *Manager {
-	consulPrefix := "nomad-firehose"
-	if v, ok := os.LookupEnv("NOMAD_FIREHOSE_CONSUL_PREFIX"); ok {
-		consulPrefix = strings.TrimSuffix(v, "/")
-	}
 	return &Manager{
 		runner:                   r,
 		logger:                   log.WithField("type", r.Name()),
 		stopCh:                   make(chan interface{}),
 		voluntarilyReleaseLockCh: make(chan interface{}),
-		prefix:                   consulPrefix,
 	}
 }
 
+// NewManagerWithBackend creates a Manager using an existing backend, so several
+// managers in the same process can share it
+func NewManagerWithBackend(r Runner, b backend.Backend) *Manager {
+	m := NewManager(r)
+	m.backend = b
+	return m
+}
+
 type Manager struct {
 	runner                   Runner
-	client                   *consulapi.Client
-	lock                     *consulapi.Lock
-	lockCh                   <-chan struct{}  // lock channel used by Consul SDK to notify about changes
-	lockErrorCh              <-chan struct{}  // lock error channel used by Consul SDK to notify about errors related to the lock
-	logger                   *log.Entry       // logger for the consul connection struct
-	prefix                   string           // Consul KV prefix to write state to
+	backend                  backend.Backend // backend holding the lock and the last change time
+	lock                     backend.Locker
+	lockCh                   <-chan struct{}  // lock channel used by the backend to notify about changes
+	lockErrorCh              <-chan struct{}  // lock error channel used by the backend to notify about errors related to the lock
+	logger                   *log.Entry       // logger for the backend connection struct
 	stopCh                   chan interface{} // internal channel used to stop all go-routines when gracefully shutting down
 	voluntarilyReleaseLockCh chan interface{}
 }
@@ -49,7 +66,7 @@ type Manager struct {
 // cleanup will do cleanup tasks when the reconciler is shutting down
 func (m *Manager) cleanup() {
 	m.logger.Debug("Releasing lock")
-	m.releaseConsulLock()
+	m.releaseLock()
 
 	m.logger.Debug("Closing stopCh")
 	close(m.stopCh)
@@ -57,9 +74,9 @@ func (m *Manager) cleanup() {
 	m.logger.Debugf("Cleanup complete")
 }
 
-// continuouslyAcquireConsulLeadership waits to acquire the lock to the Consul KV key.
+// continuouslyAcquireLeadership waits to acquire the lock of the firehose type.
 // it will run until the stopCh is closed
-func (m *Manager) continuouslyAcquireConsulLeadership() error {
+func (m *Manager) continuouslyAcquireLeadership() error {
 	m.logger.Info("Starting to continously acquire leadership")
 
 	interval := 250 * time.Millisecond
@@ -71,9 +88,9 @@ func (m *Manager) continuouslyAcquireConsulLeadership() error {
 		case <-m.stopCh:
 			return nil
 
-		// Periodically try to acquire the consul lock
+		// Periodically try to acquire the lock
 		case <-timer.C:
-			if err := m.acquireConsulLeadership(); err != nil {
+			if err := m.acquireLeadership(); err != nil {
 				return err
 			}
 			timer.Reset(interval)
@@ -81,16 +98,17 @@ func (m *Manager) continuouslyAcquireConsulLeadership() error {
 	}
 }
 
-// Read the Last Change Time from Consul KV, so we don't re-process tasks over and over on restart
+// Read the Last Change Time from the backend, so we don't re-process tasks over and over on restart
 func (m *Manager) restoreLastChangeTime() interface{} {
-	kv, _, err := m.client.KV().Get(fmt.Sprintf("%s/%s.value", m.prefix, m.runner.Name()), nil)
+	value, err := m.backend.Get(m.runner.Name())
 	if err != nil {
+		m.logger.Errorf("Could not read Last Change Time: %v", err)
 		return 0
 	}
 
 	// Ensure we got
-	if kv != nil && kv.Value != nil {
-		sv := string(kv.Value)
+	if value != nil {
+		sv := string(value)
 		v, err := strconv.ParseInt(sv, 10, 64)
 		if err != nil {
 			return 0
@@ -104,58 +122,89 @@ func (m *Manager) restoreLastChangeTime() interface{} {
 	return 0
 }
 
-// acquireConsulLeadership will one-off try to acquire the consul lock needed to become
-// redis Master node
-func (m *Manager) acquireConsulLeadership() error {
+// Read the state of a StatefulRunner from the backend, nil if there is none
+func (m *Manager) restoreState() []byte {
+	value, err := m.backend.Get(m.stateName())
+	if err != nil {
+		m.logger.Errorf("Could not read state: %v", err)
+		return nil
+	}
+
+	return value
+}
+
+// stateName is the name the state of a StatefulRunner is stored under in the backend
+func (m *Manager) stateName() string {
+	return m.runner.Name() + ".state"
+}
+
+// acquireLeadership will one-off try to acquire the lock needed to become
+// the leader of the firehose type
+func (m *Manager) acquireLeadership() error {
 	var err error
-	m.lock, err = m.client.LockOpts(&consulapi.LockOptions{
-		Key:              fmt.Sprintf("%s/%s.lock", m.prefix, m.runner.Name()),
-		SessionName:      fmt.Sprintf("nomad-firehose-%s", m.runner.Name()),
-		MonitorRetries:   10,
-		MonitorRetryTime: 5 * time.Second,
-	})
+	m.lock, err = m.backend.NewLock(m.runner.Name())
 	if err != nil {
-		return fmt.Errorf("Failed create lock options: %+v", err)
+		return err
 	}
 
 	// try to acquire the lock
-	m.logger.Infof("Trying to acquire consul lock")
+	m.logger.Infof("Trying to acquire lock")
 	m.lockErrorCh, err = m.lock.Lock(m.lockCh)
 	if err != nil {
 		return err
 	}
 
 	m.logger.Info("Lock successfully acquired")
+	metrics.Leader.Set(1, m.runner.Name())
+	health.SetLeader(m.runner.Name(), true)
 
 	//
-	// start monitoring the consul lock for errors / changes
+	// start monitoring the lock for errors / changes
 	//
 
 	m.voluntarilyReleaseLockCh = make(chan interface{})
 	if err := m.runner.SetRestoreValue(m.restoreLastChangeTime()); err != nil {
 		return err
 	}
+	if s, ok := m.runner.(StatefulRunner); ok {
+		if err := s.SetRestoreState(m.restoreState()); err != nil {
+			return err
+		}
+	}
 
 	go m.runner.Start()
 
 	// At this point, if we return from this function, we need to make sure
 	// we release the lock
 	defer func() {
+		metrics.Leader.Set(0, m.runner.Name())
+		health.SetLeader(m.runner.Name(), false)
 		m.runner.Stop()
 
 		err := m.lock.Unlock()
-		m.handleConsulError(err)
+		m.handleLockError(err)
 		if err != nil {
-			m.logger.Errorf("Could not release Consul Lock: %v", err)
+			m.logger.Errorf("Could not release lock: %v", err)
 		} else {
-			m.logger.Info("Consul Lock successfully released")
+			m.logger.Info("Lock successfully released")
 		}
 	}()
 
-	// Wait for changes to Consul Lock
+	// Wait for changes to the lock
 	for {
 		select {
 		case v := <-m.runner.UpdateCh():
+			if snapshot, ok := v.(*Snapshot); ok {
+				m.logger.Debug("Writing state to KV")
+				if err := m.backend.Put(m.stateName(), snapshot.State); err != nil {
+					// Keep the last change time that goes with the state that was persisted
+					metrics.CheckpointErrors.Inc(m.runner.Name())
+					log.Error(err)
+					continue
+				}
+				v = snapshot.Value
+			}
+
 			var r string
 			switch v.(type) {
 			case int:
@@ -167,13 +216,12 @@ func (m *Manager) acquireConsulLeadership() error {
 			}
 
 			m.logger.Debugf("Writing lastChangedTime to KV: %s", r)
-			kv := &consulapi.KVPair{
-				Key:   fmt.Sprintf("%s/%s.value", m.prefix, m.runner.Name()),
-				Value: []byte(r),
-			}
-			_, err := m.client.KV().Put(kv, nil)
+			err := m.backend.Put(m.runner.Name(), []byte(r))
 			if err != nil {
+				metrics.CheckpointErrors.Inc(m.runner.Name())
 				log.Error(err)
+			} else if value, err := strconv.ParseFloat(r, 64); err == nil {
+				metrics.Checkpoint.Set(value, m.runner.Name())
 			}
 
 		// Global stop of all go-routines, reconciler is shutting down
@@ -185,46 +233,50 @@ func (m *Manager) acquireConsulLeadership() error {
 		// if written to, we simply pass on the message
 		case data, ok := <-m.lockErrorCh:
 			if !ok {
-				return fmt.Errorf("Consul Lock error channel was closed, we no longer hold the lock")
+				return fmt.Errorf("Lock error channel was closed, we no longer hold the lock")
 			}
 
 			m.logger.Warnf("Something wrote to lock error channel %+v", data)
 
 		// voluntarily release our claim on the lock
 		case <-m.voluntarilyReleaseLockCh:
-			m.logger.Warnf("Voluntarily releasing the Consul lock")
+			m.logger.Warnf("Voluntarily releasing the lock")
 			return nil
 		}
 	}
 }
 
-// releaseConsulLock stops consul lock handler")
-func (m *Manager) releaseConsulLock() {
-	m.logger.Info("Releasing Consul lock")
+// releaseLock stops the lock handler
+func (m *Manager) releaseLock() {
+	m.logger.Info("Releasing lock")
 	close(m.voluntarilyReleaseLockCh)
 }
 
-// handleConsulError is the error handler
-func (m *Manager) handleConsulError(err error) {
+// handleLockError is the error handler
+func (m *Manager) handleLockError(err error) {
 	// if no error
 	if err == nil {
 		return
 	}
 
-	m.logger.Errorf("Consul error: %v", err)
+	m.logger.Errorf("Lock error: %v", err)
 }
 
 func (m *Manager) Start() error {
 	m.logger.Info("Starting manager")
+	metrics.Leader.Set(0, m.runner.Name())
+	health.SetLeader(m.runner.Name(), false)
 
-	var err error
-	m.client, err = consulapi.NewClient(consulapi.DefaultConfig())
-	if err != nil {
-		return err
+	if m.backend == nil {
+		var err error
+		m.backend, err = backend.GetBackend()
+		if err != nil {
+			return err
+		}
 	}
 
 	go m.signalHandler()
-	return m.continuouslyAcquireConsulLeadership()
+	return m.continuouslyAcquireLeadership()
 }
 
 // Close the stopCh if we get a signal, so we can gracefully shut down
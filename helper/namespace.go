@@ -0,0 +1,60 @@
+package helper
+
+import (
+	"strings"
+)
+
+// Namespaces is the set of Nomad namespaces the firehoses watch
+type Namespaces struct {
+	query   string
+	allowed map[string]bool
+}
+
+var namespaces = &Namespaces{}
+
+// ConfigureNamespaces sets the namespaces to watch from a comma separated list, "*" watches
+// all namespaces, and an empty list the namespace of the Nomad client (NOMAD_NAMESPACE)
+func ConfigureNamespaces(value string) {
+	n := &Namespaces{}
+
+	for _, namespace := range strings.Split(value, ",") {
+		namespace = strings.TrimSpace(namespace)
+		switch {
+		case namespace == "":
+			continue
+
+		case namespace == "*":
+			n.query = "*"
+			n.allowed = nil
+			namespaces = n
+			return
+
+		case n.allowed == nil:
+			n.allowed = map[string]bool{namespace: true}
+			n.query = namespace
+
+		default:
+			// Nomad can't query a list of namespaces, so query them all and filter locally
+			n.allowed[namespace] = true
+			n.query = "*"
+		}
+	}
+
+	namespaces = n
+}
+
+// GetNamespaces returns the namespaces the firehoses watch
+func GetNamespaces() *Namespaces {
+	return namespaces
+}
+
+// Query returns the namespace to pass to Nomad queries
+func (n *Namespaces) Query() string {
+	return n.query
+}
+
+// Allowed returns true if objects in the namespace should be published, objects without
+// a namespace (e.g. nodes, or clusters predating namespaces) are always allowed
+func (n *Namespaces) Allowed(namespace string) bool {
+	return n.allowed == nil || namespace == "" || n.allowed[namespace]
+}
@@ -0,0 +1,18 @@
+package helper
+
+import (
+	"time"
+
+	"github.com/seatgeek/nomad-firehose/health"
+	"github.com/seatgeek/nomad-firehose/metrics"
+)
+
+// ObserveNomadQuery records the duration and outcome of a Nomad query started at start
+func ObserveNomadQuery(firehose string, start time.Time, err error) {
+	metrics.NomadQueryDuration.Observe(time.Since(start).Seconds(), firehose)
+	health.NomadQuery(firehose, err)
+
+	if err != nil {
+		metrics.NomadErrors.Inc(firehose)
+	}
+}
@@ -0,0 +1,54 @@
+package helper
+
+import (
+	"strings"
+	"time"
+
+	"github.com/seatgeek/nomad-firehose/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	readMinBackoff = 1 * time.Second
+	readMaxBackoff = 1 * time.Minute
+)
+
+// IsNotFound returns true if err is a 404 response from Nomad
+func IsNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "response code: 404")
+}
+
+// ReadObject calls read to read the object an update is about, retrying failed reads with an
+// exponential backoff. It returns false if there is nothing to publish, after calling ack with
+// nil if the object was deleted, or with the last error if stopCh was closed first so the
+// checkpoint doesn't move past the update
+func ReadObject(stopCh <-chan struct{}, what string, ack sink.AckFunc, read func() error) bool {
+	backoff := readMinBackoff
+
+	for {
+		err := read()
+		if err == nil {
+			return true
+		}
+
+		if IsNotFound(err) {
+			log.Debugf("Could not read %s, it was deleted: %s", what, err)
+			ack(nil)
+			return false
+		}
+
+		log.Errorf("Could not read %s, retrying in %s: %s", what, backoff, err)
+
+		select {
+		case <-stopCh:
+			ack(err)
+			return false
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > readMaxBackoff {
+			backoff = readMaxBackoff
+		}
+	}
+}
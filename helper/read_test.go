@@ -0,0 +1,49 @@
+package helper
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReadObjectRetries(t *testing.T) {
+	attempts := 0
+	acked := false
+
+	ok := ReadObject(make(chan struct{}), "job web", func(err error) { acked = true }, func() error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("Unexpected response code: 500")
+		}
+		return nil
+	})
+
+	if !ok || attempts != 2 || acked {
+		t.Errorf("expected the read to succeed on its second attempt without acking, got ok=%t attempts=%d acked=%t", ok, attempts, acked)
+	}
+}
+
+func TestReadObjectNotFound(t *testing.T) {
+	var ackErr error = errors.New("not acked")
+
+	ok := ReadObject(make(chan struct{}), "job web", func(err error) { ackErr = err }, func() error {
+		return errors.New("Unexpected response code: 404 (job not found)")
+	})
+
+	if ok || ackErr != nil {
+		t.Errorf("expected a deleted object to be acked with nil, got ok=%t err=%v", ok, ackErr)
+	}
+}
+
+func TestReadObjectStopped(t *testing.T) {
+	stopCh := make(chan struct{})
+	close(stopCh)
+
+	var ackErr error
+	ok := ReadObject(stopCh, "job web", func(err error) { ackErr = err }, func() error {
+		return errors.New("Unexpected response code: 500")
+	})
+
+	if ok || ackErr == nil {
+		t.Errorf("expected the update to fail once stopped, got ok=%t err=%v", ok, ackErr)
+	}
+}
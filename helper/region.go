@@ -0,0 +1,58 @@
+package helper
+
+import (
+	"os"
+	"strings"
+
+	nomad "github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// ParseRegions parses a comma separated list of Nomad regions, an empty list means the
+// region of the Nomad client (NOMAD_REGION, or the region of the agent)
+func ParseRegions(value string) []string {
+	regions := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, region := range strings.Split(value, ",") {
+		region = strings.TrimSpace(region)
+		if region == "" || seen[region] {
+			continue
+		}
+
+		seen[region] = true
+		regions = append(regions, region)
+	}
+
+	return regions
+}
+
+// RegionName returns the name of a firehose type watching a region, used for its lock,
+// checkpoint and metrics. Firehoses not watching an explicit region keep the type name, so
+// single region deployments keep their existing checkpoint
+func RegionName(name, region string) string {
+	if region == "" {
+		return name
+	}
+
+	return name + "/" + region
+}
+
+// ResolveRegion returns region, or the region of the Nomad client if it's empty, to annotate events with
+func ResolveRegion(client *nomad.Client, region string) string {
+	if region != "" {
+		return region
+	}
+
+	if region := os.Getenv("NOMAD_REGION"); region != "" {
+		return region
+	}
+
+	region, err := client.Agent().Region()
+	if err != nil {
+		log.Warnf("Unable to read the region of the Nomad agent, events won't be annotated with it: %s", err)
+		return ""
+	}
+
+	return region
+}
@@ -0,0 +1,21 @@
+package helper
+
+import (
+	"net/http"
+
+	"github.com/seatgeek/nomad-firehose/health"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServeHTTP exposes the Prometheus metrics of the firehose on addr at /metrics,
+// and its health at /healthz and /ready
+func ServeHTTP(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", health.HealthzHandler())
+	mux.Handle("/ready", health.ReadyHandler())
+
+	log.Infof("Serving metrics and health checks on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,96 @@
+package helper
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// StartupReplay replays all the history Nomad still has
+	StartupReplay = "replay"
+
+	// StartupFromNow skips the history and only emits new changes
+	StartupFromNow = "from-now"
+
+	// StartupFullSnapshot emits the current state of live objects, then only new changes
+	StartupFullSnapshot = "full-snapshot"
+
+	// StartupReplaySince replays the history newer than a duration
+	StartupReplaySince = "replay-since"
+)
+
+// StartupPolicy decides where a firehose starts when there is no restore point, e.g. on its
+// first start or after its checkpoint was wiped
+type StartupPolicy struct {
+	Mode  string
+	Since time.Duration // how far back replay-since replays
+}
+
+var startupPolicy = &StartupPolicy{Mode: StartupReplay}
+
+// ConfigureStartupPolicy sets the startup policy from "replay", "from-now", "full-snapshot"
+// or "replay-since=<duration>", an empty value keeps replaying all the history
+func ConfigureStartupPolicy(value string) error {
+	value = strings.TrimSpace(value)
+
+	switch {
+	case value == "" || value == StartupReplay:
+		startupPolicy = &StartupPolicy{Mode: StartupReplay}
+
+	case value == StartupFromNow || value == StartupFullSnapshot:
+		startupPolicy = &StartupPolicy{Mode: value}
+
+	case strings.HasPrefix(value, StartupReplaySince+"="):
+		since, err := time.ParseDuration(strings.TrimPrefix(value, StartupReplaySince+"="))
+		if err != nil {
+			return fmt.Errorf("Invalid startup policy %q: %s", value, err)
+		}
+
+		if since <= 0 {
+			return fmt.Errorf("Invalid startup policy %q: the duration must be positive", value)
+		}
+
+		startupPolicy = &StartupPolicy{Mode: StartupReplaySince, Since: since}
+
+	default:
+		return fmt.Errorf("Invalid startup policy %q, expected replay, from-now, full-snapshot or replay-since=<duration>", value)
+	}
+
+	return nil
+}
+
+// GetStartupPolicy returns the startup policy of the firehoses
+func GetStartupPolicy() *StartupPolicy {
+	return startupPolicy
+}
+
+// SkipHistory returns true if changes made before the firehose started should not all be replayed
+func (p *StartupPolicy) SkipHistory() bool {
+	return p.Mode != StartupReplay
+}
+
+// Snapshot returns true if the current state of live objects should be emitted before going live
+func (p *StartupPolicy) Snapshot() bool {
+	return p.Mode == StartupFullSnapshot
+}
+
+// Cutoff returns the time changes must be newer than to be emitted, zero to replay all the history
+func (p *StartupPolicy) Cutoff(now time.Time) time.Time {
+	switch p.Mode {
+	case StartupReplay:
+		return time.Time{}
+	case StartupReplaySince:
+		return now.Add(-p.Since)
+	default:
+		return now
+	}
+}
+
+func (p *StartupPolicy) String() string {
+	if p.Mode == StartupReplaySince {
+		return fmt.Sprintf("%s=%s", p.Mode, p.Since)
+	}
+
+	return p.Mode
+}
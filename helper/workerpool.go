@@ -0,0 +1,149 @@
+package helper
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/sink"
+)
+
+const defaultWorkers = 8
+
+// WorkFunc handles an update of an object, ack must be attached to the published message
+type WorkFunc func(ack sink.AckFunc)
+
+// WorkerPool runs updates of objects (e.g. reading a node from Nomad and publishing it) with
+// a bounded number of workers. Updates of the same object run one at a time in the order they
+// were submitted, and an update still waiting for a worker is superseded by a newer update of
+// the same object
+type WorkerPool struct {
+	workers    int
+	firehose   string
+	lock       sync.Mutex
+	cond       *sync.Cond
+	generation int                 // incremented on Stop, so workers of a previous Start exit
+	queue      []string            // keys with a pending update and no worker running them, in order
+	pending    map[string]*work    // next update of each key
+	active     map[string]struct{} // keys queued or being run by a worker
+}
+
+type work struct {
+	fn  WorkFunc
+	ack sink.AckFunc
+}
+
+// NewWorkerPool creates a WorkerPool with the number of workers set by NOMAD_FIREHOSE_WORKERS (default: 8)
+func NewWorkerPool() (*WorkerPool, error) {
+	workers := defaultWorkers
+	if v := os.Getenv("NOMAD_FIREHOSE_WORKERS"); v != "" {
+		var err error
+		if workers, err = strconv.Atoi(v); err != nil || workers < 1 {
+			return nil, fmt.Errorf("Invalid NOMAD_FIREHOSE_WORKERS: %s", v)
+		}
+	}
+
+	p := &WorkerPool{
+		workers: workers,
+		pending: make(map[string]*work),
+		active:  make(map[string]struct{}),
+	}
+	p.cond = sync.NewCond(&p.lock)
+
+	return p, nil
+}
+
+// Start the workers of the pool for a firehose
+func (p *WorkerPool) Start(firehose string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.firehose == "" {
+		metrics.WorkerQueueDepth.AddFunc(func() float64 {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+
+			return float64(len(p.pending))
+		}, firehose)
+	}
+	p.firehose = firehose
+
+	for i := 0; i < p.workers; i++ {
+		go p.work(p.generation)
+	}
+}
+
+// Stop the workers once they are done with their current update, and drop the pending updates
+// without acknowledging them
+func (p *WorkerPool) Stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.generation++
+	p.queue = nil
+	p.pending = make(map[string]*work)
+	p.active = make(map[string]struct{})
+	p.cond.Broadcast()
+}
+
+// Submit an update of the object identified by key, a pending update of the same object is
+// acknowledged without running, as fn is expected to read the latest state of the object
+func (p *WorkerPool) Submit(key string, ack sink.AckFunc, fn WorkFunc) {
+	p.lock.Lock()
+
+	superseded := p.pending[key]
+	p.pending[key] = &work{fn: fn, ack: ack}
+
+	if _, ok := p.active[key]; !ok {
+		p.active[key] = struct{}{}
+		p.queue = append(p.queue, key)
+		p.cond.Signal()
+	}
+
+	p.lock.Unlock()
+
+	if superseded != nil {
+		metrics.UpdatesCollapsed.Inc(p.firehose)
+		superseded.ack(nil)
+	}
+}
+
+// work runs queued updates until the pool is stopped
+func (p *WorkerPool) work(generation int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for {
+		for len(p.queue) == 0 && p.generation == generation {
+			p.cond.Wait()
+		}
+
+		if p.generation != generation {
+			return
+		}
+
+		key := p.queue[0]
+		p.queue = p.queue[1:]
+
+		w := p.pending[key]
+		delete(p.pending, key)
+
+		p.lock.Unlock()
+		w.fn(w.ack)
+		p.lock.Lock()
+
+		if p.generation != generation {
+			return
+		}
+
+		// Run the update submitted while this one was running after the updates of other objects
+		if _, ok := p.pending[key]; ok {
+			p.queue = append(p.queue, key)
+			p.cond.Signal()
+		} else {
+			delete(p.active, key)
+		}
+	}
+}
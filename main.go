@@ -5,12 +5,11 @@ import (
 	"sort"
 
 	gelf "github.com/seatgeek/logrus-gelf-formatter"
-	"github.com/seatgeek/nomad-firehose/command/allocations"
-	"github.com/seatgeek/nomad-firehose/command/deployments"
-	"github.com/seatgeek/nomad-firehose/command/evaluations"
-	"github.com/seatgeek/nomad-firehose/command/jobs"
-	"github.com/seatgeek/nomad-firehose/command/nodes"
+	"github.com/seatgeek/nomad-firehose/command/multi"
+	"github.com/seatgeek/nomad-firehose/filter"
 	"github.com/seatgeek/nomad-firehose/helper"
+	"github.com/seatgeek/nomad-firehose/sink"
+	"github.com/seatgeek/nomad-firehose/transform"
 	log "github.com/sirupsen/logrus"
 	cli "gopkg.in/urfave/cli.v1"
 )
@@ -37,87 +36,167 @@ func main() {
 			Usage:  "json or text",
 			EnvVar: "LOG_FORMAT",
 		},
+		cli.StringFlag{
+			Name:   "http-addr",
+			Usage:  "Address to serve Prometheus metrics (/metrics) and health checks (/healthz, /ready) on (example: :8080), disabled if empty",
+			EnvVar: "NOMAD_FIREHOSE_HTTP_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "namespaces",
+			Usage:  "Comma separated list of Nomad namespaces to watch, or * for all namespaces (default: the NOMAD_NAMESPACE namespace)",
+			EnvVar: "NOMAD_FIREHOSE_NAMESPACES",
+		},
+		cli.StringFlag{
+			Name:   "regions",
+			Usage:  "Comma separated list of Nomad regions to watch, each with its own lock and checkpoint (default: the NOMAD_REGION region)",
+			EnvVar: "NOMAD_FIREHOSE_REGIONS",
+		},
+		cli.StringFlag{
+			Name:   "startup-policy",
+			Value:  "replay",
+			Usage:  "Where allocations, nodes and deployments start without a restore point: replay, from-now, full-snapshot or replay-since=<duration>",
+			EnvVar: "NOMAD_FIREHOSE_STARTUP_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "filter-include",
+			Usage:  "Only send events matching this expression to the sink (example: 'TaskEvent.Type == \"Terminated\"')",
+			EnvVar: "NOMAD_FIREHOSE_FILTER_INCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "filter-exclude",
+			Usage:  "Don't send events matching this expression to the sink (example: 'Namespace == \"test\"')",
+			EnvVar: "NOMAD_FIREHOSE_FILTER_EXCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "filter-file",
+			Usage:  "JSON file with include and exclude expressions per firehose type",
+			EnvVar: "NOMAD_FIREHOSE_FILTER_FILE",
+		},
+		cli.StringFlag{
+			Name:   "transform-fields",
+			Usage:  "Comma separated list of fields to keep, optionally renamed (example: Name,TaskEvent.Type:event_type)",
+			EnvVar: "NOMAD_FIREHOSE_TRANSFORM_FIELDS",
+		},
+		cli.StringFlag{
+			Name:   "transform-add",
+			Usage:  "Comma separated list of static fields to add to events (example: cluster=prod,region=us-east-1)",
+			EnvVar: "NOMAD_FIREHOSE_TRANSFORM_ADD",
+		},
+		cli.StringFlag{
+			Name:   "transform-template",
+			Usage:  "Go text/template rendering events, the output is sent instead of JSON",
+			EnvVar: "NOMAD_FIREHOSE_TRANSFORM_TEMPLATE",
+		},
+		cli.StringFlag{
+			Name:   "transform-template-file",
+			Usage:  "File holding the Go text/template rendering events, overrides --transform-template",
+			EnvVar: "NOMAD_FIREHOSE_TRANSFORM_TEMPLATE_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "envelope",
+			Usage:  "Wrap events in an envelope with their type, cluster, region, index, emission time, schema version and instance ID",
+			EnvVar: "NOMAD_FIREHOSE_ENVELOPE",
+		},
+		cli.StringFlag{
+			Name:   "cluster",
+			Usage:  "Name of the Nomad cluster, for the envelope",
+			EnvVar: "NOMAD_FIREHOSE_CLUSTER",
+		},
+		cli.StringFlag{
+			Name:   "instance-id",
+			Usage:  "ID of this firehose process, for the envelope (default: the hostname)",
+			EnvVar: "NOMAD_FIREHOSE_INSTANCE_ID",
+		},
+		cli.StringFlag{
+			Name:   "cloudevents",
+			Usage:  "Encode events as CloudEvents 1.0, in the structured or binary mode",
+			EnvVar: "NOMAD_FIREHOSE_CLOUDEVENTS",
+		},
+		cli.StringFlag{
+			Name:   "cloudevents-source",
+			Usage:  "Source of the CloudEvents (default: the Nomad address, $NOMAD_ADDR)",
+			EnvVar: "NOMAD_FIREHOSE_CLOUDEVENTS_SOURCE",
+		},
+		cli.StringFlag{
+			Name:   "transform-file",
+			Usage:  "JSON file with fields, static fields and template per firehose type",
+			EnvVar: "NOMAD_FIREHOSE_TRANSFORM_FILE",
+		},
 	}
 	app.Commands = []cli.Command{
 		{
-			Name:  "allocations",
-			Usage: "Firehose nomad allocation changes",
-			Action: func(c *cli.Context) error {
-				firehose, err := allocations.NewFirehose()
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				manager := helper.NewManager(firehose)
-				if err := manager.Start(); err != nil {
-					log.Fatal(err)
-				}
-
-				return nil
-			},
+			Name:   "allocations",
+			Usage:  "Firehose nomad allocation changes",
+			Action: runFirehose("allocations"),
 		},
 		{
-			Name:  "nodes",
-			Usage: "Firehose nomad node changes",
-			Action: func(c *cli.Context) error {
-				firehose, err := nodes.NewFirehose()
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				manager := helper.NewManager(firehose)
-				if err := manager.Start(); err != nil {
-					log.Fatal(err)
-				}
-
-				return nil
-			},
+			Name:   "nodes",
+			Usage:  "Firehose nomad node changes",
+			Action: runFirehose("nodes"),
 		},
 		{
-			Name:  "evaluations",
-			Usage: "Firehose nomad evaluation changes",
-			Action: func(c *cli.Context) error {
-				firehose, err := evaluations.NewFirehose()
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				manager := helper.NewManager(firehose)
-				if err := manager.Start(); err != nil {
-					log.Fatal(err)
-				}
-
-				return nil
-			},
+			Name:   "evaluations",
+			Usage:  "Firehose nomad evaluation changes",
+			Action: runFirehose("evaluations"),
 		},
 		{
-			Name:  "jobs",
-			Usage: "Firehose nomad job changes",
-			Action: func(c *cli.Context) error {
-				firehose, err := jobs.NewJobFirehose()
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				manager := helper.NewManager(firehose)
-				if err := manager.Start(); err != nil {
-					log.Fatal(err)
-				}
-
-				return nil
-			},
+			Name:   "jobs",
+			Usage:  "Firehose nomad job changes",
+			Action: runFirehose("jobs"),
+		},
+		{
+			Name:   "jobliststubs",
+			Usage:  "Firehose nomad job info changes",
+			Action: runFirehose("jobliststubs"),
+		},
+		{
+			Name:   "jobstatus",
+			Usage:  "Firehose nomad job status and summary changes",
+			Action: runFirehose("jobstatus"),
 		},
 		{
-			Name:  "jobliststubs",
-			Usage: "Firehose nomad job info changes",
+			Name:   "deployments",
+			Usage:  "Firehose nomad deployment changes",
+			Action: runFirehose("deployments"),
+		},
+		{
+			Name:   "volumes",
+			Usage:  "Firehose nomad CSI volume claims, CSI plugin health and host volume changes",
+			Action: runFirehose("volumes"),
+		},
+		{
+			Name:   "services",
+			Usage:  "Firehose nomad native service registrations and check status changes",
+			Action: runFirehose("services"),
+		},
+		{
+			Name:   "scaling",
+			Usage:  "Firehose nomad task group scaling events",
+			Action: runFirehose("scaling"),
+		},
+		{
+			Name:    "multi",
+			Aliases: []string{"all"},
+			Usage:   "Firehose several nomad object types from a single process",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "types",
+					Usage:  "Comma separated list of firehose types to run (default: all types)",
+					EnvVar: "NOMAD_FIREHOSE_TYPES",
+				},
+				cli.BoolFlag{
+					Name:   "shared-sink",
+					Usage:  "Write all firehose types to a single sink, rather than a sink per type",
+					EnvVar: "NOMAD_FIREHOSE_SHARED_SINK",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				firehose, err := jobs.NewJobListStubFirehose()
+				types, err := multi.ParseTypes(c.String("types"))
 				if err != nil {
 					log.Fatal(err)
 				}
 
-				manager := helper.NewManager(firehose)
-				if err := manager.Start(); err != nil {
+				if err := multi.Run(types, helper.ParseRegions(c.GlobalString("regions")), c.Bool("shared-sink")); err != nil {
 					log.Fatal(err)
 				}
 
@@ -125,16 +204,16 @@ func main() {
 			},
 		},
 		{
-			Name:  "deployments",
-			Usage: "Firehose nomad deployment changes",
+			Name:  "schemas",
+			Usage: "Print the Avro schemas of the events of every firehose type",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "Directory to write the schemas to as <firehose>.<type>.avsc, rather than printing them",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				firehose, err := deployments.NewFirehose()
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				manager := helper.NewManager(firehose)
-				if err := manager.Start(); err != nil {
+				if err := multi.WriteSchemas(c.String("output"), os.Stdout); err != nil {
 					log.Fatal(err)
 				}
 
@@ -169,9 +248,61 @@ func main() {
 			log.SetFormatter(&gelf.GelfFormatter{})
 		}
 
+		helper.ConfigureNamespaces(c.String("namespaces"))
+
+		if err := helper.ConfigureStartupPolicy(c.String("startup-policy")); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := filter.Configure(c.String("filter-include"), c.String("filter-exclude"), c.String("filter-file")); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := transform.Configure(c.String("transform-fields"), c.String("transform-add"), c.String("transform-template"), c.String("transform-template-file"), c.String("transform-file")); err != nil {
+			log.Fatal(err)
+		}
+
+		sink.ConfigureEnvelope(c.Bool("envelope"), c.String("cluster"), c.String("instance-id"))
+
+		source := c.String("cloudevents-source")
+		if source == "" {
+			source = nomadAddress()
+		}
+		if err := sink.ConfigureCloudEvents(c.String("cloudevents"), source); err != nil {
+			log.Fatal(err)
+		}
+
+		if addr := c.String("http-addr"); addr != "" {
+			go func() {
+				if err := helper.ServeHTTP(addr); err != nil {
+					log.Fatal(err)
+				}
+			}()
+		}
+
 		return nil
 	}
 
 	sort.Sort(cli.FlagsByName(app.Flags))
 	app.Run(os.Args)
 }
+
+// runFirehose returns the action running a single firehose type, for each of the Nomad regions
+func runFirehose(name string) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		if err := multi.Run([]string{name}, helper.ParseRegions(c.GlobalString("regions")), false); err != nil {
+			log.Fatal(err)
+		}
+
+		return nil
+	}
+}
+
+// nomadAddress returns the address of the Nomad cluster, as the Nomad client resolves it
+func nomadAddress() string {
+	if addr := os.Getenv("NOMAD_ADDR"); addr != "" {
+		return addr
+	}
+
+	return "http://127.0.0.1:4646"
+}
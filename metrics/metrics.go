@@ -0,0 +1,108 @@
+package metrics
+
+var (
+	// EventsPublished counts events handed to the sink, per firehose type
+	EventsPublished = NewCounterVec(
+		"nomad_firehose_events_published_total",
+		"Number of events published by the firehose.",
+		"firehose")
+
+	// EventsFiltered counts events dropped by the filter before reaching the sink, per firehose type
+	EventsFiltered = NewCounterVec(
+		"nomad_firehose_events_filtered_total",
+		"Number of events dropped by the filter.",
+		"firehose")
+
+	// TransformErrors counts events dropped because they could not be transformed
+	TransformErrors = NewCounterVec(
+		"nomad_firehose_transform_errors_total",
+		"Number of events dropped because they could not be transformed.",
+		"firehose")
+
+	// SinkPuts counts messages written to a sink, including retries
+	SinkPuts = NewCounterVec(
+		"nomad_firehose_sink_put_total",
+		"Number of messages put on the sink, including retries.",
+		"firehose", "sink")
+
+	// SinkAcks counts messages a sink acknowledged
+	SinkAcks = NewCounterVec(
+		"nomad_firehose_sink_ack_total",
+		"Number of messages acknowledged by the sink.",
+		"firehose", "sink")
+
+	// SinkErrors counts messages a sink failed to write
+	SinkErrors = NewCounterVec(
+		"nomad_firehose_sink_errors_total",
+		"Number of messages the sink failed to write.",
+		"firehose", "sink")
+
+	// SinkDropped counts messages that are never written to a sink, because its fan-out queue stayed
+	// full (queue_full) or the sink could not encode them (encoding)
+	SinkDropped = NewCounterVec(
+		"nomad_firehose_sink_dropped_total",
+		"Number of messages dropped without being written to the sink, by reason.",
+		"firehose", "sink", "reason")
+
+	// SinkLatency observes the time between putting a message on a sink and the sink acknowledging it
+	SinkLatency = NewHistogramVec(
+		"nomad_firehose_sink_latency_seconds",
+		"Time between putting a message on the sink and the sink acknowledging or failing it.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		"firehose", "sink")
+
+	// SinkQueueDepth reports the number of messages waiting in a sink's queue
+	SinkQueueDepth = NewGaugeVec(
+		"nomad_firehose_sink_queue_depth",
+		"Number of messages waiting in the sink queue.",
+		"firehose", "sink")
+
+	// NomadQueryDuration observes the duration of Nomad blocking queries
+	NomadQueryDuration = NewHistogramVec(
+		"nomad_firehose_nomad_query_duration_seconds",
+		"Duration of Nomad blocking queries.",
+		[]float64{.1, .5, 1, 5, 10, 30, 60, 120, 300, 600},
+		"firehose")
+
+	// NomadIndex reports the current WaitIndex (or event stream index) of a firehose
+	NomadIndex = NewGaugeVec(
+		"nomad_firehose_nomad_index",
+		"Current Nomad WaitIndex of the blocking query, or index of the event stream.",
+		"firehose")
+
+	// WorkerQueueDepth reports the number of objects waiting to be read from Nomad by the worker pool of a firehose
+	WorkerQueueDepth = NewGaugeVec(
+		"nomad_firehose_worker_queue_depth",
+		"Number of objects waiting to be read from Nomad by the worker pool.",
+		"firehose")
+
+	// UpdatesCollapsed counts updates dropped by the worker pool because a newer update of the same object was queued
+	UpdatesCollapsed = NewCounterVec(
+		"nomad_firehose_updates_collapsed_total",
+		"Number of updates superseded by a newer update of the same object before being read from Nomad.",
+		"firehose")
+
+	// NomadErrors counts failed Nomad queries
+	NomadErrors = NewCounterVec(
+		"nomad_firehose_nomad_errors_total",
+		"Number of failed Nomad queries.",
+		"firehose")
+
+	// Leader reports if the process holds the lock of a firehose type
+	Leader = NewGaugeVec(
+		"nomad_firehose_leader",
+		"1 if this process holds the lock for the firehose and is running it, 0 if it is on standby.",
+		"firehose")
+
+	// Checkpoint reports the last value written to the checkpoint
+	Checkpoint = NewGaugeVec(
+		"nomad_firehose_checkpoint",
+		"Last change time or index written to the checkpoint.",
+		"firehose")
+
+	// CheckpointErrors counts failed checkpoint writes
+	CheckpointErrors = NewCounterVec(
+		"nomad_firehose_checkpoint_write_errors_total",
+		"Number of failed checkpoint writes.",
+		"firehose")
+)
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultRegistry is the registry all metrics of the firehose are registered to, along with the
+// Go runtime and process metrics
+var DefaultRegistry = prometheus.NewRegistry()
+
+func init() {
+	DefaultRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler returns the HTTP handler serving the default registry
+func Handler() http.Handler {
+	return promhttp.HandlerFor(DefaultRegistry, promhttp.HandlerOpts{})
+}
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	vec *prometheus.CounterVec
+}
+
+// NewCounterVec creates a counter and registers it to the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	DefaultRegistry.MustRegister(vec)
+
+	return &CounterVec{vec: vec}
+}
+
+// Inc increments the counter for the label values by 1
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.vec.WithLabelValues(labelValues...).Inc()
+}
+
+// Add increments the counter for the label values by v
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	c.vec.WithLabelValues(labelValues...).Add(v)
+}
+
+// GaugeVec is a gauge partitioned by label values
+type GaugeVec struct {
+	vec  *prometheus.GaugeVec
+	desc *prometheus.Desc
+
+	lock  sync.Mutex
+	funcs map[string]*gaugeFuncs // functions added to the gauge by label values
+}
+
+// gaugeFuncs are the functions added to a gauge for a set of label values
+type gaugeFuncs struct {
+	labelValues []string
+	funcs       []func() float64
+}
+
+// NewGaugeVec creates a gauge and registers it to the default registry
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		vec:   prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels),
+		desc:  prometheus.NewDesc(name, help, labels, nil),
+		funcs: make(map[string]*gaugeFuncs),
+	}
+	DefaultRegistry.MustRegister(g)
+
+	return g
+}
+
+// Set the gauge for the label values to v
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.vec.WithLabelValues(labelValues...).Set(v)
+}
+
+// AddFunc adds f to the gauge for the label values, f is called every time the metrics are
+// collected and the gauge reports the sum of all functions added to it. The gauge must not
+// also be Set for the same label values
+func (g *GaugeVec) AddFunc(f func() float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	if g.funcs[key] == nil {
+		g.funcs[key] = &gaugeFuncs{labelValues: labelValues}
+	}
+	g.funcs[key].funcs = append(g.funcs[key].funcs, f)
+}
+
+// Describe implements prometheus.Collector
+func (g *GaugeVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+// Collect implements prometheus.Collector
+func (g *GaugeVec) Collect(ch chan<- prometheus.Metric) {
+	g.vec.Collect(ch)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, f := range g.funcs {
+		value := 0.0
+		for _, fn := range f.funcs {
+			value += fn()
+		}
+
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, value, f.labelValues...)
+	}
+}
+
+// HistogramVec is a histogram partitioned by label values
+type HistogramVec struct {
+	vec *prometheus.HistogramVec
+}
+
+// NewHistogramVec creates a histogram with the provided upper bounds and registers it to the default registry
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	DefaultRegistry.MustRegister(vec)
+
+	return &HistogramVec{vec: vec}
+}
+
+// Observe adds a single observation to the histogram for the label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.vec.WithLabelValues(labelValues...).Observe(v)
+}
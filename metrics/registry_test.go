@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandlerGolden(t *testing.T) {
+	counter := NewCounterVec("test_events_total", "Number of test events.", "firehose", "sink")
+	counter.Inc("jobs", "kafka")
+	counter.Add(2.5, "allocations", "kafka")
+	counter.Inc("nodes", "with \"quotes\", \\ and\nnewline")
+
+	gauge := NewGaugeVec("test_queue_depth", "Number of test messages queued.", "firehose")
+	gauge.Set(3, "jobs")
+	gauge.AddFunc(func() float64 { return 2 }, "allocations")
+	gauge.AddFunc(func() float64 { return 5 }, "allocations")
+	gauge.Set(math.Inf(1), "nodes")
+
+	unlabelled := NewGaugeVec("test_leader", "1 if leading.")
+	unlabelled.Set(1)
+
+	histogram := NewHistogramVec("test_latency_seconds", "Test latency.", []float64{.1, 1, 10}, "firehose")
+	histogram.Observe(.05, "jobs")
+	histogram.Observe(.1, "jobs")
+	histogram.Observe(.5, "jobs")
+	histogram.Observe(30, "jobs")
+
+	// Metrics without series are left out
+	NewCounterVec("test_unused_total", "Never incremented.", "firehose")
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("got Content-Type %q", got)
+	}
+
+	// The Go runtime and process metrics are served along with the firehose metrics
+	if !strings.Contains(rec.Body.String(), "\ngo_goroutines ") {
+		t.Error("expected the Go runtime metrics to be served")
+	}
+
+	// Only the test metrics are compared, the runtime metrics change between runs
+	names := []string{"test_events_total", "test_queue_depth", "test_leader", "test_latency_seconds", "test_unused_total"}
+
+	golden := filepath.Join("testdata", "metrics.golden")
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := testutil.GatherAndCompare(DefaultRegistry, bytes.NewReader(want), names...); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,612 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// avroNamespace prefixes the namespace of the records generated from Go types
+const avroNamespace = "io.nomad.firehose"
+
+// Kinds of Avro schemas generated from Go types, json is a string holding a value of any type as JSON
+const (
+	avroBoolean = "boolean"
+	avroLong    = "long"
+	avroDouble  = "double"
+	avroString  = "string"
+	avroBytes   = "bytes"
+	avroJSON    = "json"
+	avroArray   = "array"
+	avroMap     = "map"
+	avroRecord  = "record"
+)
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	marshalerType  = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// avroSchema is an Avro schema generated from a Go type, matching how encoding/json encodes it
+type avroSchema struct {
+	kind     string
+	nullable bool        // a union of null and the schema, for pointers, slices, maps and interfaces
+	items    *avroSchema // items of arrays and values of maps
+	record   *avroRecordSchema
+}
+
+// avroRecordSchema is an Avro record generated from a Go struct
+type avroRecordSchema struct {
+	name      string
+	namespace string
+	fields    []*avroField
+}
+
+// avroField is a field of an Avro record, named after its JSON name
+type avroField struct {
+	name     string // Avro name, the JSON name with the characters Avro doesn't allow replaced
+	jsonName string
+	schema   *avroSchema
+}
+
+// fullName returns the namespace qualified name of the record
+func (r *avroRecordSchema) fullName() string {
+	return r.namespace + "." + r.name
+}
+
+// AvroSchema is the Avro schema of the events of a firehose type and event type
+type AvroSchema struct {
+	Firehose string
+	Type     string
+	Name     string // full name of the top level record
+	Schema   string // JSON of the Avro schema
+
+	schema *avroSchema
+	codec  *goavro.Codec
+}
+
+var (
+	eventTypesLock sync.Mutex
+	eventTypes     = make(map[string]reflect.Type)
+	avroSchemas    = make(map[string]*AvroSchema)
+)
+
+// RegisterEventType registers the Go type of the events of a firehose type and event type (the
+// Type of their Metadata), so they can be encoded as Avro
+func RegisterEventType(firehose, eventType string, v interface{}) {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	eventTypesLock.Lock()
+	defer eventTypesLock.Unlock()
+
+	key := firehose + "/" + eventType
+	eventTypes[key] = t
+	delete(avroSchemas, key)
+}
+
+// GetAvroSchema returns the Avro schema of the events of a firehose type and event type
+func GetAvroSchema(firehose, eventType string) (*AvroSchema, error) {
+	eventTypesLock.Lock()
+	defer eventTypesLock.Unlock()
+
+	key := firehose + "/" + eventType
+	if schema, ok := avroSchemas[key]; ok {
+		return schema, nil
+	}
+
+	t, ok := eventTypes[key]
+	if !ok {
+		return nil, fmt.Errorf("No schema for %s events of type %q", firehose, eventType)
+	}
+
+	g := &avroGenerator{records: make(map[reflect.Type]*avroRecordSchema), names: make(map[string]bool)}
+	s := g.schema(t, "")
+	if s.kind != avroRecord {
+		return nil, fmt.Errorf("%s events of type %q are not structs", firehose, eventType)
+	}
+
+	// Events carry their ID as their first field, see NewEventMessage
+	s.record.fields = append([]*avroField{{name: "EventID", jsonName: "EventID", schema: &avroSchema{kind: avroString}}}, s.record.fields...)
+
+	b, err := json.Marshal(s.render(make(map[*avroRecordSchema]bool)))
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := goavro.NewCodec(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Avro schema of %s events of type %q: %s", firehose, eventType, err)
+	}
+
+	schema := &AvroSchema{
+		Firehose: firehose,
+		Type:     eventType,
+		Name:     s.record.fullName(),
+		Schema:   string(b),
+		schema:   s,
+		codec:    codec,
+	}
+	avroSchemas[key] = schema
+	return schema, nil
+}
+
+// AvroSchemas returns the Avro schemas of all the registered event types, sorted by firehose type and event type
+func AvroSchemas() ([]*AvroSchema, error) {
+	eventTypesLock.Lock()
+	keys := make([]string, 0, len(eventTypes))
+	for key := range eventTypes {
+		keys = append(keys, key)
+	}
+	eventTypesLock.Unlock()
+
+	sort.Strings(keys)
+
+	schemas := make([]*AvroSchema, 0, len(keys))
+	for _, key := range keys {
+		parts := strings.SplitN(key, "/", 2)
+		schema, err := GetAvroSchema(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schema)
+	}
+
+	return schemas, nil
+}
+
+// Encode encodes a JSON event as Avro binary data. Fields missing from the event are encoded as
+// their default, null or the zero value of their type, values of the wrong type are an error
+func (s *AvroSchema) Encode(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	native, err := s.schema.native(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.codec.BinaryFromNative(nil, native)
+}
+
+// avroGenerator generates Avro schemas from Go types, defining each record once
+type avroGenerator struct {
+	records map[reflect.Type]*avroRecordSchema
+	names   map[string]bool
+}
+
+// schema returns the schema of t, name is the name of the record of anonymous structs
+func (g *avroGenerator) schema(t reflect.Type, name string) *avroSchema {
+	switch {
+	case t == timeType:
+		return &avroSchema{kind: avroString}
+	case t == rawMessageType:
+		return &avroSchema{kind: avroJSON, nullable: true}
+	case t.Kind() != reflect.Ptr && t.Implements(marshalerType):
+		return &avroSchema{kind: avroJSON, nullable: true}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &avroSchema{kind: avroBoolean}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &avroSchema{kind: avroLong}
+	case reflect.Float32, reflect.Float64:
+		return &avroSchema{kind: avroDouble}
+	case reflect.String:
+		return &avroSchema{kind: avroString}
+	case reflect.Ptr:
+		s := *g.schema(t.Elem(), name)
+		s.nullable = true
+		return &s
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &avroSchema{kind: avroBytes, nullable: true}
+		}
+		return &avroSchema{kind: avroArray, nullable: true, items: g.schema(t.Elem(), name+"Item")}
+	case reflect.Array:
+		return &avroSchema{kind: avroArray, items: g.schema(t.Elem(), name+"Item")}
+	case reflect.Map:
+		return &avroSchema{kind: avroMap, nullable: true, items: g.schema(t.Elem(), name+"Value")}
+	case reflect.Struct:
+		return &avroSchema{kind: avroRecord, record: g.record(t, name)}
+	default:
+		return &avroSchema{kind: avroJSON, nullable: true}
+	}
+}
+
+// record returns the record of a struct, its fields are the fields encoding/json encodes
+func (g *avroGenerator) record(t reflect.Type, name string) *avroRecordSchema {
+	if r, ok := g.records[t]; ok {
+		return r
+	}
+
+	namespace := avroNamespace
+	if t.PkgPath() != "" {
+		namespace += "." + avroName(path.Base(t.PkgPath()))
+	}
+	if t.Name() != "" {
+		name = t.Name()
+	}
+	name = avroName(name)
+
+	// Anonymous structs are named after the field holding them, which may clash
+	unique := name
+	for i := 2; g.names[namespace+"."+unique]; i++ {
+		unique = name + strconv.Itoa(i)
+	}
+	g.names[namespace+"."+unique] = true
+
+	r := &avroRecordSchema{name: unique, namespace: namespace}
+	g.records[t] = r
+
+	for _, f := range jsonFields(t) {
+		r.fields = append(r.fields, &avroField{
+			name:     avroName(f.name),
+			jsonName: f.name,
+			schema:   g.schema(f.typ, unique+strings.Title(avroName(f.name))),
+		})
+	}
+
+	return r
+}
+
+// jsonField is a field of a struct as encoding/json sees it
+type jsonField struct {
+	name   string
+	typ    reflect.Type
+	depth  int
+	tagged bool
+}
+
+// jsonFields returns the fields encoding/json encodes for a struct, with the fields of embedded
+// structs promoted, in order
+func jsonFields(t reflect.Type) []jsonField {
+	fields := collectJSONFields(t, 0, map[reflect.Type]bool{t: true})
+
+	byName := make(map[string][]jsonField)
+	for _, f := range fields {
+		byName[f.name] = append(byName[f.name], f)
+	}
+
+	result := make([]jsonField, 0, len(fields))
+	for _, f := range fields {
+		if dominant, ok := dominantJSONField(byName[f.name]); ok && dominant == f {
+			result = append(result, f)
+		}
+	}
+
+	return result
+}
+
+func collectJSONFields(t reflect.Type, depth int, visited map[reflect.Type]bool) []jsonField {
+	fields := make([]jsonField, 0, t.NumField())
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		if sf.Anonymous {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+
+			if name == "" && ft.Kind() == reflect.Struct {
+				if !visited[ft] {
+					visited[ft] = true
+					fields = append(fields, collectJSONFields(ft, depth+1, visited)...)
+					delete(visited, ft)
+				}
+				continue
+			}
+		}
+
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		tagged := name != ""
+		if !tagged {
+			name = sf.Name
+		}
+
+		fields = append(fields, jsonField{name: name, typ: sf.Type, depth: depth, tagged: tagged})
+	}
+
+	return fields
+}
+
+// dominantJSONField returns the field encoding/json encodes among fields with the same name: the
+// shallowest one, or the tagged one among the shallowest. None is encoded if it is ambiguous
+func dominantJSONField(fields []jsonField) (jsonField, bool) {
+	depth := fields[0].depth
+	for _, f := range fields {
+		if f.depth < depth {
+			depth = f.depth
+		}
+	}
+
+	var shallowest, tagged []jsonField
+	for _, f := range fields {
+		if f.depth != depth {
+			continue
+		}
+		shallowest = append(shallowest, f)
+		if f.tagged {
+			tagged = append(tagged, f)
+		}
+	}
+
+	switch {
+	case len(shallowest) == 1:
+		return shallowest[0], true
+	case len(tagged) == 1:
+		return tagged[0], true
+	default:
+		return jsonField{}, false
+	}
+}
+
+// avroName replaces the characters Avro doesn't allow in names with underscores
+func avroName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !(i > 0 && '0' <= c && c <= '9') {
+			b[i] = '_'
+		}
+	}
+
+	if len(b) == 0 {
+		return "_"
+	}
+
+	return string(b)
+}
+
+// render returns the schema in the Avro schema JSON format, records already defined are referred to by name
+func (s *avroSchema) render(defined map[*avroRecordSchema]bool) interface{} {
+	var v interface{}
+
+	switch s.kind {
+	case avroJSON:
+		v = avroString
+	case avroArray:
+		v = map[string]interface{}{"type": avroArray, "items": s.items.render(defined)}
+	case avroMap:
+		v = map[string]interface{}{"type": avroMap, "values": s.items.render(defined)}
+	case avroRecord:
+		v = s.record.render(defined)
+	default:
+		v = s.kind
+	}
+
+	if s.nullable {
+		return []interface{}{"null", v}
+	}
+
+	return v
+}
+
+func (r *avroRecordSchema) render(defined map[*avroRecordSchema]bool) interface{} {
+	if defined[r] {
+		return r.fullName()
+	}
+	defined[r] = true
+
+	fields := make([]interface{}, 0, len(r.fields))
+	for _, f := range r.fields {
+		field := map[string]interface{}{"name": f.name, "type": f.schema.render(defined)}
+		if f.jsonName != f.name {
+			field["doc"] = "JSON field " + f.jsonName
+		}
+		if d, ok := f.schema.zero(); ok {
+			field["default"] = d
+		}
+		fields = append(fields, field)
+	}
+
+	return map[string]interface{}{
+		"type":      avroRecord,
+		"name":      r.name,
+		"namespace": r.namespace,
+		"fields":    fields,
+	}
+}
+
+// zero returns the default value of fields of the schema
+func (s *avroSchema) zero() (interface{}, bool) {
+	if s.nullable {
+		return nil, true
+	}
+
+	switch s.kind {
+	case avroBoolean:
+		return false, true
+	case avroLong, avroDouble:
+		return 0, true
+	case avroString, avroJSON, avroBytes:
+		return "", true
+	case avroArray:
+		return []interface{}{}, true
+	case avroMap:
+		return map[string]interface{}{}, true
+	case avroRecord:
+		fields := make(map[string]interface{}, len(s.record.fields))
+		for _, f := range s.record.fields {
+			d, ok := f.schema.zero()
+			if !ok {
+				return nil, false
+			}
+			fields[f.name] = d
+		}
+		return fields, true
+	default:
+		return nil, false
+	}
+}
+
+// native converts v, a value decoded from JSON, to the value goavro encodes with the schema.
+// Record fields missing from v are left out, so goavro encodes their default
+func (s *avroSchema) native(v interface{}) (interface{}, error) {
+	if s.nullable && v == nil {
+		return nil, nil
+	}
+
+	value, err := s.nativeValue(v)
+	if err != nil || !s.nullable {
+		return value, err
+	}
+
+	return goavro.Union(s.unionName(), value), nil
+}
+
+// unionName returns the name of the schema in the union of a nullable schema
+func (s *avroSchema) unionName() string {
+	switch s.kind {
+	case avroJSON:
+		return avroString
+	case avroRecord:
+		return s.record.fullName()
+	default:
+		return s.kind
+	}
+}
+
+func (s *avroSchema) nativeValue(v interface{}) (interface{}, error) {
+	switch s.kind {
+	case avroBoolean:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("Expected a boolean, got %T", v)
+		}
+		return b, nil
+
+	case avroLong:
+		return avroLongValue(v)
+
+	case avroDouble:
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("Expected a number, got %T", v)
+		}
+		return n.Float64()
+
+	case avroString:
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("Expected a string, got %T", v)
+		}
+		return str, nil
+
+	case avroJSON:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+
+	case avroBytes:
+		// encoding/json encodes []byte as base64
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("Expected a base64 string, got %T", v)
+		}
+		return base64.StdEncoding.DecodeString(str)
+
+	case avroArray:
+		items, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Expected an array, got %T", v)
+		}
+
+		native := make([]interface{}, len(items))
+		for i, item := range items {
+			var err error
+			if native[i], err = s.items.native(item); err != nil {
+				return nil, fmt.Errorf("%d: %s", i, err)
+			}
+		}
+		return native, nil
+
+	case avroMap:
+		values, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Expected an object, got %T", v)
+		}
+
+		native := make(map[string]interface{}, len(values))
+		for key, value := range values {
+			var err error
+			if native[key], err = s.items.native(value); err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err)
+			}
+		}
+		return native, nil
+
+	case avroRecord:
+		values, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Expected an object, got %T", v)
+		}
+
+		native := make(map[string]interface{}, len(s.record.fields))
+		for _, f := range s.record.fields {
+			value, ok := values[f.jsonName]
+			if !ok {
+				continue
+			}
+
+			var err error
+			if native[f.name], err = f.schema.native(value); err != nil {
+				return nil, fmt.Errorf("%s: %s", f.jsonName, err)
+			}
+		}
+		return native, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown Avro schema kind %s", s.kind)
+	}
+}
+
+// avroLongValue returns the integer of a JSON number, uint64 above the int64 range wrap around
+func avroLongValue(v interface{}) (int64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("Expected a number, got %T", v)
+	}
+
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+
+	if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+		return int64(u), nil
+	}
+
+	return 0, fmt.Errorf("Expected an integer, got %s", n)
+}
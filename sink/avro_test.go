@@ -0,0 +1,204 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+)
+
+type avroTestLong struct {
+	N int64
+}
+
+func TestAvroEncodeLong(t *testing.T) {
+	RegisterEventType("test", "long", avroTestLong{})
+
+	schema, err := GetAvroSchema("test", "long")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		n        string
+		expected []byte
+	}{
+		{"0", []byte{0x00}},
+		{"-1", []byte{0x01}},
+		{"1", []byte{0x02}},
+		{"-64", []byte{0x7f}},
+		{"64", []byte{0x80, 0x01}},
+		{strconv.FormatInt(math.MaxInt64, 10), []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{strconv.FormatInt(math.MinInt64, 10), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{strconv.FormatUint(math.MaxUint64, 10), []byte{0x01}}, // wraps around to -1
+	}
+
+	for _, test := range tests {
+		data, err := schema.Encode([]byte(`{"EventID":"","N":` + test.n + `}`))
+		if err != nil {
+			t.Errorf("%s: %s", test.n, err)
+			continue
+		}
+
+		// The empty EventID comes first
+		expected := append([]byte{0x00}, test.expected...)
+		if !bytes.Equal(data, expected) {
+			t.Errorf("%s: expected % x, got % x", test.n, expected, data)
+		}
+	}
+}
+
+type avroTestChild struct {
+	Name string
+}
+
+type avroTestEvent struct {
+	Count   *int64
+	Tags    []string
+	Meta    map[string]int
+	Child   avroTestChild
+	Parent  *avroTestChild
+	Enabled bool
+	Ratio   float64
+	Renamed string `json:"renamed-field"`
+	Ignored string `json:"-"`
+}
+
+func avroTestSchema(t *testing.T) *AvroSchema {
+	RegisterEventType("test", "updated", avroTestEvent{})
+
+	schema, err := GetAvroSchema("test", "updated")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return schema
+}
+
+func TestAvroSchema(t *testing.T) {
+	schema := avroTestSchema(t)
+
+	if schema.Name != "io.nomad.firehose.sink.avroTestEvent" {
+		t.Errorf("unexpected record name %s", schema.Name)
+	}
+
+	var record struct {
+		Fields []struct {
+			Name string
+			Type interface{}
+		}
+	}
+	if err := json.Unmarshal([]byte(schema.Schema), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, len(record.Fields))
+	for _, f := range record.Fields {
+		names = append(names, f.Name)
+	}
+
+	expected := []string{"EventID", "Count", "Tags", "Meta", "Child", "Parent", "Enabled", "Ratio", "renamed_field"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected fields %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("expected fields %v, got %v", expected, names)
+		}
+	}
+
+	// Parent refers to the record defined by Child
+	if parent, _ := json.Marshal(record.Fields[5].Type); string(parent) != `["null","io.nomad.firehose.sink.avroTestChild"]` {
+		t.Errorf("unexpected type of Parent %s", parent)
+	}
+}
+
+func TestAvroEncode(t *testing.T) {
+	schema := avroTestSchema(t)
+
+	tests := []struct {
+		name     string
+		event    string
+		expected []byte
+	}{
+		{
+			name:  "zero values and nulls",
+			event: `{"EventID":"","Count":null,"Tags":null,"Meta":null,"Child":{"Name":""},"Parent":null,"Enabled":false,"Ratio":0}`,
+			expected: []byte{
+				0x00,                   // EventID ""
+				0x00,                   // Count null
+				0x00,                   // Tags null
+				0x00,                   // Meta null
+				0x00,                   // Child.Name ""
+				0x00,                   // Parent null
+				0x00,                   // Enabled false
+				0, 0, 0, 0, 0, 0, 0, 0, // Ratio 0
+				0x00, // renamed-field ""
+			},
+		},
+		{
+			name:  "values",
+			event: `{"EventID":"id","Count":-3,"Tags":["a","b"],"Meta":{"k":1},"Child":{"Name":"c"},"Parent":{"Name":"p"},"Enabled":true,"Ratio":1.5,"renamed-field":"r"}`,
+			expected: []byte{
+				0x04, 'i', 'd', // EventID
+				0x02, 0x05, // Count: union branch 1, -3
+				0x02, 0x04, 0x02, 'a', 0x02, 'b', 0x00, // Tags: union branch 1, block of 2 items, end
+				0x02, 0x02, 0x02, 'k', 0x02, 0x00, // Meta: union branch 1, block of 1 entry, end
+				0x02, 'c', // Child.Name
+				0x02, 0x02, 'p', // Parent: union branch 1, Name
+				0x01,                                           // Enabled
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf8, 0x3f, // Ratio 1.5
+				0x02, 'r', // renamed-field
+			},
+		},
+		{
+			name:     "missing fields",
+			event:    `{"Tags":[]}`,
+			expected: []byte{0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0x00},
+		},
+	}
+
+	for _, test := range tests {
+		data, err := schema.Encode([]byte(test.event))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if !bytes.Equal(data, test.expected) {
+			t.Errorf("%s: expected % x, got % x", test.name, test.expected, data)
+		}
+	}
+}
+
+func TestAvroEncodeTypeMismatch(t *testing.T) {
+	schema := avroTestSchema(t)
+
+	tests := []struct {
+		name  string
+		event string
+	}{
+		{"string as a long", `{"Count":"three"}`},
+		{"float as a long", `{"Count":1.5}`},
+		{"string as a boolean", `{"Enabled":"true"}`},
+		{"null as a boolean", `{"Enabled":null,"Child":{"Name":""}}`},
+		{"string as a double", `{"Ratio":"1.5"}`},
+		{"number as a string", `{"Child":{"Name":1}}`},
+		{"object as an array", `{"Tags":{}}`},
+		{"number in an array of strings", `{"Tags":["a",1]}`},
+		{"string in a map of longs", `{"Meta":{"k":"v"}}`},
+	}
+
+	for _, test := range tests {
+		if _, err := schema.Encode([]byte(test.event)); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestAvroSchemaUnknownType(t *testing.T) {
+	if _, err := GetAvroSchema("test", "unknown"); err == nil {
+		t.Error("expected an error for an unregistered event type")
+	}
+}
@@ -0,0 +1,173 @@
+package sink
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CloudEventsStructured encodes events as JSON CloudEvents, attributes and data together
+	CloudEventsStructured = "structured"
+
+	// CloudEventsBinary sends the event as-is, with the CloudEvents attributes as native headers
+	CloudEventsBinary = "binary"
+
+	// cloudEventsContentType is the media type of structured mode CloudEvents
+	cloudEventsContentType = "application/cloudevents+json"
+)
+
+// cloudEventsOptions configure the CloudEvents encoding of every firehose type
+type cloudEventsOptions struct {
+	mode   string
+	source string
+}
+
+// cloudEvents is nil if events are not encoded as CloudEvents
+var cloudEvents *cloudEventsOptions
+
+// ConfigureCloudEvents encodes events as CloudEvents 1.0 in the structured or binary mode, with
+// source as their source, an empty mode disables CloudEvents
+func ConfigureCloudEvents(mode, source string) error {
+	switch mode {
+	case "":
+		cloudEvents = nil
+		return nil
+	case CloudEventsStructured, CloudEventsBinary:
+	default:
+		return fmt.Errorf("Invalid CloudEvents mode %q, expected structured or binary", mode)
+	}
+
+	if envelope != nil {
+		return fmt.Errorf("The envelope and CloudEvents can't be used together")
+	}
+
+	if source == "" {
+		return fmt.Errorf("Missing CloudEvents source")
+	}
+
+	cloudEvents = &cloudEventsOptions{mode: mode, source: source}
+	return nil
+}
+
+// supportsCloudEvents returns an error if the sink type can't send events in the configured
+// CloudEvents mode, as binary mode needs native headers
+func supportsCloudEvents(sinkType string) error {
+	if cloudEvents == nil || cloudEvents.mode != CloudEventsBinary {
+		return nil
+	}
+
+	switch sinkType {
+	case "amqp", "rabbitmq", "http", "kafka":
+		return nil
+	default:
+		return fmt.Errorf("The %s sink can't send binary CloudEvents, use the structured mode", sinkType)
+	}
+}
+
+// CloudEventsSink encodes the events of a firehose type as CloudEvents before they reach the wrapped sink
+type CloudEventsSink struct {
+	sink Sink
+	kind string
+}
+
+// NewCloudEventsSink wraps s with the CloudEvents encoding, s is returned as-is if CloudEvents are disabled
+func NewCloudEventsSink(s Sink, firehose string) Sink {
+	if cloudEvents == nil {
+		return s
+	}
+
+	return &CloudEventsSink{
+		sink: s,
+		kind: eventKind(firehose),
+	}
+}
+
+// Start ...
+func (s *CloudEventsSink) Start() error {
+	return s.sink.Start()
+}
+
+// Stop ...
+func (s *CloudEventsSink) Stop() {
+	s.sink.Stop()
+}
+
+// Put ..
+func (s *CloudEventsSink) Put(message *Message) error {
+	m := *message
+	m.Attributes = s.attributes(message)
+
+	// Templates may render events as anything
+	contentType := "application/json"
+	if !json.Valid(message.Data) {
+		contentType = "text/plain"
+	}
+
+	if cloudEvents.mode == CloudEventsBinary {
+		m.ContentType = contentType
+		return s.sink.Put(&m)
+	}
+
+	event := make(map[string]interface{}, len(m.Attributes)+2)
+	for name, value := range m.Attributes {
+		event[name] = value
+	}
+	event["datacontenttype"] = contentType
+	if contentType == "application/json" {
+		event["data"] = json.RawMessage(message.Data)
+	} else {
+		event["data"] = string(message.Data)
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		// Retrying won't help, so drop the event rather than holding back the checkpoint forever
+		log.Errorf("[sink/cloudevents] Could not encode event as a CloudEvent, dropping it: %s", err)
+		message.Ack(nil)
+		return nil
+	}
+
+	m.Data = b
+	m.ContentType = cloudEventsContentType
+	m.Attributes = nil
+	return s.sink.Put(&m)
+}
+
+// attributes returns the CloudEvents attributes of a message, the Nomad region and index are
+// added as the nomadregion and nomadindex extensions
+func (s *CloudEventsSink) attributes(message *Message) map[string]string {
+	id := message.ID
+	if id == "" {
+		sum := sha256.Sum256(message.Data)
+		id = hex.EncodeToString(sum[:])
+	}
+
+	eventType := "io.nomad." + s.kind
+	if message.Type != "" {
+		eventType += "." + message.Type
+	}
+
+	attributes := map[string]string{
+		"specversion": "1.0",
+		"id":          id,
+		"source":      cloudEvents.source,
+		"type":        eventType,
+		"time":        time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	if message.Region != "" {
+		attributes["nomadregion"] = message.Region
+	}
+
+	if message.Index != 0 {
+		attributes["nomadindex"] = strconv.FormatUint(message.Index, 10)
+	}
+
+	return attributes
+}
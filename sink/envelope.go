@@ -0,0 +1,131 @@
+package sink
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SchemaVersion is the version of the event schemas, bumped on breaking changes of the payloads
+const SchemaVersion = 1
+
+// Envelope wraps the payload of an event with metadata, so consumers of a topic shared by several
+// firehose types can tell events apart
+type Envelope struct {
+	ID            string          `json:"id,omitempty"`
+	Type          string          `json:"type"`
+	Cluster       string          `json:"cluster,omitempty"`
+	Region        string          `json:"region,omitempty"`
+	Index         uint64          `json:"index,omitempty"`
+	EmittedAt     time.Time       `json:"emitted_at"`
+	SchemaVersion int             `json:"schema_version"`
+	InstanceID    string          `json:"instance_id,omitempty"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// envelopeOptions annotate the envelopes of every firehose type
+type envelopeOptions struct {
+	cluster    string
+	instanceID string
+}
+
+// envelope is nil if events are not wrapped in an envelope
+var envelope *envelopeOptions
+
+// eventKinds is the kind of the events of each firehose type, if it differs from the firehose type
+var eventKinds = map[string]string{
+	"allocations": "allocation",
+	"nodes":       "node",
+	"evaluations": "evaluation",
+	"jobs":        "job",
+	"deployments": "deployment",
+	"volumes":     "volume",
+	"services":    "service",
+}
+
+// eventKind returns the kind of the events of a firehose type, e.g. allocation for allocations
+func eventKind(firehose string) string {
+	if kind, ok := eventKinds[firehose]; ok {
+		return kind
+	}
+
+	return firehose
+}
+
+// ConfigureEnvelope wraps events in an Envelope if enabled, annotated with the cluster name and
+// the instance ID, which defaults to the hostname
+func ConfigureEnvelope(enabled bool, cluster, instanceID string) {
+	if !enabled {
+		envelope = nil
+		return
+	}
+
+	if instanceID == "" {
+		instanceID, _ = os.Hostname()
+	}
+
+	envelope = &envelopeOptions{cluster: cluster, instanceID: instanceID}
+}
+
+// EnvelopeSink wraps the events of a firehose type in an Envelope before they reach the wrapped sink
+type EnvelopeSink struct {
+	sink      Sink
+	eventType string
+}
+
+// NewEnvelopeSink wraps s with the envelope, s is returned as-is if the envelope is disabled
+func NewEnvelopeSink(s Sink, firehose string) Sink {
+	if envelope == nil {
+		return s
+	}
+
+	return &EnvelopeSink{
+		sink:      s,
+		eventType: eventKind(firehose),
+	}
+}
+
+// Start ...
+func (s *EnvelopeSink) Start() error {
+	return s.sink.Start()
+}
+
+// Stop ...
+func (s *EnvelopeSink) Stop() {
+	s.sink.Stop()
+}
+
+// Put ..
+func (s *EnvelopeSink) Put(message *Message) error {
+	data := json.RawMessage(message.Data)
+
+	// Templates may render events as anything, which is then sent as a JSON string
+	if !json.Valid(data) {
+		data, _ = json.Marshal(strings.TrimSpace(string(message.Data)))
+	}
+
+	b, err := json.Marshal(&Envelope{
+		ID:            message.ID,
+		Type:          s.eventType,
+		Cluster:       envelope.cluster,
+		Region:        message.Region,
+		Index:         message.Index,
+		EmittedAt:     time.Now().UTC(),
+		SchemaVersion: SchemaVersion,
+		InstanceID:    envelope.instanceID,
+		Data:          data,
+	})
+	if err != nil {
+		// Retrying won't help, so drop the event rather than holding back the checkpoint forever
+		log.Errorf("[sink/envelope] Could not wrap event in an envelope, dropping it: %s", err)
+		message.Ack(nil)
+		return nil
+	}
+
+	m := *message
+	m.Data = b
+	return s.sink.Put(&m)
+}
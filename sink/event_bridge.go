@@ -19,8 +19,8 @@ type EBSink struct {
 	detailType  string
 	source      string
 	stopCh      chan interface{}
-	putCh       chan []byte
-	batchCh     chan [][]byte
+	putCh       chan *Message
+	batchCh     chan []*Message
 }
 
 // New Event Bus ...
@@ -53,8 +53,8 @@ func NewEventBus() (*EBSink, error) {
 		detailType:  detailType,
 		source:      ebSource,
 		stopCh:      make(chan interface{}),
-		putCh:       make(chan []byte, 1000),
-		batchCh:     make(chan [][]byte, 100),
+		putCh:       make(chan *Message, 1000),
+		batchCh:     make(chan []*Message, 100),
 	}, nil
 }
 
@@ -91,24 +91,29 @@ func (s *EBSink) Stop() {
 }
 
 // Put ..
-func (s *EBSink) Put(data []byte) error {
-	s.putCh <- data
+func (s *EBSink) Put(message *Message) error {
+	s.putCh <- message
 
 	return nil
 }
 
+// QueueDepth returns the number of messages waiting to be written
+func (s *EBSink) QueueDepth() int {
+	return len(s.putCh)
+}
+
 func (s *EBSink) batch() {
-	buffer := make([][]byte, 0)
+	buffer := make([]*Message, 0)
 	ticker := time.NewTicker(1 * time.Second)
 
 	for {
 		select {
-		case data := <-s.putCh:
-			buffer = append(buffer, data)
+		case message := <-s.putCh:
+			buffer = append(buffer, message)
 
 			if len(buffer) == 10 {
 				s.batchCh <- buffer
-				buffer = make([][]byte, 0)
+				buffer = make([]*Message, 0)
 			}
 
 		case _ = <-ticker.C:
@@ -119,7 +124,7 @@ func (s *EBSink) batch() {
 
 			if len(buffer) > 0 {
 				s.batchCh <- buffer
-				buffer = make([][]byte, 0)
+				buffer = make([]*Message, 0)
 			}
 		}
 	}
@@ -133,10 +138,10 @@ func (s *EBSink) write() {
 		case batch := <-s.batchCh:
 			entries := make([]*eventbridge.PutEventsRequestEntry, 0)
 
-			for _, data := range batch {
+			for _, message := range batch {
 				entry := &eventbridge.PutEventsRequestEntry{
 					EventBusName: aws.String(s.busName),
-					Detail:       aws.String(string(data)),
+					Detail:       aws.String(string(message.Data)),
 					DetailType:   aws.String(s.detailType),
 					Source:       aws.String(s.source),
 				}
@@ -144,25 +149,48 @@ func (s *EBSink) write() {
 				entries = append(entries, entry)
 			}
 
-			err := s.sendBatch(entries)
+			failed, err := s.sendBatch(entries)
 
 			if err != nil {
 				log.Errorf("[sink/eventbridge] %s", err)
 			} else {
-				log.Infof("[sink/eventbridge] queued %d messages", len(batch))
+				log.Infof("[sink/eventbridge] queued %d messages", len(batch)-len(failed))
+			}
+
+			for i, message := range batch {
+				if err != nil {
+					message.Ack(err)
+					continue
+				}
+
+				if entryErr, ok := failed[i]; ok {
+					log.Errorf("[sink/eventbridge] Failed to queue %d: %s", i, entryErr)
+					message.Ack(entryErr)
+					continue
+				}
+
+				message.Ack(nil)
 			}
 		}
 	}
 }
 
-func (s *EBSink) sendBatch(entries []*eventbridge.PutEventsRequestEntry) error {
-	req, _ := s.eventbridge.PutEventsRequest(&eventbridge.PutEventsInput{
+// sendBatch sends the entries to Event Bridge, and returns the error for every entry (by position) it did not accept
+func (s *EBSink) sendBatch(entries []*eventbridge.PutEventsRequestEntry) (map[int]error, error) {
+	req, output := s.eventbridge.PutEventsRequest(&eventbridge.PutEventsInput{
 		Entries: entries,
 	})
 	err := req.Send()
-	if err == nil {
-		return err
+	if err != nil {
+		return nil, err
+	}
+
+	failed := make(map[int]error)
+	for i, entry := range output.Entries {
+		if entry.ErrorCode != nil {
+			failed[i] = fmt.Errorf("%s: %s", aws.StringValue(entry.ErrorCode), aws.StringValue(entry.ErrorMessage))
+		}
 	}
 
-	return err
+	return failed, nil
 }
@@ -0,0 +1,225 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seatgeek/nomad-firehose/filter"
+	"github.com/seatgeek/nomad-firehose/health"
+	"github.com/seatgeek/nomad-firehose/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFanoutQueueSize      = 10000
+	defaultFanoutEnqueueTimeout = 30 * time.Second
+)
+
+// FanoutSink writes every message to several sinks, each with its own filter, queue and retries,
+// so a slow or failing sink never holds back the others
+type FanoutSink struct {
+	firehose       string
+	routes         []*route
+	enqueueTimeout time.Duration // how long Put waits for room in a full queue
+	stopCh         chan interface{}
+}
+
+// route is one of the sinks of a FanoutSink
+type route struct {
+	sinkType string
+	sink     Sink
+	filter   *filter.Filter
+	queue    chan *Message
+}
+
+// NewFanoutSink creates the sinks listed in sinkTypes, each wrapped like GetSink does
+//
+// SINK_<TYPE>_FILTER and SINK_<TYPE>_FILTER_EXCLUDE set the expressions a message must
+// (not) match to be written to the sink of that type
+func NewFanoutSink(resourceName string, sinkTypes []string) (*FanoutSink, error) {
+	queueSize := defaultFanoutQueueSize
+	if v := os.Getenv("SINK_FANOUT_QUEUE_SIZE"); v != "" {
+		var err error
+		if queueSize, err = strconv.Atoi(v); err != nil || queueSize < 1 {
+			return nil, fmt.Errorf("[sink/fanout] Invalid SINK_FANOUT_QUEUE_SIZE: %s", v)
+		}
+	}
+
+	enqueueTimeout := defaultFanoutEnqueueTimeout
+	if v := os.Getenv("SINK_FANOUT_ENQUEUE_TIMEOUT"); v != "" {
+		var err error
+		if enqueueTimeout, err = time.ParseDuration(v); err != nil || enqueueTimeout <= 0 {
+			return nil, fmt.Errorf("[sink/fanout] Invalid SINK_FANOUT_ENQUEUE_TIMEOUT: %s", v)
+		}
+	}
+
+	s := &FanoutSink{
+		firehose:       resourceName,
+		enqueueTimeout: enqueueTimeout,
+		stopCh:         make(chan interface{}),
+	}
+
+	for _, sinkType := range sinkTypes {
+		prefix := "SINK_" + strings.ToUpper(sinkType) + "_"
+
+		var rules filter.Rules
+		if v := os.Getenv(prefix + "FILTER"); v != "" {
+			rules.Include = append(rules.Include, v)
+		}
+		if v := os.Getenv(prefix + "FILTER_EXCLUDE"); v != "" {
+			rules.Exclude = append(rules.Exclude, v)
+		}
+
+		f, err := filter.New(rules)
+		if err != nil {
+			return nil, fmt.Errorf("[sink/fanout] %s: %s", sinkType, err)
+		}
+
+		child, err := newSink(resourceName, sinkType)
+		if err != nil {
+			return nil, err
+		}
+
+		s.routes = append(s.routes, &route{
+			sinkType: sinkType,
+			sink:     NewRetrySink(NewInstrumentedSink(child, resourceName, sinkType)),
+			filter:   f,
+			queue:    make(chan *Message, queueSize),
+		})
+	}
+
+	return s, nil
+}
+
+// Start ...
+func (s *FanoutSink) Start() error {
+	// Stop chan for all routes to depend on
+	s.stopCh = make(chan interface{})
+
+	errCh := make(chan error, len(s.routes))
+	for _, r := range s.routes {
+		go r.forward(s.stopCh)
+		go func(r *route) {
+			errCh <- r.sink.Start()
+		}(r)
+	}
+
+	for range s.routes {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stop ...
+func (s *FanoutSink) Stop() {
+	close(s.stopCh)
+
+	for _, r := range s.routes {
+		r.sink.Stop()
+	}
+}
+
+// Put the message on the queue of every sink whose filter it matches, it is acknowledged
+// once all of them have acknowledged it. Filters match the event before it was transformed or
+// wrapped
+func (s *FanoutSink) Put(message *Message) error {
+	data := message.Event
+	if data == nil {
+		data = message.Data
+	}
+
+	var event interface{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		// Not JSON, filters can't apply
+		event = nil
+	}
+
+	routes := make([]*route, 0, len(s.routes))
+	for _, r := range s.routes {
+		if event == nil || r.filter.MatchValue(event) {
+			routes = append(routes, r)
+		}
+	}
+
+	if len(routes) == 0 {
+		metrics.EventsFiltered.Inc(s.firehose)
+		message.Ack(nil)
+		return nil
+	}
+
+	ack := AckAll(message.Ack, len(routes))
+
+	// Queue the message for the sinks with room first, so they don't wait for a full queue
+	full := make([]*route, 0)
+	for _, r := range routes {
+		select {
+		case r.queue <- message.withAck(ack):
+		default:
+			full = append(full, r)
+		}
+	}
+
+	if len(full) == 0 {
+		return nil
+	}
+
+	// Slow down the firehose until the full queues have room, a sink whose queue stays full
+	// for the whole timeout is stuck: its share fails so the checkpoint doesn't move past the
+	// message
+	expired := make(chan struct{})
+	timer := time.AfterFunc(s.enqueueTimeout, func() { close(expired) })
+	defer timer.Stop()
+
+	for _, r := range full {
+		select {
+		case r.queue <- message.withAck(ack):
+		case <-expired:
+			s.drop(r, ack, fmt.Errorf("[sink/fanout] %s queue is full", r.sinkType))
+		case <-s.stopCh:
+			s.drop(r, ack, fmt.Errorf("[sink/fanout] stopped"))
+		}
+	}
+
+	return nil
+}
+
+// drop fails the share of a message of a route it could not be queued for
+func (s *FanoutSink) drop(r *route, ack AckFunc, err error) {
+	log.Errorf("[sink/fanout] Could not queue message for %s, dropping it: %s", r.sinkType, err)
+	metrics.SinkDropped.Inc(s.firehose, r.sinkType, "queue_full")
+	health.SinkDropped(s.firehose+"/"+r.sinkType, err)
+	ack(err)
+}
+
+// QueueDepth returns the number of messages waiting in the fan-out queues
+func (s *FanoutSink) QueueDepth() int {
+	depth := 0
+	for _, r := range s.routes {
+		depth += len(r.queue)
+	}
+
+	return depth
+}
+
+// forward messages from the queue to the sink until stopCh is closed
+func (r *route) forward(stopCh chan interface{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+
+		case message := <-r.queue:
+			if err := r.sink.Put(message); err != nil {
+				log.Errorf("[sink/fanout] Could not put message on %s: %s", r.sinkType, err)
+				message.Ack(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package sink
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/seatgeek/nomad-firehose/filter"
+	"github.com/seatgeek/nomad-firehose/health"
+)
+
+// testSink records the messages put on it, and acknowledges them unless it is stuck
+type testSink struct {
+	lock     sync.Mutex
+	messages []*Message
+	stuck    chan struct{}
+}
+
+func (s *testSink) Start() error { return nil }
+func (s *testSink) Stop()        {}
+
+func (s *testSink) Put(message *Message) error {
+	if s.stuck != nil {
+		<-s.stuck
+	}
+
+	s.lock.Lock()
+	s.messages = append(s.messages, message)
+	s.lock.Unlock()
+
+	message.Ack(nil)
+	return nil
+}
+
+func (s *testSink) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.messages)
+}
+
+func testRoute(t *testing.T, sinkType string, s Sink, queueSize int) *route {
+	f, err := filter.New(filter.Rules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &route{sinkType: sinkType, sink: s, filter: f, queue: make(chan *Message, queueSize)}
+}
+
+func TestFanoutSinkStuckRoute(t *testing.T) {
+	stuck := &testSink{stuck: make(chan struct{})}
+	defer close(stuck.stuck)
+	healthy := &testSink{}
+
+	s := &FanoutSink{
+		firehose:       "test",
+		routes:         []*route{testRoute(t, "stuck", stuck, 1), testRoute(t, "healthy", healthy, 100)},
+		enqueueTimeout: 10 * time.Millisecond,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 10
+	acks := make(chan error, n)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			s.Put(NewMessage([]byte(`{"i":1}`), func(err error) { acks <- err }))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Put blocked on the stuck route")
+	}
+
+	deadline := time.After(5 * time.Second)
+	for healthy.count() < n {
+		select {
+		case <-deadline:
+			t.Fatalf("healthy route received %d messages, expected %d", healthy.count(), n)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// The stuck route holds one message and queues another, the others fail for it
+	failed := 0
+	for i := 0; i < n-2; i++ {
+		select {
+		case err := <-acks:
+			if err == nil {
+				t.Fatal("expected messages turned away by the stuck route to fail")
+			}
+			failed++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d messages were acknowledged", failed)
+		}
+	}
+
+	if dropped := health.GetReport().Sinks["test/stuck"].Dropped; dropped != n-2 {
+		t.Errorf("expected %d messages dropped for the stuck route, got %d", n-2, dropped)
+	}
+}
+
+func TestFanoutSinkWaitsForRoom(t *testing.T) {
+	slow := &testSink{stuck: make(chan struct{})}
+
+	s := &FanoutSink{
+		firehose:       "test",
+		routes:         []*route{testRoute(t, "slow", slow, 1)},
+		enqueueTimeout: 5 * time.Second,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// The sink catches up while the third message waits for room in the queue
+	time.AfterFunc(50*time.Millisecond, func() { close(slow.stuck) })
+
+	const n = 3
+	acks := make(chan error, n)
+	for i := 0; i < n; i++ {
+		s.Put(NewMessage([]byte(`{"i":1}`), func(err error) { acks <- err }))
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-acks:
+			if err != nil {
+				t.Fatalf("expected the message to be written once the queue had room, got %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d messages were acknowledged", i)
+		}
+	}
+}
+
+func TestFanoutSinkFiltersUnwrappedEvents(t *testing.T) {
+	ConfigureEnvelope(true, "test", "test")
+	defer ConfigureEnvelope(false, "", "")
+
+	failed := &testSink{}
+	all := &testSink{}
+
+	f, err := filter.New(filter.Rules{Include: []string{"TaskFailed == true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failedRoute := testRoute(t, "failed", failed, 10)
+	failedRoute.filter = f
+
+	fanout := &FanoutSink{firehose: "allocations", routes: []*route{failedRoute, testRoute(t, "all", all, 10)}}
+	s, err := ForFirehose(fanout, "allocations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	s.Put(NewEventMessage(Metadata{ID: "1"}, []byte(`{"TaskFailed":true}`), nil))
+	s.Put(NewEventMessage(Metadata{ID: "2"}, []byte(`{"TaskFailed":false}`), nil))
+
+	deadline := time.After(5 * time.Second)
+	for failed.count() < 1 || all.count() < 2 {
+		select {
+		case <-deadline:
+			t.Fatalf("failed route received %d messages, all route %d", failed.count(), all.count())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if failed.count() != 1 {
+		t.Fatalf("expected the failed route to receive 1 message, got %d", failed.count())
+	}
+
+	// The route still receives the event wrapped in the envelope
+	var wrapped Envelope
+	if err := json.Unmarshal(failed.messages[0].Data, &wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.Type != "allocation" || wrapped.ID != "1" {
+		t.Errorf("expected the envelope of event 1, got %+v", wrapped)
+	}
+}
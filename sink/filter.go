@@ -0,0 +1,54 @@
+package sink
+
+import (
+	"github.com/seatgeek/nomad-firehose/filter"
+	"github.com/seatgeek/nomad-firehose/metrics"
+)
+
+// FilterSink drops the events of a firehose type not matching its filter, acknowledging them
+// right away so they don't hold back the checkpoint
+type FilterSink struct {
+	sink     Sink
+	filter   *filter.Filter
+	firehose string
+}
+
+// NewFilterSink wraps s with the filter configured for the firehose type, s is returned as-is
+// if the firehose has no filter
+func NewFilterSink(s Sink, firehose string) (Sink, error) {
+	f, err := filter.ForFirehose(firehose)
+	if err != nil {
+		return nil, err
+	}
+
+	if f == nil {
+		return s, nil
+	}
+
+	return &FilterSink{
+		sink:     s,
+		filter:   f,
+		firehose: firehose,
+	}, nil
+}
+
+// Start ...
+func (s *FilterSink) Start() error {
+	return s.sink.Start()
+}
+
+// Stop ...
+func (s *FilterSink) Stop() {
+	s.sink.Stop()
+}
+
+// Put ..
+func (s *FilterSink) Put(message *Message) error {
+	if !s.filter.Match(message.Data) {
+		metrics.EventsFiltered.Inc(s.firehose)
+		message.Ack(nil)
+		return nil
+	}
+
+	return s.sink.Put(message)
+}
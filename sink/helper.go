@@ -3,15 +3,76 @@ package sink
 import (
 	"fmt"
 	"os"
+	"strings"
 )
 
-// GetSink ...
+// GetSink creates the sink configured by SINK_TYPE, or a FanoutSink if it lists several sinks
 func GetSink(resourceName string) (Sink, error) {
 	sinkType := os.Getenv("SINK_TYPE")
 	if sinkType == "" {
 		return nil, fmt.Errorf("Missing SINK_TYPE: amqp, http, kafka, kinesis, mongodb, nsq, rabbitmq, redis, sqs, stdout, syslog, eventbridge")
 	}
 
+	if sinkTypes := strings.Split(sinkType, ","); len(sinkTypes) > 1 {
+		for i := range sinkTypes {
+			sinkTypes[i] = strings.TrimSpace(sinkTypes[i])
+		}
+
+		return NewFanoutSink(resourceName, sinkTypes)
+	}
+
+	s, err := newSink(resourceName, sinkType)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRetrySink(NewInstrumentedSink(s, resourceName, sinkType)), nil
+}
+
+// ForFirehose wraps s with the filter, transform and envelope or CloudEvents stages configured for
+// the firehose type, events are filtered before they are transformed and wrapped
+func ForFirehose(s Sink, firehose string) (Sink, error) {
+	s = NewCloudEventsSink(NewEnvelopeSink(s, firehose), firehose)
+
+	s, err := NewTransformSink(s, firehose)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err = NewFilterSink(s, firehose)
+	if err != nil {
+		return nil, err
+	}
+
+	return &firehoseSink{sink: s, firehose: firehose}, nil
+}
+
+// firehoseSink sets the firehose type of the events put on the wrapped sink
+type firehoseSink struct {
+	sink     Sink
+	firehose string
+}
+
+func (s *firehoseSink) Start() error {
+	return s.sink.Start()
+}
+
+func (s *firehoseSink) Stop() {
+	s.sink.Stop()
+}
+
+func (s *firehoseSink) Put(message *Message) error {
+	message.Firehose = s.firehose
+	message.Event = message.Data
+	return s.sink.Put(message)
+}
+
+// newSink creates a sink of the given type
+func newSink(resourceName, sinkType string) (Sink, error) {
+	if err := supportsCloudEvents(sinkType); err != nil {
+		return nil, err
+	}
+
 	switch sinkType {
 	case "amqp":
 		return NewRabbitmq()
@@ -2,6 +2,8 @@ package sink
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
 	"strconv"
 	"time"
 
@@ -19,7 +21,7 @@ type HttpSink struct {
 	address     string
 	workerCount int
 	stopCh      chan interface{}
-	putCh       chan []byte
+	putCh       chan *Message
 }
 
 // NewHttp ...
@@ -42,7 +44,7 @@ func NewHttp() (*HttpSink, error) {
 		address:     address,
 		workerCount: workerCount,
 		stopCh:      make(chan interface{}),
-		putCh:       make(chan []byte, 1000),
+		putCh:       make(chan *Message, 1000),
 	}, nil
 }
 
@@ -80,25 +82,63 @@ func (s *HttpSink) Stop() {
 }
 
 // Put ..
-func (s *HttpSink) Put(data []byte) error {
-	s.putCh <- data
+func (s *HttpSink) Put(message *Message) error {
+	s.putCh <- message
 
 	return nil
 }
 
+// QueueDepth returns the number of messages waiting to be written
+func (s *HttpSink) QueueDepth() int {
+	return len(s.putCh)
+}
+
 func (s *HttpSink) send(id int) {
 	log.Infof("[sink/http/%d] Starting writer", id)
 
 	for {
 		select {
-		case data := <-s.putCh:
-			resp, err := http.Post(s.address, "application/json; charset=utf-8", bytes.NewBuffer(data[:]))
+		case message := <-s.putCh:
+			err := s.post(message)
 			if err != nil {
 				log.Errorf("[sink/http/%d] %s", id, err)
 			} else {
-				defer resp.Body.Close()
 				log.Debugf("[sink/http/%d] publish ok", id)
 			}
+
+			message.Ack(err)
 		}
 	}
 }
+
+func (s *HttpSink) post(message *Message) error {
+	req, err := http.NewRequest("POST", s.address, bytes.NewBuffer(message.Data))
+	if err != nil {
+		return err
+	}
+
+	contentType := "application/json; charset=utf-8"
+	if message.ContentType != "" {
+		contentType = message.ContentType
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	// CloudEvents HTTP binding of binary mode events
+	for name, value := range message.Attributes {
+		req.Header.Set("ce-"+name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
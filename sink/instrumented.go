@@ -0,0 +1,114 @@
+package sink
+
+import (
+	"time"
+
+	"github.com/seatgeek/nomad-firehose/health"
+	"github.com/seatgeek/nomad-firehose/metrics"
+)
+
+// How often an idle sink is probed
+const sinkProbeInterval = 30 * time.Second
+
+// queuedSink is implemented by sinks buffering messages in a queue before writing them
+type queuedSink interface {
+	QueueDepth() int
+}
+
+// pingableSink is implemented by sinks that can be probed when no messages are written to them
+type pingableSink interface {
+	Ping() error
+}
+
+// InstrumentedSink records metrics and health about the messages written to the wrapped sink
+type InstrumentedSink struct {
+	sink     Sink
+	firehose string
+	sinkType string
+	stopCh   chan interface{}
+}
+
+// NewInstrumentedSink ...
+func NewInstrumentedSink(s Sink, firehose, sinkType string) *InstrumentedSink {
+	if q, ok := s.(queuedSink); ok {
+		metrics.SinkQueueDepth.AddFunc(func() float64 { return float64(q.QueueDepth()) }, firehose, sinkType)
+	}
+
+	return &InstrumentedSink{
+		sink:     s,
+		firehose: firehose,
+		sinkType: sinkType,
+		stopCh:   make(chan interface{}),
+	}
+}
+
+// Start ...
+func (s *InstrumentedSink) Start() error {
+	// Stop chan for the probe to depend on
+	s.stopCh = make(chan interface{})
+
+	if p, ok := s.sink.(pingableSink); ok {
+		go s.probe(p)
+	}
+
+	return s.sink.Start()
+}
+
+// Stop ...
+func (s *InstrumentedSink) Stop() {
+	close(s.stopCh)
+	s.sink.Stop()
+}
+
+// Put ..
+func (s *InstrumentedSink) Put(message *Message) error {
+	metrics.SinkPuts.Inc(s.firehose, s.sinkType)
+	start := time.Now()
+	done := health.SinkPut(s.name())
+
+	return s.sink.Put(message.withAck(func(err error) {
+		metrics.SinkLatency.Observe(time.Since(start).Seconds(), s.firehose, s.sinkType)
+		done(err)
+
+		if dropped, ok := err.(*droppedError); ok {
+			metrics.SinkDropped.Inc(s.firehose, s.sinkType, dropped.reason)
+			health.SinkDropped(s.name(), err)
+			message.Ack(nil)
+			return
+		}
+
+		if err != nil {
+			metrics.SinkErrors.Inc(s.firehose, s.sinkType)
+		} else {
+			metrics.SinkAcks.Inc(s.firehose, s.sinkType)
+		}
+
+		message.Ack(err)
+	}))
+}
+
+// name of the sink in the health report
+func (s *InstrumentedSink) name() string {
+	return s.firehose + "/" + s.sinkType
+}
+
+// probe pings the sink when it has not accepted a message for a while, so an idle
+// sink is still known to be reachable
+func (s *InstrumentedSink) probe(p pingableSink) {
+	ticker := time.NewTicker(sinkProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+
+		case <-ticker.C:
+			if time.Since(health.SinkLastSuccess(s.name())) < sinkProbeInterval {
+				continue
+			}
+
+			health.SinkWrite(s.name(), p.Ping())
+		}
+	}
+}
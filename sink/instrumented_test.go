@@ -0,0 +1,43 @@
+package sink
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/seatgeek/nomad-firehose/health"
+)
+
+// droppingSink gives up on every message put on it
+type droppingSink struct{}
+
+func (s *droppingSink) Start() error { return nil }
+func (s *droppingSink) Stop()        {}
+
+func (s *droppingSink) Put(message *Message) error {
+	message.Ack(&droppedError{reason: "encoding", err: errors.New("no schema")})
+	return nil
+}
+
+func TestInstrumentedSinkDroppedMessage(t *testing.T) {
+	s := NewInstrumentedSink(&droppingSink{}, "test", "dropping")
+
+	acked := false
+	s.Put(NewMessage([]byte(`{}`), func(err error) {
+		if err != nil {
+			t.Errorf("expected the dropped message to be acked upstream, got %s", err)
+		}
+		acked = true
+	}))
+
+	if !acked {
+		t.Fatal("expected the dropped message to be acked")
+	}
+
+	report := health.GetReport().Sinks["test/dropping"]
+	if report.Dropped != 1 {
+		t.Errorf("expected 1 message dropped, got %d", report.Dropped)
+	}
+	if report.LastError != "no schema" {
+		t.Errorf("expected the sink to be failing with the encoding error, got %q", report.LastError)
+	}
+}
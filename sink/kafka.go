@@ -21,9 +21,14 @@ type KafkaSink struct {
 	Topic string
 
 	producer sarama.SyncProducer
+	version  sarama.KafkaVersion
+
+	// registry is the Schema Registry of the Avro schemas of events, nil if events are sent as JSON
+	registry        *SchemaRegistry
+	subjectStrategy string
 
 	stopCh chan interface{}
-	putCh  chan []byte
+	putCh  chan *Message
 }
 
 func createTlsConfiguration() (t *tls.Config) {
@@ -45,6 +50,15 @@ func createTlsConfiguration() (t *tls.Config) {
 	return t
 }
 
+// Encodings of the values of Kafka records
+const (
+	KafkaEncodingJSON = "json"
+	KafkaEncodingAvro = "avro"
+)
+
+// avroEncoded is true if a sink encodes events as Avro, the schemas describe untransformed events
+var avroEncoded bool
+
 // NewKafka ...
 func NewKafka() (*KafkaSink, error) {
 	brokers := os.Getenv("SINK_KAFKA_BROKERS")
@@ -64,6 +78,23 @@ func NewKafka() (*KafkaSink, error) {
 	config := sarama.NewConfig()
 	config.Producer.Return.Successes = true
 
+	if v := os.Getenv("SINK_KAFKA_VERSION"); v != "" {
+		version, err := sarama.ParseKafkaVersion(v)
+		if err != nil {
+			return nil, fmt.Errorf("[sink/kafka] Invalid SINK_KAFKA_VERSION: %s", err)
+		}
+		config.Version = version
+	}
+
+	if cloudEvents != nil && cloudEvents.mode == CloudEventsBinary && !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		return nil, fmt.Errorf("[sink/kafka] Binary CloudEvents need record headers, set SINK_KAFKA_VERSION to 0.11.0.0 or newer")
+	}
+
+	registry, subjectStrategy, err := kafkaSchemaRegistry()
+	if err != nil {
+		return nil, err
+	}
+
 	tlsConfig := createTlsConfiguration()
 	if tlsConfig != nil {
 		config.Net.TLS.Config = tlsConfig
@@ -85,14 +116,54 @@ func NewKafka() (*KafkaSink, error) {
 	}
 
 	return &KafkaSink{
-		Brokers:  brokerList,
-		Topic:    topic,
-		producer: producer,
-		stopCh:   make(chan interface{}),
-		putCh:    make(chan []byte, 1000),
+		Brokers:         brokerList,
+		Topic:           topic,
+		producer:        producer,
+		version:         config.Version,
+		registry:        registry,
+		subjectStrategy: subjectStrategy,
+		stopCh:          make(chan interface{}),
+		putCh:           make(chan *Message, 1000),
 	}, nil
 }
 
+// kafkaSchemaRegistry returns the Schema Registry and subject name strategy of the Avro encoding
+// configured by SINK_KAFKA_ENCODING, a nil registry if events are sent as JSON
+func kafkaSchemaRegistry() (*SchemaRegistry, string, error) {
+	switch encoding := os.Getenv("SINK_KAFKA_ENCODING"); encoding {
+	case "", KafkaEncodingJSON:
+		return nil, "", nil
+	case KafkaEncodingAvro:
+	default:
+		return nil, "", fmt.Errorf("[sink/kafka] Invalid SINK_KAFKA_ENCODING %q, expected json or avro", encoding)
+	}
+
+	if envelope != nil || cloudEvents != nil {
+		return nil, "", fmt.Errorf("[sink/kafka] The Avro encoding can't be used with the envelope or CloudEvents")
+	}
+
+	address := os.Getenv("SINK_KAFKA_SCHEMA_REGISTRY_URL")
+	if address == "" {
+		return nil, "", fmt.Errorf("[sink/kafka] Missing SINK_KAFKA_SCHEMA_REGISTRY_URL")
+	}
+
+	strategy := os.Getenv("SINK_KAFKA_SUBJECT_NAME_STRATEGY")
+	switch strategy {
+	case "":
+		strategy = SubjectTopicRecord
+	case SubjectTopic, SubjectRecord, SubjectTopicRecord:
+	default:
+		return nil, "", fmt.Errorf("[sink/kafka] Invalid SINK_KAFKA_SUBJECT_NAME_STRATEGY %q, expected topic, record or topic_record", strategy)
+	}
+
+	autoRegister := os.Getenv("SINK_KAFKA_SCHEMA_REGISTRY_AUTO_REGISTER") != "false"
+	log.Infof("[sink/kafka] Encoding events as Avro, schema registry: %s subject name strategy: %s auto register: %t", address, strategy, autoRegister)
+
+	avroEncoded = true
+	registry := NewSchemaRegistry(address, os.Getenv("SINK_KAFKA_SCHEMA_REGISTRY_USER"), os.Getenv("SINK_KAFKA_SCHEMA_REGISTRY_PASSWORD"), autoRegister)
+	return registry, strategy, nil
+}
+
 // Start ...
 func (s *KafkaSink) Start() error {
 	// Stop chan for all tasks to depend on
@@ -116,26 +187,99 @@ func (s *KafkaSink) Stop() {
 }
 
 // Put ..
-func (s *KafkaSink) Put(data []byte) error {
-	s.putCh <- data
+func (s *KafkaSink) Put(message *Message) error {
+	s.putCh <- message
 
 	return nil
 }
 
+// QueueDepth returns the number of messages waiting to be written
+func (s *KafkaSink) QueueDepth() int {
+	return len(s.putCh)
+}
+
 func (s *KafkaSink) write() {
 	log.Info("[sink/kafka] Starting writer")
 
 	for {
 		select {
-		case data := <-s.putCh:
-			message := &sarama.ProducerMessage{Topic: s.Topic}
-			message.Value = sarama.StringEncoder(string(data))
-			partition, offset, err := s.producer.SendMessage(message)
+		case message := <-s.putCh:
+			record := &sarama.ProducerMessage{Topic: s.Topic}
+			value, err := s.value(message)
+			if _, ok := err.(*droppedError); ok {
+				// Retrying won't help, so drop the event rather than holding back the checkpoint forever
+				log.Errorf("[sink/kafka] Could not encode %s event of type %q, dropping it: %s", message.Firehose, message.Type, err)
+				message.Ack(err)
+				continue
+			}
+			if err != nil {
+				log.Errorf("[sink/kafka] Could not encode %s event of type %q: %s", message.Firehose, message.Type, err)
+				message.Ack(err)
+				continue
+			}
+			record.Value = value
+			if message.ID != "" {
+				record.Key = sarama.StringEncoder(message.ID)
+			}
+
+			// Record headers need Kafka 0.11+
+			if s.version.IsAtLeast(sarama.V0_11_0_0) {
+				record.Headers = headers(message)
+			}
+			partition, offset, err := s.producer.SendMessage(record)
 			if err != nil {
 				log.Errorf("Failed to produce message: %s", err)
 			} else {
 				log.Debugf("[sink/kafka] topic=%s\tpartition=%d\toffset=%d\n", s.Topic, partition, offset)
 			}
+
+			message.Ack(err)
 		}
 	}
 }
+
+// value returns the value of the record of a message, its data as-is or encoded as Avro in the
+// Confluent wire format. Encoding errors are dropped errors, retrying won't fix them unlike
+// Schema Registry errors
+func (s *KafkaSink) value(message *Message) (sarama.Encoder, error) {
+	if s.registry == nil {
+		return sarama.StringEncoder(string(message.Data)), nil
+	}
+
+	schema, err := GetAvroSchema(message.Firehose, message.Type)
+	if err != nil {
+		return nil, &droppedError{reason: "encoding", err: err}
+	}
+
+	data, err := schema.Encode(message.Data)
+	if err != nil {
+		return nil, &droppedError{reason: "encoding", err: err}
+	}
+
+	id, err := s.registry.ID(subject(s.subjectStrategy, s.Topic, schema), schema.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return sarama.ByteEncoder(confluentWireFormat(id, data)), nil
+}
+
+// headers returns the record headers of a message, its event ID and, for CloudEvents, its content
+// type and the CloudEvents Kafka binding of the attributes of binary mode events
+func headers(message *Message) []sarama.RecordHeader {
+	headers := make([]sarama.RecordHeader, 0, len(message.Attributes)+2)
+
+	if message.ID != "" {
+		headers = append(headers, sarama.RecordHeader{Key: []byte("event_id"), Value: []byte(message.ID)})
+	}
+
+	if message.ContentType != "" {
+		headers = append(headers, sarama.RecordHeader{Key: []byte("content-type"), Value: []byte(message.ContentType)})
+	}
+
+	for name, value := range message.Attributes {
+		headers = append(headers, sarama.RecordHeader{Key: []byte("ce_" + name), Value: []byte(value)})
+	}
+
+	return headers
+}
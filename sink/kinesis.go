@@ -20,7 +20,7 @@ type KinesisSink struct {
 	streamName   string
 	partitionKey string
 	stopCh       chan interface{}
-	putCh        chan []byte
+	putCh        chan *Message
 }
 
 // NewKinesis ...
@@ -44,7 +44,7 @@ func NewKinesis() (*KinesisSink, error) {
 		streamName:   streamName,
 		partitionKey: partitionKey,
 		stopCh:       make(chan interface{}),
-		putCh:        make(chan []byte, 1000),
+		putCh:        make(chan *Message, 1000),
 	}, nil
 }
 
@@ -83,12 +83,17 @@ func (s *KinesisSink) Stop() {
 }
 
 // Put ..
-func (s *KinesisSink) Put(data []byte) error {
-	s.putCh <- data
+func (s *KinesisSink) Put(message *Message) error {
+	s.putCh <- message
 
 	return nil
 }
 
+// QueueDepth returns the number of messages waiting to be written
+func (s *KinesisSink) QueueDepth() int {
+	return len(s.putCh)
+}
+
 func (s *KinesisSink) write(id int) {
 	log.Infof("[sink/kinesis/%d] Starting writer", id)
 
@@ -97,9 +102,9 @@ func (s *KinesisSink) write(id int) {
 
 	for {
 		select {
-		case data := <-s.putCh:
+		case message := <-s.putCh:
 			putOutput, err := s.kinesis.PutRecord(&kinesis.PutRecordInput{
-				Data:         data,
+				Data:         message.Data,
 				StreamName:   streamName,
 				PartitionKey: partitionKey,
 			})
@@ -109,6 +114,8 @@ func (s *KinesisSink) write(id int) {
 			} else {
 				log.Infof("[sink/kinesis/%d] %v", id, putOutput)
 			}
+
+			message.Ack(err)
 		}
 	}
 }
@@ -13,6 +13,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	mongo "github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/replaceopt"
 )
 
 // MongodbSink ...
@@ -22,7 +23,7 @@ type MongodbSink struct {
 	collection  string
 	workerCount int
 	stopCh      chan interface{}
-	putCh       chan []byte
+	putCh       chan *Message
 }
 
 // NewMongodb ...
@@ -67,7 +68,7 @@ func NewMongodb() (*MongodbSink, error) {
 		collection:  collection,
 		workerCount: workerCount,
 		stopCh:      make(chan interface{}),
-		putCh:       make(chan []byte, 1000),
+		putCh:       make(chan *Message, 1000),
 	}, nil
 }
 
@@ -106,12 +107,25 @@ func (s *MongodbSink) Stop() {
 }
 
 // Put ..
-func (s *MongodbSink) Put(data []byte) error {
-	s.putCh <- data
+func (s *MongodbSink) Put(message *Message) error {
+	s.putCh <- message
 
 	return nil
 }
 
+// QueueDepth returns the number of messages waiting to be written
+func (s *MongodbSink) QueueDepth() int {
+	return len(s.putCh)
+}
+
+// Ping ...
+func (s *MongodbSink) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return s.conn.Ping(ctx, nil)
+}
+
 func (s *MongodbSink) write(id int) {
 	log.Infof("[sink/mongodb/%d] Starting writer", id)
 
@@ -119,20 +133,30 @@ func (s *MongodbSink) write(id int) {
 
 	for {
 		select {
-		case data := <-s.putCh:
+		case message := <-s.putCh:
 			m := make(map[string]interface{})
-			err := json.Unmarshal(data, &m)
+			err := json.Unmarshal(message.Data, &m)
 
 			if err != nil {
 				log.Errorf("[sink/mongodb/%d] %s", id, err)
+				message.Ack(err)
 				continue
 			}
-			_, err = collection.InsertOne(context.Background(), m)
+
+			// Upsert events by their ID, so an event delivered twice is only stored once
+			if message.ID != "" {
+				m["_id"] = message.ID
+				_, err = collection.ReplaceOne(context.Background(), map[string]interface{}{"_id": message.ID}, m, replaceopt.Upsert(true))
+			} else {
+				_, err = collection.InsertOne(context.Background(), m)
+			}
 			if err != nil {
 				log.Errorf("[sink/mongodb/%d] %s", id, err)
 			} else {
 				log.Debugf("[sink/mongodb/%d] publish ok", id)
 			}
+
+			message.Ack(err)
 		}
 	}
 }
@@ -13,7 +13,7 @@ type NSQSink struct {
 	producer  *nsq.Producer
 	topicName string
 	stopCh    chan interface{}
-	putCh     chan []byte
+	putCh     chan *Message
 }
 
 func NewNSQ() (*NSQSink, error) {
@@ -40,7 +40,7 @@ func NewNSQ() (*NSQSink, error) {
 		producer:  producer,
 		topicName: topicName,
 		stopCh:    make(chan interface{}),
-		putCh:     make(chan []byte, 1000),
+		putCh:     make(chan *Message, 1000),
 	}, nil
 }
 
@@ -74,23 +74,36 @@ func (s *NSQSink) Stop() {
 	close(s.stopCh)
 }
 
-func (s *NSQSink) Put(data []byte) error {
-	s.putCh <- data
+func (s *NSQSink) Put(message *Message) error {
+	s.putCh <- message
 
 	return nil
 }
 
+// QueueDepth returns the number of messages waiting to be written
+func (s *NSQSink) QueueDepth() int {
+	return len(s.putCh)
+}
+
+// Ping ...
+func (s *NSQSink) Ping() error {
+	return s.producer.Ping()
+}
+
 func (s *NSQSink) write(id int) {
 	log.Infof("[sink/nsq/%d] Starting writer", id)
 
 	for {
 		select {
-		case data := <-s.putCh:
-			if err := s.producer.Publish(s.topicName, data); err != nil {
+		case message := <-s.putCh:
+			err := s.producer.Publish(s.topicName, message.Data)
+			if err != nil {
 				log.Infof("[sink/nsq/%d] %s", id, err)
 			} else {
 				log.Infof("[sink/nsq/%d] Publish OK", id)
 			}
+
+			message.Ack(err)
 		}
 	}
 }
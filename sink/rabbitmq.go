@@ -19,7 +19,7 @@ type RabbitmqSink struct {
 	routingKey  string
 	workerCount int
 	stopCh      chan interface{}
-	putCh       chan []byte
+	putCh       chan *Message
 }
 
 // NewRabbitmq ...
@@ -59,7 +59,7 @@ func NewRabbitmq() (*RabbitmqSink, error) {
 		routingKey:  routingKey,
 		workerCount: workerCount,
 		stopCh:      make(chan interface{}),
-		putCh:       make(chan []byte, 1000),
+		putCh:       make(chan *Message, 1000),
 	}, nil
 }
 
@@ -98,12 +98,17 @@ func (s *RabbitmqSink) Stop() {
 }
 
 // Put ..
-func (s *RabbitmqSink) Put(data []byte) error {
-	s.putCh <- data
+func (s *RabbitmqSink) Put(message *Message) error {
+	s.putCh <- message
 
 	return nil
 }
 
+// QueueDepth returns the number of messages waiting to be written
+func (s *RabbitmqSink) QueueDepth() int {
+	return len(s.putCh)
+}
+
 func (s *RabbitmqSink) write(id int) {
 	log.Infof("[sink/amqp/%d] Starting writer", id)
 
@@ -115,24 +120,58 @@ func (s *RabbitmqSink) write(id int) {
 
 	defer ch.Close()
 
+	// Use publisher confirms, so messages are only acknowledged once the broker has them
+	if err := ch.Confirm(false); err != nil {
+		log.Error(err)
+		return
+	}
+
+	confirmCh := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
 	for {
 		select {
-		case data := <-s.putCh:
+		case message := <-s.putCh:
+			contentType := "application/json"
+			if message.ContentType != "" {
+				contentType = message.ContentType
+			}
+
+			// CloudEvents AMQP binding of binary mode events
+			var headers amqp.Table
+			if len(message.Attributes) > 0 {
+				headers = make(amqp.Table, len(message.Attributes))
+				for name, value := range message.Attributes {
+					headers["cloudEvents:"+name] = value
+				}
+			}
+
 			err = ch.Publish(
 				s.exchange,   // exchange
 				s.routingKey, // routing key
 				false,        // mandatory
 				false,        // immediate
 				amqp.Publishing{
-					ContentType: "application/json",
-					Body:        data,
+					Headers:     headers,
+					ContentType: contentType,
+					MessageId:   message.ID,
+					Body:        message.Data,
 				})
 
+			if err == nil {
+				if confirm, ok := <-confirmCh; !ok {
+					err = fmt.Errorf("channel closed before the broker confirmed the message")
+				} else if !confirm.Ack {
+					err = fmt.Errorf("broker rejected message %d", confirm.DeliveryTag)
+				}
+			}
+
 			if err != nil {
 				log.Errorf("[sink/amqp/%d] %s", id, err)
 			} else {
 				log.Debugf("[sink/amqp/%d] publish ok", id)
 			}
+
+			message.Ack(err)
 		}
 	}
 }
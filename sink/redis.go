@@ -14,7 +14,7 @@ type RedisSink struct {
 	pool   *redis.Pool
 	key    string
 	stopCh chan interface{}
-	putCh  chan []byte
+	putCh  chan *Message
 }
 
 // NewStdout ...
@@ -44,7 +44,7 @@ func NewRedis() (*RedisSink, error) {
 		pool:   &redisPool,
 		key:    redisKey,
 		stopCh: make(chan interface{}),
-		putCh:  make(chan []byte, 1000),
+		putCh:  make(chan *Message, 1000),
 	}, nil
 }
 
@@ -81,24 +81,41 @@ func (s *RedisSink) Stop() {
 }
 
 // Put ..
-func (s *RedisSink) Put(data []byte) error {
-	s.putCh <- data
+func (s *RedisSink) Put(message *Message) error {
+	s.putCh <- message
 	return nil
 }
 
+// QueueDepth returns the number of messages waiting to be written
+func (s *RedisSink) QueueDepth() int {
+	return len(s.putCh)
+}
+
+// Ping ...
+func (s *RedisSink) Ping() error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	return err
+}
+
 func (s *RedisSink) write() {
 	log.Infof("[sink/redis] Starting writer to key '%s'", s.key)
 
 	for {
 		select {
-		case data := <-s.putCh:
+		case message := <-s.putCh:
 			conn := s.pool.Get()
-			if _, err := conn.Do("RPUSH", s.key, data); err != nil {
+			_, err := conn.Do("RPUSH", s.key, message.Data)
+			if err != nil {
 				log.Infof("[sink/redis] %s", err)
 			} else {
 				log.Infof("[sink/redis] Published to key '%s'", s.key)
 			}
 			conn.Close()
+
+			message.Ack(err)
 		}
 	}
 }
@@ -0,0 +1,72 @@
+package sink
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	retryMinBackoff = 1 * time.Second
+	retryMaxBackoff = 1 * time.Minute
+)
+
+// RetrySink puts messages the wrapped sink failed to write back on its queue with an
+// exponential backoff, so a sink outage holds back the checkpoint rather than dropping events
+type RetrySink struct {
+	sink   Sink
+	stopCh chan interface{}
+}
+
+// NewRetrySink ...
+func NewRetrySink(s Sink) *RetrySink {
+	return &RetrySink{
+		sink:   s,
+		stopCh: make(chan interface{}),
+	}
+}
+
+// Start ...
+func (s *RetrySink) Start() error {
+	// Stop chan for all retries to depend on
+	s.stopCh = make(chan interface{})
+
+	return s.sink.Start()
+}
+
+// Stop ...
+func (s *RetrySink) Stop() {
+	close(s.stopCh)
+	s.sink.Stop()
+}
+
+// Put ..
+func (s *RetrySink) Put(message *Message) error {
+	return s.put(message, retryMinBackoff)
+}
+
+func (s *RetrySink) put(message *Message, backoff time.Duration) error {
+	return s.sink.Put(message.withAck(func(err error) {
+		if err == nil {
+			message.Ack(nil)
+			return
+		}
+
+		log.Warnf("[sink/retry] Failed to write message, retrying in %s: %s", backoff, err)
+
+		go func() {
+			select {
+			case <-time.After(backoff):
+				next := backoff * 2
+				if next > retryMaxBackoff {
+					next = retryMaxBackoff
+				}
+				s.put(message, next)
+
+			// Give up, the message was never acknowledged so the checkpoint won't move past it
+			case <-s.stopCh:
+				message.Ack(err)
+			}
+		}()
+	}))
+}
@@ -0,0 +1,144 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subject name strategies, deciding the Schema Registry subject of the schema of an event
+const (
+	// SubjectTopic uses <topic>-value, for topics holding a single event type
+	SubjectTopic = "topic"
+
+	// SubjectRecord uses the full name of the record, e.g. io.nomad.firehose.allocations.AllocationUpdate
+	SubjectRecord = "record"
+
+	// SubjectTopicRecord uses <topic>-<record full name>, for topics holding several event types
+	SubjectTopicRecord = "topic_record"
+)
+
+// schemaRegistryContentType is the media type of the Confluent Schema Registry API
+const schemaRegistryContentType = "application/vnd.schemaregistry.v1+json"
+
+// SchemaRegistry is a client of a Confluent compatible Schema Registry, caching the IDs of schemas
+type SchemaRegistry struct {
+	address      string
+	user         string
+	password     string
+	autoRegister bool // register schemas missing from the registry, rather than failing
+	client       *http.Client
+
+	lock sync.Mutex
+	ids  map[string]int // schema ID by subject and schema
+}
+
+// NewSchemaRegistry creates a client of the Schema Registry at address
+func NewSchemaRegistry(address, user, password string, autoRegister bool) *SchemaRegistry {
+	return &SchemaRegistry{
+		address:      strings.TrimSuffix(address, "/"),
+		user:         user,
+		password:     password,
+		autoRegister: autoRegister,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		ids:          make(map[string]int),
+	}
+}
+
+// ID returns the ID of schema under subject, registering it if auto registration is enabled, or
+// looking it up otherwise
+func (r *SchemaRegistry) ID(subject, schema string) (int, error) {
+	key := subject + "\x00" + schema
+
+	r.lock.Lock()
+	id, ok := r.ids[key]
+	r.lock.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	// Registering a schema that is already registered returns its ID
+	path := "/subjects/" + url.PathEscape(subject)
+	if r.autoRegister {
+		path += "/versions"
+	}
+
+	id, err := r.post(path, schema)
+	if err != nil {
+		return 0, fmt.Errorf("Could not get the ID of the schema of subject %s: %s", subject, err)
+	}
+
+	r.lock.Lock()
+	r.ids[key] = id
+	r.lock.Unlock()
+
+	return id, nil
+}
+
+func (r *SchemaRegistry) post(path, schema string) (int, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.address+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", schemaRegistryContentType)
+	req.Header.Set("Accept", schemaRegistryContentType)
+	if r.user != "" {
+		req.SetBasicAuth(r.user, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	var result struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(b, &result); err != nil {
+		return 0, err
+	}
+
+	return result.ID, nil
+}
+
+// subject returns the subject of the schema of an event written to topic
+func subject(strategy, topic string, schema *AvroSchema) string {
+	switch strategy {
+	case SubjectTopic:
+		return topic + "-value"
+	case SubjectRecord:
+		return schema.Name
+	default:
+		return topic + "-" + schema.Name
+	}
+}
+
+// confluentWireFormat frames data in the Confluent wire format: a zero magic byte, the schema ID
+// as a 4-byte big-endian integer, then the data
+func confluentWireFormat(id int, data []byte) []byte {
+	b := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(b[1:], uint32(id))
+	return append(b, data...)
+}
@@ -0,0 +1,134 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// registryStub is a Schema Registry holding schemas in memory
+type registryStub struct {
+	lock     sync.Mutex
+	subjects map[string]map[string]int // schema ID by subject and schema
+	nextID   int
+	requests int
+}
+
+func newRegistryStub() *registryStub {
+	return &registryStub{subjects: make(map[string]map[string]int), nextID: 1}
+}
+
+func (r *registryStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests++
+
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != schemaRegistryContentType {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	subject := strings.TrimPrefix(req.URL.Path, "/subjects/")
+	register := strings.HasSuffix(subject, "/versions")
+	subject = strings.TrimSuffix(subject, "/versions")
+
+	schemas, ok := r.subjects[subject]
+	if !ok {
+		schemas = make(map[string]int)
+		r.subjects[subject] = schemas
+	}
+
+	id, ok := schemas[body.Schema]
+	if !ok {
+		if !register {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+			return
+		}
+
+		id = r.nextID
+		r.nextID++
+		schemas[body.Schema] = id
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id})
+}
+
+func TestSchemaRegistryRegister(t *testing.T) {
+	stub := newRegistryStub()
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	r := NewSchemaRegistry(server.URL, "", "", true)
+
+	id, err := r.ID("events-value", `"string"`)
+	if err != nil || id != 1 {
+		t.Fatalf("expected schema ID 1, got %d: %v", id, err)
+	}
+
+	// Cached, the registry is not queried again
+	if id, err = r.ID("events-value", `"string"`); err != nil || id != 1 || stub.requests != 1 {
+		t.Fatalf("expected the cached schema ID 1, got %d after %d requests: %v", id, stub.requests, err)
+	}
+
+	if id, err = r.ID("events-value", `"long"`); err != nil || id != 2 {
+		t.Fatalf("expected schema ID 2, got %d: %v", id, err)
+	}
+}
+
+func TestSchemaRegistryLookup(t *testing.T) {
+	stub := newRegistryStub()
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	r := NewSchemaRegistry(server.URL, "", "", false)
+
+	if _, err := r.ID("events-value", `"string"`); err == nil {
+		t.Fatal("expected looking up a schema that isn't registered to fail")
+	}
+
+	if _, err := NewSchemaRegistry(server.URL, "", "", true).ID("events-value", `"string"`); err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := r.ID("events-value", `"string"`); err != nil || id != 1 {
+		t.Fatalf("expected schema ID 1, got %d: %v", id, err)
+	}
+}
+
+func TestConfluentWireFormat(t *testing.T) {
+	data := confluentWireFormat(0x01020304, []byte{0xaa, 0xbb})
+
+	expected := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0xaa, 0xbb}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("expected % x, got % x", expected, data)
+	}
+}
+
+func TestSubject(t *testing.T) {
+	schema := &AvroSchema{Name: "io.nomad.firehose.allocations.AllocationUpdate"}
+
+	tests := map[string]string{
+		SubjectTopic:       "events-value",
+		SubjectRecord:      "io.nomad.firehose.allocations.AllocationUpdate",
+		SubjectTopicRecord: "events-io.nomad.firehose.allocations.AllocationUpdate",
+	}
+
+	for strategy, expected := range tests {
+		if s := subject(strategy, "events", schema); s != expected {
+			t.Errorf("%s: expected %s, got %s", strategy, expected, s)
+		}
+	}
+}
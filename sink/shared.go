@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"sync"
+)
+
+// SharedSink lets several firehoses use the same sink, the wrapped sink is started by
+// the first firehose to start, and only stopped once every firehose has stopped
+type SharedSink struct {
+	sink    Sink
+	lock    sync.Mutex
+	running int
+	stopCh  chan interface{}
+}
+
+// NewSharedSink ...
+func NewSharedSink(s Sink) *SharedSink {
+	return &SharedSink{
+		sink: s,
+	}
+}
+
+// Start ...
+func (s *SharedSink) Start() error {
+	s.lock.Lock()
+	s.running++
+	first := s.running == 1
+	if first {
+		s.stopCh = make(chan interface{})
+	}
+	stopCh := s.stopCh
+	s.lock.Unlock()
+
+	if first {
+		return s.sink.Start()
+	}
+
+	// wait for the shared sink to stop, like the wrapped sink would
+	<-stopCh
+	return nil
+}
+
+// Stop ...
+func (s *SharedSink) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.running == 0 {
+		return
+	}
+
+	s.running--
+	if s.running == 0 {
+		s.sink.Stop()
+		close(s.stopCh)
+	}
+}
+
+// Put ..
+func (s *SharedSink) Put(message *Message) error {
+	return s.sink.Put(message)
+}
@@ -1,6 +1,8 @@
 package sink
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"strconv"
@@ -20,8 +22,8 @@ type SQSSink struct {
 	queueName string
 	groupId   string
 	stopCh    chan interface{}
-	putCh     chan []byte
-	batchCh   chan [][]byte
+	putCh     chan *Message
+	batchCh   chan []*Message
 }
 
 // NNewSQS ...
@@ -49,8 +51,8 @@ func NewSQS(groupId string) (*SQSSink, error) {
 		queueName: *output.QueueUrl,
 		groupId:   groupId,
 		stopCh:    make(chan interface{}),
-		putCh:     make(chan []byte, 1000),
-		batchCh:   make(chan [][]byte, 100),
+		putCh:     make(chan *Message, 1000),
+		batchCh:   make(chan []*Message, 100),
 	}, nil
 }
 
@@ -87,24 +89,29 @@ func (s *SQSSink) Stop() {
 }
 
 // Put ..
-func (s *SQSSink) Put(data []byte) error {
-	s.putCh <- data
+func (s *SQSSink) Put(message *Message) error {
+	s.putCh <- message
 
 	return nil
 }
 
+// QueueDepth returns the number of messages waiting to be written
+func (s *SQSSink) QueueDepth() int {
+	return len(s.putCh)
+}
+
 func (s *SQSSink) batch() {
-	buffer := make([][]byte, 0)
+	buffer := make([]*Message, 0)
 	ticker := time.NewTicker(1 * time.Second)
 
 	for {
 		select {
-		case data := <-s.putCh:
-			buffer = append(buffer, data)
+		case message := <-s.putCh:
+			buffer = append(buffer, message)
 
 			if len(buffer) == 10 {
 				s.batchCh <- buffer
-				buffer = make([][]byte, 0)
+				buffer = make([]*Message, 0)
 			}
 
 		case _ = <-ticker.C:
@@ -115,7 +122,7 @@ func (s *SQSSink) batch() {
 
 			if len(buffer) > 0 {
 				s.batchCh <- buffer
-				buffer = make([][]byte, 0)
+				buffer = make([]*Message, 0)
 			}
 		}
 	}
@@ -131,28 +138,34 @@ func (s *SQSSink) write() {
 		case batch := <-s.batchCh:
 			entries := make([]*sqs.SendMessageBatchRequestEntry, 0)
 
-			for _, data := range batch {
+			for _, message := range batch {
 				mID := aws.String(strconv.FormatInt(id, 10))
 				entry := &sqs.SendMessageBatchRequestEntry{
 					Id:                     mID,
-					MessageBody:            aws.String(string(data)),
+					MessageBody:            aws.String(string(message.Data)),
 					MessageGroupId:         aws.String(s.groupId),
-					MessageDeduplicationId: mID,
+					MessageDeduplicationId: deduplicationID(message, mID),
 				}
 
 				entries = append(entries, entry)
 				id = id + 1
 			}
 
-			err := s.sendBatch(entries)
+			failed, err := s.sendBatch(entries)
 			if err != nil && strings.Contains(err.Error(), "AWS.SimpleQueueService.BatchRequestTooLong") {
 				for i, el := range entries {
-					err = s.sendBatch([]*sqs.SendMessageBatchRequestEntry{el})
+					failed, err := s.sendBatch([]*sqs.SendMessageBatchRequestEntry{el})
+					if err == nil {
+						err = failed[*el.Id]
+					}
+
 					if err != nil {
 						log.Errorf("[sink/sqs] Retry failed for %d: %s", i, err)
 					} else {
 						log.Infof("[sink/sqs] Retry succeeded for %d", i)
 					}
+
+					batch[i].Ack(err)
 				}
 
 				continue
@@ -161,17 +174,52 @@ func (s *SQSSink) write() {
 			if err != nil {
 				log.Errorf("[sink/sqs] %s", err)
 			} else {
-				log.Infof("[sink/sqs] queued %d messages", len(batch))
+				log.Infof("[sink/sqs] queued %d messages", len(batch)-len(failed))
+			}
+
+			for i, el := range entries {
+				if err != nil {
+					batch[i].Ack(err)
+					continue
+				}
+
+				if entryErr := failed[*el.Id]; entryErr != nil {
+					log.Errorf("[sink/sqs] Failed to queue %d: %s", i, entryErr)
+					batch[i].Ack(entryErr)
+					continue
+				}
+
+				batch[i].Ack(nil)
 			}
 		}
 	}
 }
 
-func (s *SQSSink) sendBatch(entries []*sqs.SendMessageBatchRequestEntry) error {
-	_, err := s.sqs.SendMessageBatch(&sqs.SendMessageBatchInput{
+// sendBatch sends the entries to SQS, and returns the error for every entry SQS did not queue
+func (s *SQSSink) sendBatch(entries []*sqs.SendMessageBatchRequestEntry) (map[string]error, error) {
+	output, err := s.sqs.SendMessageBatch(&sqs.SendMessageBatchInput{
 		Entries:  entries,
 		QueueUrl: aws.String(s.queueName),
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	failed := make(map[string]error)
+	for _, entry := range output.Failed {
+		failed[aws.StringValue(entry.Id)] = fmt.Errorf("%s: %s", aws.StringValue(entry.Code), aws.StringValue(entry.Message))
+	}
+
+	return failed, nil
+}
+
+// deduplicationID returns the SQS deduplication ID of a message, the hash of its event ID so it
+// fits the allowed length and characters, or fallback if it has none
+func deduplicationID(message *Message, fallback *string) *string {
+	if message.ID == "" {
+		return fallback
+	}
 
-	return err
+	sum := sha256.Sum256([]byte(message.ID))
+	return aws.String(hex.EncodeToString(sum[:]))
 }
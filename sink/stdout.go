@@ -10,14 +10,14 @@ import (
 // StdoutSink ...
 type StdoutSink struct {
 	stopCh chan interface{}
-	putCh  chan []byte
+	putCh  chan *Message
 }
 
 // NewStdout ...
 func NewStdout() (*StdoutSink, error) {
 	return &StdoutSink{
 		stopCh: make(chan interface{}),
-		putCh:  make(chan []byte, 1000),
+		putCh:  make(chan *Message, 1000),
 	}, nil
 }
 
@@ -51,7 +51,13 @@ func (s *StdoutSink) Stop() {
 }
 
 // Put ..
-func (s *StdoutSink) Put(data []byte) error {
-	fmt.Println(string(data))
+func (s *StdoutSink) Put(message *Message) error {
+	fmt.Println(string(message.Data))
+	message.Ack(nil)
 	return nil
 }
+
+// QueueDepth returns the number of messages waiting to be written
+func (s *StdoutSink) QueueDepth() int {
+	return len(s.putCh)
+}
@@ -1,8 +1,129 @@
 package sink
 
+import (
+	"encoding/json"
+	"sync"
+)
+
 // Sink ...
 type Sink interface {
 	Start() error
 	Stop()
-	Put(data []byte) error
+	Put(message *Message) error
+}
+
+// AckFunc is called once a sink has written a message (err == nil) or gave up on it
+type AckFunc func(err error)
+
+// Message is a single payload written to a Sink
+type Message struct {
+	Data []byte
+	Metadata
+
+	// Event is the event as published by the firehose, before it was transformed or wrapped in
+	// an envelope or CloudEvent, set by ForFirehose. The filters of a FanoutSink match it
+	Event []byte
+
+	// ContentType is the media type of Data, application/json if empty
+	ContentType string
+
+	// Attributes are the CloudEvents attributes of binary mode CloudEvents, sent as native
+	// headers by the sinks supporting them
+	Attributes map[string]string
+
+	ack AckFunc
+}
+
+// Metadata describes the event held by a Message
+type Metadata struct {
+	// ID is the deterministic ID of the event, empty if it has none. Sinks supporting it use it
+	// to deduplicate events delivered more than once
+	ID string
+
+	Type     string // kind of event within its firehose type in snake_case, e.g. task_event
+	Region   string // Nomad region the event comes from
+	Index    uint64 // Nomad index (e.g. ModifyIndex) the event comes from, 0 if it has none
+	Firehose string // firehose type the event comes from, set by ForFirehose
+}
+
+// NewMessage creates a Message, ack may be nil if the caller does not care about delivery
+func NewMessage(data []byte, ack AckFunc) *Message {
+	return &Message{
+		Data: data,
+		ack:  ack,
+	}
+}
+
+// NewEventMessage creates a Message for an event described by meta, data must be a JSON object
+// and the ID of the event is added to it as its EventID field
+func NewEventMessage(meta Metadata, data []byte, ack AckFunc) *Message {
+	m := NewMessage(withEventID(meta.ID, data), ack)
+	m.Metadata = meta
+	return m
+}
+
+// withEventID adds the EventID field first in the JSON object data
+func withEventID(id string, data []byte) []byte {
+	if len(data) < 2 || data[0] != '{' {
+		return data
+	}
+
+	field, _ := json.Marshal(id)
+
+	b := make([]byte, 0, len(data)+len(field)+12)
+	b = append(b, `{"EventID":`...)
+	b = append(b, field...)
+	if rest := data[1:]; len(rest) > 0 && rest[0] != '}' {
+		b = append(b, ',')
+	}
+	return append(b, data[1:]...)
+}
+
+// Ack reports the outcome of writing the message to the sink
+func (m *Message) Ack(err error) {
+	if m.ack != nil {
+		m.ack(err)
+	}
+}
+
+// withAck returns a copy of the message calling ack instead, used by sinks wrapping other sinks
+func (m *Message) withAck(ack AckFunc) *Message {
+	c := *m
+	c.ack = ack
+	return &c
+}
+
+// AckAll returns an AckFunc calling ack once it has been called n times, with the first error
+// if any, used when a single update is written as several messages
+func AckAll(ack AckFunc, n int) AckFunc {
+	var (
+		lock     sync.Mutex
+		firstErr error
+	)
+
+	return func(err error) {
+		lock.Lock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		n--
+		done := n == 0
+		lock.Unlock()
+
+		if done && ack != nil {
+			ack(firstErr)
+		}
+	}
+}
+
+// droppedError is the error a sink acks a message with when it gives up on it because retrying
+// won't help, e.g. an event that can't be encoded. The message is counted as dropped, and acked
+// upstream as written so the checkpoint moves past it
+type droppedError struct {
+	reason string
+	err    error
+}
+
+func (e *droppedError) Error() string {
+	return e.err.Error()
 }
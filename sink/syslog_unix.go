@@ -17,7 +17,7 @@ type SyslogSink struct {
 	priority syslog.Priority
 	tag      string
 	stopCh   chan interface{}
-	putCh    chan []byte
+	putCh    chan *Message
 }
 
 // NewSyslog ...
@@ -50,7 +50,7 @@ func NewSyslog() (*SyslogSink, error) {
 		priority: syslog.LOG_INFO,
 
 		stopCh: make(chan interface{}),
-		putCh:  make(chan []byte, 1000),
+		putCh:  make(chan *Message, 1000),
 	}, nil
 }
 
@@ -86,11 +86,16 @@ func (s *SyslogSink) Stop() {
 }
 
 // Put ..
-func (s *SyslogSink) Put(data []byte) error {
-	s.putCh <- data
+func (s *SyslogSink) Put(message *Message) error {
+	s.putCh <- message
 	return nil
 }
 
+// QueueDepth returns the number of messages waiting to be written
+func (s *SyslogSink) QueueDepth() int {
+	return len(s.putCh)
+}
+
 func (s *SyslogSink) write() error {
 	log.Infof("[sink/syslog] Starting writer - %s://%s - tag: %s", s.proto, s.addr, s.tag)
 	writer, err := syslog.Dial(s.proto, s.addr, syslog.LOG_NOTICE, s.tag)
@@ -101,12 +106,14 @@ func (s *SyslogSink) write() error {
 
 	for {
 		select {
-		case data := <-s.putCh:
+		case message := <-s.putCh:
 			// fmt.Fprint(writer, string(data))
-			_, err := writer.Write(data)
+			_, err := writer.Write(message.Data)
 			if err != nil {
 				log.Infof("[sink/syslog] ERROR writing to syslog: %q", err)
 			}
+
+			message.Ack(err)
 		}
 	}
 }
@@ -14,7 +14,7 @@ func NewSyslog() (*SyslogSink, error) {
 }
 
 // Put ...
-func (s *SyslogSink) Put(_ []byte) error {
+func (s *SyslogSink) Put(_ *Message) error {
 	return nil
 }
 
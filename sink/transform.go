@@ -0,0 +1,65 @@
+package sink
+
+import (
+	"fmt"
+
+	"github.com/seatgeek/nomad-firehose/metrics"
+	"github.com/seatgeek/nomad-firehose/transform"
+	log "github.com/sirupsen/logrus"
+)
+
+// TransformSink rewrites the events of a firehose type before they reach the wrapped sink
+type TransformSink struct {
+	sink        Sink
+	transformer *transform.Transformer
+	firehose    string
+}
+
+// NewTransformSink wraps s with the transformation configured for the firehose type, s is
+// returned as-is if the firehose has no transformation
+func NewTransformSink(s Sink, firehose string) (Sink, error) {
+	t, err := transform.ForFirehose(firehose)
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil {
+		return s, nil
+	}
+
+	if avroEncoded {
+		return nil, fmt.Errorf("%s events can't be transformed, the Avro schemas describe untransformed events", firehose)
+	}
+
+	return &TransformSink{
+		sink:        s,
+		transformer: t,
+		firehose:    firehose,
+	}, nil
+}
+
+// Start ...
+func (s *TransformSink) Start() error {
+	return s.sink.Start()
+}
+
+// Stop ...
+func (s *TransformSink) Stop() {
+	s.sink.Stop()
+}
+
+// Put ..
+func (s *TransformSink) Put(message *Message) error {
+	data, err := s.transformer.Transform(message.Data)
+	if err != nil {
+		// Retrying won't help, so drop the event rather than holding back the checkpoint forever
+		log.Errorf("[sink/transform] Could not transform %s event, dropping it: %s", s.firehose, err)
+		metrics.TransformErrors.Inc(s.firehose)
+		message.Ack(nil)
+		return nil
+	}
+
+	m := *message
+	m.Data = data
+	return s.sink.Put(&m)
+}
@@ -0,0 +1,281 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// allFirehoses is the key of the transform file config applying to every firehose type
+const allFirehoses = "*"
+
+// firehoseNames maps the subcommands of the firehose types whose internal name differs to it,
+// so the transform file can be keyed by either
+var firehoseNames = map[string]string{"jobliststubs": "jobliststub"}
+
+// Config is the transformation of the events of a firehose type, applied in order:
+// field projection and renaming, static enrichment, and template rendering
+type Config struct {
+	// Fields to keep, as "Selector" or "Selector:NewName", all fields are kept if empty
+	Fields []string `json:"fields"`
+
+	// Add static fields to the event, e.g. the cluster name
+	Add map[string]string `json:"add"`
+
+	// Template rendering the event, the output is sent as-is instead of JSON
+	Template string `json:"template"`
+}
+
+// Transformer rewrites the JSON encoded events of a firehose type
+type Transformer struct {
+	fields   []field
+	add      map[string]string
+	template *template.Template
+}
+
+type field struct {
+	from []string
+	to   []string
+}
+
+var (
+	defaultConfig  Config
+	firehoseConfig map[string]Config
+)
+
+// Configure the transformation applied to all firehose types from the --transform-* flags, and
+// the --transform-file holding config per firehose type. Everything is parsed up front so
+// invalid config is reported at startup
+func Configure(fields, add, tmpl, templateFile, path string) error {
+	defaultConfig = Config{}
+	firehoseConfig = make(map[string]Config)
+
+	if fields != "" {
+		defaultConfig.Fields = strings.Split(fields, ",")
+	}
+
+	if add != "" {
+		defaultConfig.Add = make(map[string]string)
+		for _, pair := range strings.Split(add, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return fmt.Errorf("Invalid field to add %q, must be name=value", pair)
+			}
+			defaultConfig.Add[strings.TrimSpace(kv[0])] = kv[1]
+		}
+	}
+
+	defaultConfig.Template = tmpl
+	if templateFile != "" {
+		data, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			return fmt.Errorf("Could not read template file: %s", err)
+		}
+		defaultConfig.Template = string(data)
+	}
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Could not read transform file: %s", err)
+		}
+
+		if err := json.Unmarshal(data, &firehoseConfig); err != nil {
+			return fmt.Errorf("Could not parse transform file %s: %s", path, err)
+		}
+	}
+
+	if _, err := New(defaultConfig); err != nil {
+		return err
+	}
+
+	for name, config := range firehoseConfig {
+		if _, err := New(merge(defaultConfig, config)); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// ForFirehose returns the transformer configured for a firehose type, nil if it has none
+func ForFirehose(name string) (*Transformer, error) {
+	config := merge(merge(defaultConfig, firehoseConfig[allFirehoses]), firehoseConfig[name])
+	for command, n := range firehoseNames {
+		if n == name {
+			config = merge(config, firehoseConfig[command])
+		}
+	}
+	if len(config.Fields) == 0 && len(config.Add) == 0 && config.Template == "" {
+		return nil, nil
+	}
+
+	log.WithField("type", name).Infof("Transforming events, fields: %q add: %q template: %t", config.Fields, config.Add, config.Template != "")
+	return New(config)
+}
+
+// merge returns base overridden by the fields and template set in override, fields to add are merged
+func merge(base, override Config) Config {
+	c := Config{
+		Fields:   base.Fields,
+		Add:      make(map[string]string),
+		Template: base.Template,
+	}
+
+	if len(override.Fields) > 0 {
+		c.Fields = override.Fields
+	}
+
+	if override.Template != "" {
+		c.Template = override.Template
+	}
+
+	for k, v := range base.Add {
+		c.Add[k] = v
+	}
+	for k, v := range override.Add {
+		c.Add[k] = v
+	}
+
+	return c
+}
+
+// New creates a Transformer from config
+func New(config Config) (*Transformer, error) {
+	t := &Transformer{
+		add: config.Add,
+	}
+
+	for _, f := range config.Fields {
+		parts := strings.SplitN(strings.TrimSpace(f), ":", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("Invalid field %q", f)
+		}
+
+		to := parts[0]
+		if len(parts) == 2 && parts[1] != "" {
+			to = parts[1]
+		}
+
+		t.fields = append(t.fields, field{
+			from: strings.Split(parts[0], "."),
+			to:   strings.Split(to, "."),
+		})
+	}
+
+	if config.Template != "" {
+		tmpl, err := template.New("event").Funcs(funcs).Option("missingkey=zero").Parse(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid template: %s", err)
+		}
+		t.template = tmpl
+	}
+
+	return t, nil
+}
+
+// Transform a JSON encoded event
+func (t *Transformer) Transform(data []byte) ([]byte, error) {
+	// Decode numbers as json.Number, so large values like timestamps in nanoseconds keep their precision
+	var event interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		return nil, err
+	}
+
+	if len(t.fields) > 0 {
+		projected := make(map[string]interface{})
+		for _, f := range t.fields {
+			if v, ok := lookup(event, f.from); ok {
+				set(projected, f.to, v)
+			}
+		}
+		event = projected
+	}
+
+	if len(t.add) > 0 {
+		m, ok := event.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Can't add fields to a %T event", event)
+		}
+
+		for k, v := range t.add {
+			set(m, strings.Split(k, "."), v)
+		}
+	}
+
+	if t.template != nil {
+		var buf bytes.Buffer
+		if err := t.template.Execute(&buf, event); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	return json.Marshal(event)
+}
+
+// lookup returns the value at selector
+func lookup(v interface{}, selector []string) (interface{}, bool) {
+	for _, name := range selector {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if v, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// set the value at path, creating intermediate objects as needed
+func set(m map[string]interface{}, path []string, v interface{}) {
+	for _, name := range path[:len(path)-1] {
+		next, ok := m[name].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			m[name] = next
+		}
+		m = next
+	}
+
+	m[path[len(path)-1]] = v
+}
+
+// funcs are the functions available in templates, on top of the text/template builtins
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"replace": func(old, new string, s string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+	"join": func(sep string, v []interface{}) string {
+		parts := make([]string, len(v))
+		for i, e := range v {
+			parts[i] = fmt.Sprint(e)
+		}
+		return strings.Join(parts, sep)
+	},
+	"default": func(def, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+	"env": os.Getenv,
+}